@@ -0,0 +1,49 @@
+package balances
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
+	"github.com/xiaomi388/beancount-automation/pkg/balances"
+)
+
+var (
+	format  string
+	owner   string
+	account string
+	file    string
+)
+
+var BalancesCmd = &cobra.Command{
+	Use:   "balances",
+	Short: "print the balance history recorded by sync",
+	Long:  `Print or export the per-account balance history recorded by each sync, e.g. for net-worth charts.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		appCtx, err := app.FromContext(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		w := io.Writer(os.Stdout)
+		if file != "" {
+			f, err := os.Create(file)
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %w", file, err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		return balances.Print(appCtx, w, balances.Options{Format: format, Owner: owner, Account: account})
+	},
+}
+
+func init() {
+	BalancesCmd.Flags().StringVar(&format, "format", balances.FormatTable, "output format: table, csv or json")
+	BalancesCmd.Flags().StringVar(&owner, "owner", "", "only print the accounts of this owner")
+	BalancesCmd.Flags().StringVar(&account, "account", "", "only print the account with this id or name")
+	BalancesCmd.Flags().StringVar(&file, "file", "", "write to this file instead of stdout")
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/dump"
 )
 
@@ -15,7 +16,11 @@ var DumpCmd = &cobra.Command{
 	Use:   "dump",
 	Short: "generate beancount file",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := dump.Dump(); err != nil {
+		appCtx, err := app.FromContext(cmd.Context())
+		if err == nil {
+			err = dump.Dump(appCtx)
+		}
+		if err != nil {
 			fmt.Println(err)
 		}
 	},
@@ -9,6 +9,7 @@ import (
 
 	"github.com/plaid/plaid-go/plaid"
 	"github.com/spf13/cobra"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/link"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
@@ -23,13 +24,16 @@ var (
 var LinkCmd = &cobra.Command{
 	Use:   "link",
 	Short: "link an institution",
-	Run: func(_ *cobra.Command, _ []string) {
+	Run: func(cmd *cobra.Command, _ []string) {
 		if *accountType != string(plaid.PRODUCTS_INVESTMENTS) && *accountType != string(plaid.PRODUCTS_TRANSACTIONS) {
 			fmt.Println("account type should be either investments or transactions")
 			os.Exit(1)
 		}
 
-		err := link.Link(*owner, *institution, types.InstitutionType(*accountType))
+		appCtx, err := app.FromContext(cmd.Context())
+		if err == nil {
+			err = link.Link(appCtx, *owner, *institution, types.InstitutionType(*accountType))
+		}
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
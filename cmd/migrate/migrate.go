@@ -2,16 +2,22 @@ package migrate
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/persistence"
 )
 
 var (
-	fromBackend string
-	toBackend   string
-	sourcePath  string
-	destPath    string
+	fromBackend   string
+	toBackend     string
+	sourcePath    string
+	destPath      string
+	schemaStatus  bool
+	encryptTokens bool
 )
 
 var MigrateCmd = &cobra.Command{
@@ -19,29 +25,45 @@ var MigrateCmd = &cobra.Command{
 	Short: "migrate owner data between storage backends",
 	Long:  `Migrate owner data from one storage backend to another (e.g. json to sqlite).`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return runMigrate()
+		appCtx, err := app.FromContext(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if schemaStatus {
+			return runSchemaStatus(appCtx)
+		}
+		if encryptTokens {
+			return runEncryptTokens(appCtx)
+		}
+		return runMigrate(appCtx)
 	},
 }
 
 func init() {
-	MigrateCmd.Flags().StringVar(&fromBackend, "from", "json", "source backend (json or sqlite)")
+	MigrateCmd.Flags().StringVar(&fromBackend, "from", "", "source backend (json or sqlite, defaults to storage.backend)")
 	MigrateCmd.Flags().StringVar(&toBackend, "to", "sqlite", "destination backend (json or sqlite)")
-	MigrateCmd.Flags().StringVar(&sourcePath, "source", "", "source file path (defaults based on backend)")
-	MigrateCmd.Flags().StringVar(&destPath, "dest", "", "destination file path (defaults based on backend)")
+	MigrateCmd.Flags().StringVar(&sourcePath, "source", "", "source file path (defaults to storage.path for the configured backend, else next to the config file)")
+	MigrateCmd.Flags().StringVar(&destPath, "dest", "", "destination file path (defaults next to the config file)")
+	MigrateCmd.Flags().BoolVar(&schemaStatus, "schema-status", false, "report the schema migrations of the sqlite database at --dest (defaults to the configured store) and exit")
+	MigrateCmd.Flags().BoolVar(&encryptTokens, "encrypt-tokens", false, "encrypt the access tokens of the configured store with the key under storage.encryption")
 }
 
-func runMigrate() error {
-	if fromBackend == toBackend {
-		return fmt.Errorf("source and destination backends are the same: %s", fromBackend)
+func runMigrate(appCtx *app.Context) error {
+	from := fromBackend
+	if from == "" {
+		from = storeBackend(appCtx.Config.Storage.Backend)
+	}
+	if from == toBackend {
+		return fmt.Errorf("source and destination backends are the same: %s", from)
 	}
 
-	src, err := persistence.NewStoreWithBackend(fromBackend, sourcePath)
+	src, err := persistence.NewStoreWithBackend(from, storePath(appCtx, from, sourcePath))
 	if err != nil {
 		return fmt.Errorf("failed to open source store: %w", err)
 	}
 	defer src.Close()
 
-	dst, err := persistence.NewStoreWithBackend(toBackend, destPath)
+	dst, err := persistence.NewStoreWithBackend(toBackend, storePath(appCtx, toBackend, destPath))
 	if err != nil {
 		return fmt.Errorf("failed to open destination store: %w", err)
 	}
@@ -56,9 +78,78 @@ func runMigrate() error {
 		return fmt.Errorf("failed to write to destination: %w", err)
 	}
 
-	fmt.Printf("Successfully migrated %d owner(s) from %s to %s.\n", len(owners), fromBackend, toBackend)
+	fmt.Printf("Successfully migrated %d owner(s) from %s to %s.\n", len(owners), from, toBackend)
 	fmt.Println("Update your config.yaml to use the new backend:")
 	fmt.Println("  storage:")
 	fmt.Printf("    backend: %s\n", toBackend)
 	return nil
 }
+
+func runSchemaStatus(appCtx *app.Context) error {
+	path := storePath(appCtx, "sqlite", destPath)
+
+	current, statuses, err := persistence.SQLiteSchemaStatus(path)
+	if err != nil {
+		return fmt.Errorf("failed to read schema status: %w", err)
+	}
+
+	fmt.Printf("%s: schema version %d, latest %d\n", path, current, persistence.LatestSchemaVersion())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATUS\tDESCRIPTION")
+	for _, status := range statuses {
+		state := "pending"
+		if status.AppliedAt != "" {
+			state = "applied " + status.AppliedAt
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, state, status.Description)
+	}
+	if current > persistence.LatestSchemaVersion() {
+		fmt.Fprintf(w, "%d\tunknown\twritten by a newer bean-auto\n", current)
+	}
+	return w.Flush()
+}
+
+// storePath is the path flag when set, else the configured store when it
+// uses backend, else the backend's default file next to the config file.
+func storePath(appCtx *app.Context, backend, path string) string {
+	if path != "" {
+		return path
+	}
+	if storeBackend(appCtx.Config.Storage.Backend) == backend {
+		return appCtx.Config.Storage.Path
+	}
+	return filepath.Join(filepath.Dir(appCtx.ConfigPath), persistence.DefaultStoreFile(backend))
+}
+
+// storeBackend names the backend the store falls back to when none is configured.
+func storeBackend(name string) string {
+	if name == "" {
+		return "json"
+	}
+	return name
+}
+
+func runEncryptTokens(appCtx *app.Context) error {
+	enc := appCtx.Config.Storage.Encryption
+	if enc.KeyFile == "" && enc.KeyEnv == "" && enc.PassphraseEnv == "" {
+		return fmt.Errorf("no token key configured; set one of keyFile, keyEnv or passphraseEnv under storage.encryption")
+	}
+
+	store, err := appCtx.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	owners, err := store.LoadOwners()
+	if err != nil {
+		return fmt.Errorf("failed to load owners: %w", err)
+	}
+
+	if err := store.DumpOwners(owners); err != nil {
+		return fmt.Errorf("failed to write encrypted tokens: %w", err)
+	}
+
+	fmt.Printf("Access tokens of %d owner(s) are now encrypted.\n", len(owners))
+	return nil
+}
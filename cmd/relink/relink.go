@@ -8,6 +8,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/link"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
@@ -16,14 +17,25 @@ var (
 	owner           *string
 	institution     *string
 	institutionType *string
+	pending         *bool
 )
 
 // linkCmd represents the link command
 var RelinkCmd = &cobra.Command{
 	Use:   "relink",
 	Short: "relink an institution",
-	Run: func(_ *cobra.Command, _ []string) {
-		err := link.Relink(*owner, *institution, types.InstitutionType(*institutionType))
+	Run: func(cmd *cobra.Command, _ []string) {
+		appCtx, err := app.FromContext(cmd.Context())
+		if err == nil {
+			if *pending {
+				err = link.RelinkPending(appCtx)
+			} else if *owner == "" || *institution == "" {
+				err = fmt.Errorf("--owner and --institution are required unless --pending is set")
+			} else {
+				err = link.Relink(appCtx, *owner, *institution, types.InstitutionType(*institutionType))
+			}
+		}
+
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -33,11 +45,10 @@ var RelinkCmd = &cobra.Command{
 
 func init() {
 	owner = RelinkCmd.PersistentFlags().String("owner", "", "")
-	_ = RelinkCmd.MarkPersistentFlagRequired("owner")
 
 	institution = RelinkCmd.PersistentFlags().String("institution", "", "")
-	_ = RelinkCmd.MarkPersistentFlagRequired("institution")
 
 	institutionType = RelinkCmd.PersistentFlags().String("type", "transactions", "type of the linked account")
-	_ = RelinkCmd.MarkPersistentFlagRequired("type")
+
+	pending = RelinkCmd.PersistentFlags().Bool("pending", false, "relink every institution flagged by sync as needing re-authentication")
 }
@@ -8,13 +8,18 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/xiaomi388/beancount-automation/cmd/balances"
 	"github.com/xiaomi388/beancount-automation/cmd/dump"
 	"github.com/xiaomi388/beancount-automation/cmd/link"
 	"github.com/xiaomi388/beancount-automation/cmd/migrate"
 	"github.com/xiaomi388/beancount-automation/cmd/relink"
 	"github.com/xiaomi388/beancount-automation/cmd/sync"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 )
 
+// options holds the global flags, resolved by each command via app.FromContext.
+var options app.Options
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "beancountautomation",
@@ -44,11 +49,10 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	//p, err := os.Getwd()
-	//if err != nil {
-	//	panic(err)
-	//}
-	//rootCmd.PersistentFlags().StringVar(&config.ConfigPath, "config", filepath.Join(p, "config.yaml"), "config file (default is config.yaml)")
+	options.Register(rootCmd.PersistentFlags())
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		cmd.SetContext(app.WithOptions(cmd.Context(), options))
+	}
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -60,5 +64,6 @@ func init() {
 	rootCmd.AddCommand(link.LinkCmd)
 	rootCmd.AddCommand(relink.RelinkCmd)
 	rootCmd.AddCommand(migrate.MigrateCmd)
+	rootCmd.AddCommand(balances.BalancesCmd)
 
 }
@@ -6,8 +6,10 @@ package sync
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/sync"
 )
 
@@ -16,8 +18,13 @@ var SyncCmd = &cobra.Command{
 	Use:   "sync",
 	Short: "sync transactions from plaid",
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := sync.Sync(); err != nil {
+		appCtx, err := app.FromContext(cmd.Context())
+		if err == nil {
+			err = sync.Sync(appCtx)
+		}
+		if err != nil {
 			fmt.Println(err)
+			os.Exit(1)
 		}
 	},
 }
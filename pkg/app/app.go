@@ -0,0 +1,132 @@
+// Package app resolves the global command-line flags into the context every
+// command runs with.
+package app
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/pflag"
+	"github.com/xiaomi388/beancount-automation/pkg/persistence"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+const (
+	defaultConfigFile    = "config.yaml"
+	defaultBeancountFile = "plaid_gen.beancount"
+)
+
+// Options are the global flags shared by every command.
+type Options struct {
+	ConfigPath string
+	StorePath  string
+	OutputPath string
+}
+
+// Register binds o to the persistent flags of the root command.
+func (o *Options) Register(flags *pflag.FlagSet) {
+	flags.StringVar(&o.ConfigPath, "config", defaultConfigFile, "config file")
+	flags.StringVar(&o.StorePath, "store", "", "owner data file (defaults to storage.path, next to the config file)")
+	flags.StringVar(&o.OutputPath, "output", "", "generated beancount file (defaults to "+defaultBeancountFile+" next to the config file)")
+}
+
+// Context is the resolved configuration a command runs with. Relative paths
+// in the config file are resolved against the config file's directory, so a
+// ledger works the same from any working directory.
+type Context struct {
+	ConfigPath string
+	OutputPath string
+	Config     types.Config
+}
+
+// Load reads the config file named by opts and resolves every path.
+func Load(opts Options) (*Context, error) {
+	configPath, err := filepath.Abs(opts.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve config path: %w", err)
+	}
+
+	cfg, err := persistence.LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	dir := filepath.Dir(configPath)
+	cfg.Storage.Path = resolvePath(dir, cfg.Storage.Path)
+	if opts.StorePath != "" {
+		if cfg.Storage.Path, err = filepath.Abs(opts.StorePath); err != nil {
+			return nil, fmt.Errorf("failed to resolve store path: %w", err)
+		}
+	}
+	if cfg.Storage.Path == "" {
+		cfg.Storage.Path = filepath.Join(dir, persistence.DefaultStoreFile(cfg.Storage.Backend))
+	}
+	cfg.Storage.Encryption.KeyFile = resolvePath(dir, cfg.Storage.Encryption.KeyFile)
+	for _, path := range []*string{
+		&cfg.Dump.Categories.File,
+		&cfg.Dump.Templates.Transaction,
+		&cfg.Dump.Templates.OpenAccount,
+		&cfg.Dump.Templates.Commodity,
+		&cfg.Dump.Templates.Holding,
+		&cfg.Dump.Templates.Price,
+	} {
+		*path = resolvePath(dir, *path)
+	}
+
+	outputPath := filepath.Join(dir, defaultBeancountFile)
+	if opts.OutputPath != "" {
+		if outputPath, err = filepath.Abs(opts.OutputPath); err != nil {
+			return nil, fmt.Errorf("failed to resolve output path: %w", err)
+		}
+	}
+
+	return &Context{
+		ConfigPath: configPath,
+		OutputPath: outputPath,
+		Config:     cfg,
+	}, nil
+}
+
+// OpenStore opens the owner data store named by the config.
+func (c *Context) OpenStore() (persistence.Store, error) {
+	store, err := persistence.NewStore(c.Config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store: %w", err)
+	}
+	return store, nil
+}
+
+// PlaidConfig returns the config with its Plaid credentials resolved from
+// env:, file: or cmd: references. Commands resolve them once and pass the
+// result to everything that talks to Plaid.
+func (c *Context) PlaidConfig() (types.Config, error) {
+	cfg, err := persistence.ResolveConfigSecrets(c.Config)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to resolve config secrets: %w", err)
+	}
+	return cfg, nil
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+type optionsKey struct{}
+
+// WithOptions attaches the parsed global flags to ctx.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, opts)
+}
+
+// FromContext loads the Context for the global flags attached to ctx.
+func FromContext(ctx context.Context) (*Context, error) {
+	opts, ok := ctx.Value(optionsKey{}).(Options)
+	if !ok {
+		opts = Options{ConfigPath: defaultConfigFile}
+	}
+	return Load(opts)
+}
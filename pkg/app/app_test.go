@@ -0,0 +1,90 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadResolvesPathsAgainstConfigDir(t *testing.T) {
+	ledger := t.TempDir()
+	configPath := writeConfig(t, ledger, "storage:\n  backend: sqlite\n  encryption:\n    keyFile: secrets/token.key\ndump:\n  categories:\n    file: categories.yaml\n  templates:\n    transaction: templates/txn.tpl\n    holding: /abs/holding.tpl\n")
+
+	appCtx, err := Load(Options{ConfigPath: configPath})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if want := filepath.Join(ledger, "owners.db"); appCtx.Config.Storage.Path != want {
+		t.Errorf("store path = %q, want %q", appCtx.Config.Storage.Path, want)
+	}
+	if want := filepath.Join(ledger, "secrets", "token.key"); appCtx.Config.Storage.Encryption.KeyFile != want {
+		t.Errorf("key file = %q, want %q", appCtx.Config.Storage.Encryption.KeyFile, want)
+	}
+	if want := filepath.Join(ledger, "templates", "txn.tpl"); appCtx.Config.Dump.Templates.Transaction != want {
+		t.Errorf("transaction template = %q, want %q", appCtx.Config.Dump.Templates.Transaction, want)
+	}
+	if want := "/abs/holding.tpl"; appCtx.Config.Dump.Templates.Holding != want {
+		t.Errorf("holding template = %q, want %q", appCtx.Config.Dump.Templates.Holding, want)
+	}
+	if want := filepath.Join(ledger, "categories.yaml"); appCtx.Config.Dump.Categories.File != want {
+		t.Errorf("categories file = %q, want %q", appCtx.Config.Dump.Categories.File, want)
+	}
+	if want := filepath.Join(ledger, "plaid_gen.beancount"); appCtx.OutputPath != want {
+		t.Errorf("output path = %q, want %q", appCtx.OutputPath, want)
+	}
+}
+
+func TestLoadFlagsOverrideConfig(t *testing.T) {
+	ledger := t.TempDir()
+	configPath := writeConfig(t, ledger, "storage:\n  backend: json\n  path: data/owners.yaml\n")
+
+	appCtx, err := Load(Options{ConfigPath: configPath})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if want := filepath.Join(ledger, "data", "owners.yaml"); appCtx.Config.Storage.Path != want {
+		t.Errorf("store path = %q, want %q", appCtx.Config.Storage.Path, want)
+	}
+
+	out := t.TempDir()
+	appCtx, err = Load(Options{
+		ConfigPath: configPath,
+		StorePath:  filepath.Join(out, "other.yaml"),
+		OutputPath: filepath.Join(out, "ledger.beancount"),
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if want := filepath.Join(out, "other.yaml"); appCtx.Config.Storage.Path != want {
+		t.Errorf("store path = %q, want %q", appCtx.Config.Storage.Path, want)
+	}
+	if want := filepath.Join(out, "ledger.beancount"); appCtx.OutputPath != want {
+		t.Errorf("output path = %q, want %q", appCtx.OutputPath, want)
+	}
+}
+
+func TestLoadMissingConfig(t *testing.T) {
+	if _, err := Load(Options{ConfigPath: filepath.Join(t.TempDir(), "config.yaml")}); err == nil {
+		t.Errorf("expected error for missing config")
+	}
+}
+
+func TestLoadRejectsInvalidRuleRegex(t *testing.T) {
+	configPath := writeConfig(t, t.TempDir(), "postprocess:\n  categorise:\n    keyword_rules:\n      - match:\n          payee:\n            equals: Cafe\n      - match:\n          description:\n            regex: \"(unclosed\"\n")
+
+	_, err := Load(Options{ConfigPath: configPath})
+	if err == nil || !strings.Contains(err.Error(), "postprocess.categorise.keyword_rules[1].match.description.regex") {
+		t.Fatalf("Load error = %v, want invalid regex of rule 1", err)
+	}
+}
@@ -0,0 +1,204 @@
+package balances
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/shopspring/decimal"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+const (
+	FormatTable = "table"
+	FormatCSV   = "csv"
+	FormatJSON  = "json"
+)
+
+// Options selects the balance history to print and how.
+type Options struct {
+	Format string
+	// Owner and Account limit the history to one owner and to accounts
+	// whose id or name matches.
+	Owner   string
+	Account string
+}
+
+// Row is one balance snapshot of one account.
+type Row struct {
+	Owner           string                `json:"owner"`
+	Institution     string                `json:"institution"`
+	InstitutionType types.InstitutionType `json:"institutionType"`
+	AccountID       string                `json:"accountId"`
+	AccountName     string                `json:"accountName"`
+	AccountType     string                `json:"accountType"`
+	FetchedAt       time.Time             `json:"fetchedAt"`
+	Currency        string                `json:"currency"`
+	Available       *json.Number          `json:"available"`
+	Current         *json.Number          `json:"current"`
+	Limit           *json.Number          `json:"limit"`
+}
+
+// Print writes the balance history recorded by sync to w.
+func Print(appCtx *app.Context, w io.Writer, opts Options) error {
+	store, err := appCtx.OpenStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	owners, err := store.LoadOwners()
+	if err != nil {
+		return fmt.Errorf("failed to load owners: %w", err)
+	}
+
+	return Write(w, opts.Format, Collect(owners, opts))
+}
+
+// Collect flattens the balance history of every account matching opts,
+// ordered by owner, institution, account and fetch time.
+func Collect(owners []types.Owner, opts Options) []Row {
+	var rows []Row
+	add := func(owner types.Owner, inst types.InstitutionBase, instType types.InstitutionType, base plaid.AccountBase, history []types.BalanceSnapshot) {
+		if opts.Account != "" && opts.Account != base.AccountId && opts.Account != base.Name {
+			return
+		}
+		for _, snapshot := range history {
+			rows = append(rows, newRow(owner.Name, inst.Name, instType, base, snapshot))
+		}
+	}
+
+	for _, owner := range owners {
+		if opts.Owner != "" && opts.Owner != owner.Name {
+			continue
+		}
+		for _, inst := range owner.TransactionInstitutions {
+			for _, account := range inst.TransactionAccounts {
+				add(owner, inst.InstitutionBase, types.InstitutionTypeTransaction, account.AccoutBase, account.BalanceHistory)
+			}
+		}
+		for _, inst := range owner.InvestmentInstitutions {
+			for _, account := range inst.InvestmentAccounts {
+				add(owner, inst.InstitutionBase, types.InstitutionTypeInvestment, account.AccoutBase, account.BalanceHistory)
+			}
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		if a.Institution != b.Institution {
+			return a.Institution < b.Institution
+		}
+		if a.AccountName != b.AccountName {
+			return a.AccountName < b.AccountName
+		}
+		if a.AccountID != b.AccountID {
+			return a.AccountID < b.AccountID
+		}
+		return a.FetchedAt.Before(b.FetchedAt)
+	})
+	return rows
+}
+
+func newRow(owner, institution string, instType types.InstitutionType, base plaid.AccountBase, snapshot types.BalanceSnapshot) Row {
+	currency := snapshot.Balances.GetIsoCurrencyCode()
+	if currency == "" {
+		currency = snapshot.Balances.GetUnofficialCurrencyCode()
+	}
+
+	return Row{
+		Owner:           owner,
+		Institution:     institution,
+		InstitutionType: instType,
+		AccountID:       base.AccountId,
+		AccountName:     base.Name,
+		AccountType:     string(base.Type),
+		FetchedAt:       snapshot.FetchedAt.UTC(),
+		Currency:        currency,
+		Available:       number(snapshot.Balances.Available),
+		Current:         number(snapshot.Balances.Current),
+		Limit:           number(snapshot.Balances.Limit),
+	}
+}
+
+// number keeps the shortest decimal that round-trips the float32 Plaid
+// reported, so 995.01 is not exported as 995.010009765625.
+func number(v plaid.NullableFloat32) *json.Number {
+	f := v.Get()
+	if f == nil {
+		return nil
+	}
+	n := json.Number(decimal.NewFromFloat32(*f).String())
+	return &n
+}
+
+// Write renders rows in format: "table" (default), "csv" or "json".
+func Write(w io.Writer, format string, rows []Row) error {
+	switch format {
+	case "", FormatTable:
+		return writeTable(w, rows)
+	case FormatCSV:
+		return writeCSV(w, rows)
+	case FormatJSON:
+		if rows == nil {
+			rows = []Row{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rows); err != nil {
+			return fmt.Errorf("failed to encode balances: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown balances format %q: want %s, %s or %s", format, FormatTable, FormatCSV, FormatJSON)
+	}
+}
+
+var csvHeader = []string{"owner", "institution", "institution_type", "account_id", "account_name", "account_type", "fetched_at", "currency", "available", "current", "limit"}
+
+func writeCSV(w io.Writer, rows []Row) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return fmt.Errorf("failed to write balances: %w", err)
+	}
+	for _, row := range rows {
+		if err := cw.Write([]string{
+			row.Owner, row.Institution, string(row.InstitutionType), row.AccountID, row.AccountName, row.AccountType,
+			row.FetchedAt.Format(time.RFC3339), row.Currency, text(row.Available), text(row.Current), text(row.Limit),
+		}); err != nil {
+			return fmt.Errorf("failed to write balances: %w", err)
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to write balances: %w", err)
+	}
+	return nil
+}
+
+func writeTable(w io.Writer, rows []Row) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OWNER\tINSTITUTION\tACCOUNT\tFETCHED AT\tAVAILABLE\tCURRENT\tCURRENCY")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			row.Owner, row.Institution, row.AccountName, row.FetchedAt.Format(time.RFC3339),
+			text(row.Available), text(row.Current), row.Currency)
+	}
+	return tw.Flush()
+}
+
+func text(n *json.Number) string {
+	if n == nil {
+		return ""
+	}
+	return n.String()
+}
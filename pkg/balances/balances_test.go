@@ -0,0 +1,117 @@
+package balances
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func snapshot(accountID string, day int, available *float32, current float32) types.BalanceSnapshot {
+	return types.BalanceSnapshot{
+		AccountID: accountID,
+		FetchedAt: time.Date(2024, 3, day, 12, 0, 0, 0, time.UTC),
+		Balances: plaid.AccountBalance{
+			Available:       *plaid.NewNullableFloat32(available),
+			Current:         *plaid.NewNullableFloat32(&current),
+			IsoCurrencyCode: *plaid.NewNullableString(plaid.PtrString("USD")),
+		},
+	}
+}
+
+func newTestOwners() []types.Owner {
+	available := float32(995.01)
+	return []types.Owner{
+		{
+			Name: "bob",
+			TransactionInstitutions: []types.TransactionInstitution{{
+				InstitutionBase: types.InstitutionBase{Name: "bank"},
+				TransactionAccounts: []types.TransactionAccount{{
+					AccoutBase:     plaid.AccountBase{AccountId: "bob-1", Name: "Checking", Type: plaid.ACCOUNTTYPE_DEPOSITORY},
+					BalanceHistory: []types.BalanceSnapshot{snapshot("bob-1", 1, &available, 1000)},
+				}},
+			}},
+		},
+		{
+			Name: "alice",
+			TransactionInstitutions: []types.TransactionInstitution{{
+				InstitutionBase: types.InstitutionBase{Name: "bank"},
+				TransactionAccounts: []types.TransactionAccount{{
+					AccoutBase: plaid.AccountBase{AccountId: "alice-1", Name: "Checking", Type: plaid.ACCOUNTTYPE_DEPOSITORY},
+					BalanceHistory: []types.BalanceSnapshot{
+						snapshot("alice-1", 1, &available, 1000),
+						snapshot("alice-1", 2, nil, 1200.5),
+					},
+				}},
+			}},
+			InvestmentInstitutions: []types.InvestmentInstitution{{
+				InstitutionBase: types.InstitutionBase{Name: "broker"},
+				InvestmentAccounts: []types.InvestmentAccount{{
+					AccoutBase:     plaid.AccountBase{AccountId: "alice-2", Name: "Brokerage", Type: plaid.ACCOUNTTYPE_INVESTMENT},
+					BalanceHistory: []types.BalanceSnapshot{snapshot("alice-2", 1, nil, 5000)},
+				}},
+			}},
+		},
+	}
+}
+
+func TestCollect(t *testing.T) {
+	var got []string
+	for _, row := range Collect(newTestOwners(), Options{}) {
+		got = append(got, row.Owner+"/"+row.AccountID+"/"+row.FetchedAt.Format("02"))
+	}
+	want := "alice/alice-1/01,alice/alice-1/02,alice/alice-2/01,bob/bob-1/01"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("Collect = %v, want %s", got, want)
+	}
+
+	rows := Collect(newTestOwners(), Options{Owner: "alice", Account: "Brokerage"})
+	if len(rows) != 1 || rows[0].AccountID != "alice-2" || rows[0].InstitutionType != types.InstitutionTypeInvestment {
+		t.Fatalf("filtered Collect = %+v, want only alice-2", rows)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, FormatCSV, Collect(newTestOwners(), Options{Owner: "alice", Account: "alice-1"})); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	want := `owner,institution,institution_type,account_id,account_name,account_type,fetched_at,currency,available,current,limit
+alice,bank,transactions,alice-1,Checking,depository,2024-03-01T12:00:00Z,USD,995.01,1000,
+alice,bank,transactions,alice-1,Checking,depository,2024-03-02T12:00:00Z,USD,,1200.5,
+`
+	if buf.String() != want {
+		t.Fatalf("csv = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, FormatJSON, Collect(newTestOwners(), Options{Owner: "bob"})); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rows); err != nil {
+		t.Fatalf("invalid json %s: %v", buf.String(), err)
+	}
+	if len(rows) != 1 || rows[0]["available"] != 995.01 || rows[0]["limit"] != nil || rows[0]["fetchedAt"] != "2024-03-01T12:00:00Z" {
+		t.Fatalf("unexpected json rows %s", buf.String())
+	}
+
+	buf.Reset()
+	if err := Write(&buf, FormatJSON, nil); err != nil || strings.TrimSpace(buf.String()) != "[]" {
+		t.Fatalf("empty json = %q, %v; want []", buf.String(), err)
+	}
+}
+
+func TestWriteRejectsUnknownFormat(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, "xml", nil); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+}
@@ -0,0 +1,116 @@
+package dump
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+var accountRoots = map[string]bool{"Assets": true, "Liabilities": true, "Equity": true, "Income": true, "Expenses": true}
+
+// accountConfig returns the accounts entry for an account, looked up by
+// Plaid account id and then by "owner/institution/mask".
+func accountConfig(accounts map[string]types.AccountConfig, owner types.Owner, inst types.InstitutionBase, base plaid.AccountBase) types.AccountConfig {
+	if cfg, ok := accounts[base.AccountId]; ok {
+		return cfg
+	}
+	if mask := base.GetMask(); mask != "" {
+		return accounts[owner.Name+"/"+inst.Name+"/"+mask]
+	}
+	return types.AccountConfig{}
+}
+
+// accountType is the root of a configured name, else the configured type,
+// else typ.
+func accountType(cfg types.AccountConfig, typ string) string {
+	if cfg.Name != "" {
+		return strings.SplitN(cfg.Name, ":", 2)[0]
+	}
+	if cfg.Type != "" {
+		return cfg.Type
+	}
+	return typ
+}
+
+func validateAccountConfigs(accounts map[string]types.AccountConfig) error {
+	keys := make([]string, 0, len(accounts))
+	for key := range accounts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		cfg := accounts[key]
+		switch cfg.Type {
+		case "", "Assets", "Liabilities":
+		default:
+			return fmt.Errorf("invalid accounts.%s.type %q: want \"Assets\" or \"Liabilities\"", key, cfg.Type)
+		}
+
+		if cfg.Name == "" {
+			continue
+		}
+		if err := validateAccountName(cfg.Name); err != nil {
+			return fmt.Errorf("invalid accounts.%s.name: %w", key, err)
+		}
+		if root := accountType(cfg, ""); root != "Assets" && root != "Liabilities" {
+			return fmt.Errorf("invalid accounts.%s.name %q: want an Assets or Liabilities account", key, cfg.Name)
+		}
+		if cfg.Type != "" && accountType(cfg, "") != cfg.Type {
+			return fmt.Errorf("invalid accounts.%s: name %s is not under type %s", key, cfg.Name, cfg.Type)
+		}
+	}
+	return nil
+}
+
+func validateAccountName(name string) error {
+	components := strings.Split(name, ":")
+	if !accountRoots[components[0]] {
+		return fmt.Errorf("%q must start with Assets, Liabilities, Equity, Income or Expenses", name)
+	}
+	if len(components) < 2 {
+		return fmt.Errorf("%q needs at least one component after %s", name, components[0])
+	}
+	for _, c := range components[1:] {
+		if !accountComponentRE.MatchString(c) {
+			return fmt.Errorf("%q has invalid component %q: want a capital letter or digit followed by letters, digits or dashes", name, c)
+		}
+	}
+	return nil
+}
+
+// excludeAccounts returns owners without the accounts configured to be
+// excluded, leaving owners itself untouched.
+func excludeAccounts(accounts map[string]types.AccountConfig, owners []types.Owner) []types.Owner {
+	if len(accounts) == 0 {
+		return owners
+	}
+
+	kept := make([]types.Owner, 0, len(owners))
+	for _, owner := range owners {
+		o := types.Owner{Name: owner.Name}
+		for _, inst := range owner.TransactionInstitutions {
+			i := types.TransactionInstitution{InstitutionBase: inst.InstitutionBase}
+			for _, account := range inst.TransactionAccounts {
+				if !accountConfig(accounts, owner, inst.InstitutionBase, account.AccoutBase).Exclude {
+					i.TransactionAccounts = append(i.TransactionAccounts, account)
+				}
+			}
+			o.TransactionInstitutions = append(o.TransactionInstitutions, i)
+		}
+		for _, inst := range owner.InvestmentInstitutions {
+			i := types.InvestmentInstitution{InstitutionBase: inst.InstitutionBase}
+			for _, account := range inst.InvestmentAccounts {
+				if !accountConfig(accounts, owner, inst.InstitutionBase, account.AccoutBase).Exclude {
+					i.InvestmentAccounts = append(i.InvestmentAccounts, account)
+				}
+			}
+			o.InvestmentInstitutions = append(o.InvestmentInstitutions, i)
+		}
+		kept = append(kept, o)
+	}
+	return kept
+}
@@ -0,0 +1,108 @@
+package dump
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func TestDumpAppliesAccountConfigs(t *testing.T) {
+	hsa := testAccountBase("hsa", "Health Savings", plaid.ACCOUNTTYPE_DEPOSITORY, 900)
+	loan := testAccountBase("loan", "Car", plaid.ACCOUNTTYPE_OTHER, 500)
+	loan.Mask = newNullableString("9999")
+	hidden := testAccountBase("hidden", "Joint", plaid.ACCOUNTTYPE_DEPOSITORY, 10)
+	prepaid := testAccountBase("prepaid", "Prepaid", plaid.ACCOUNTTYPE_CREDIT, 500)
+
+	account := func(base plaid.AccountBase, txnName string) types.TransactionAccount {
+		return types.TransactionAccount{
+			AccoutBase: base,
+			Transactions: map[string]plaid.Transaction{
+				base.AccountId + "-t": testTransaction(base.AccountId+"-t", base.AccountId, "2024-01-02", txnName, 20),
+			},
+			BalanceHistory: []types.BalanceSnapshot{testBalanceSnapshot(base.AccountId, "2024-02-03T12:00:00Z", 500, 500)},
+		}
+	}
+	owners := []types.Owner{{
+		Name: "alice",
+		TransactionInstitutions: []types.TransactionInstitution{{
+			InstitutionBase: types.InstitutionBase{Name: "bank"},
+			TransactionAccounts: []types.TransactionAccount{
+				account(hsa, "Pharmacy"),
+				account(loan, "Dealer"),
+				account(hidden, "Secret"),
+				account(prepaid, "Top Up"),
+			},
+		}},
+	}}
+
+	cfg := types.Config{Accounts: map[string]types.AccountConfig{
+		"hsa":             {Name: "Assets:Alice:US:HSA"},
+		"alice/bank/9999": {Type: "Liabilities"},
+		"hidden":          {Exclude: true},
+		"prepaid":         {Type: "Assets"},
+	}}
+
+	var buf bytes.Buffer
+	if err := dumpTransactions(cfg, owners, &buf); err != nil {
+		t.Fatalf("dumpTransactions: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"open Assets:Alice:US:HSA USD",
+		" balance Assets:Alice:US:HSA 500.00 USD",
+		"open Liabilities:Alice:USD:Bank:Other:Car USD",
+		" balance Liabilities:Alice:USD:Bank:Other:Car -500.00 USD",
+		"open Assets:Alice:USD:Bank:Credit:Prepaid USD",
+		" balance Assets:Alice:USD:Bank:Credit:Prepaid 500.00 USD",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"Joint", "Secret", "Assets:Alice:USD:Bank:Other:Car", "Liabilities:Alice:USD:Bank:Credit:Prepaid"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output mentions %q:\n%s", unwanted, out)
+		}
+	}
+	if len(owners[0].TransactionInstitutions[0].TransactionAccounts) != 4 {
+		t.Errorf("excluding accounts changed the owners passed in")
+	}
+}
+
+func TestValidateAccountConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     types.AccountConfig
+		wantErr string
+	}{
+		{name: "name", cfg: types.AccountConfig{Name: "Assets:US:Health-Savings:2024"}},
+		{name: "unicode name", cfg: types.AccountConfig{Name: "Assets:Épargne"}},
+		{name: "type", cfg: types.AccountConfig{Type: "Liabilities"}},
+		{name: "unknown type", cfg: types.AccountConfig{Type: "Equity"}, wantErr: `invalid accounts.a1.type "Equity"`},
+		{name: "bad root", cfg: types.AccountConfig{Name: "Cash:Wallet"}, wantErr: "must start with Assets"},
+		{name: "income name", cfg: types.AccountConfig{Name: "Income:Salary"}, wantErr: `invalid accounts.a1.name "Income:Salary": want an Assets or Liabilities account`},
+		{name: "root only", cfg: types.AccountConfig{Name: "Assets"}, wantErr: "needs at least one component"},
+		{name: "lowercase component", cfg: types.AccountConfig{Name: "Assets:hsa"}, wantErr: `invalid component "hsa"`},
+		{name: "space", cfg: types.AccountConfig{Name: "Assets:My HSA"}, wantErr: `invalid component "My HSA"`},
+		{name: "type mismatch", cfg: types.AccountConfig{Name: "Assets:Loan", Type: "Liabilities"}, wantErr: "is not under type Liabilities"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAccountConfigs(map[string]types.AccountConfig{"a1": tt.cfg})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateAccountConfigs: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateAccountConfigs error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package dump
+
+import (
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// maxPricePlaces bounds the digits kept when a per-unit price or cost has
+// to be derived by division.
+const maxPricePlaces = 8
+
+// isoCurrencies lists the active ISO 4217 codes. Any other unit, such as a
+// security ticker, is printed with exactly the digits it has.
+var isoCurrencies = toSet(strings.Fields(`
+AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL
+BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP
+ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD HNL HTG HUF IDR ILS INR
+IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL
+LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR
+NZD OMR PAB PEN PGK PHP PKR PLN PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD
+SHP SLE SOS SRD SSP STN SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX
+USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL`))
+
+// currencyPlaces holds the ISO 4217 minor units that differ from two.
+var currencyPlaces = map[string]int32{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// decimalFromFloat32 converts a Plaid amount using the shortest decimal that
+// round-trips the float32, so 42.1 stays 42.1 rather than 42.0999984741.
+func decimalFromFloat32(f float32) decimal.Decimal {
+	return decimal.NewFromFloat32(f)
+}
+
+// formatAmount prints d for unit. Currencies are padded to their minor
+// unit (12.5 USD prints as 12.50) but never rounded, so sub-cent prices keep
+// every digit; other units print exactly.
+func formatAmount(d decimal.Decimal, unit string) string {
+	s := d.String()
+	if !isoCurrencies[unit] {
+		return s
+	}
+
+	places, ok := currencyPlaces[unit]
+	if !ok {
+		places = 2
+	}
+
+	decimals := 0
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		decimals = len(s) - i - 1
+	}
+	if int32(decimals) >= places {
+		return s
+	}
+	return d.StringFixed(places)
+}
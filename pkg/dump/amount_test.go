@@ -0,0 +1,94 @@
+package dump
+
+import (
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/shopspring/decimal"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func TestFormatAmount(t *testing.T) {
+	for _, tc := range []struct {
+		amount string
+		unit   string
+		want   string
+	}{
+		{"42.1", "USD", "42.10"},
+		{"2500", "USD", "2500.00"},
+		{"123456789012.34", "USD", "123456789012.34"},
+		{"98765432109876.5", "EUR", "98765432109876.50"},
+		{"0.0012", "USD", "0.0012"},
+		{"1500", "JPY", "1500"},
+		{"1.5", "KWD", "1.500"},
+		{"0.123456", "VTI", "0.123456"},
+		{"-7.25", "USD", "-7.25"},
+	} {
+		if got := formatAmount(decimal.RequireFromString(tc.amount), tc.unit); got != tc.want {
+			t.Errorf("formatAmount(%s, %s) = %q, want %q", tc.amount, tc.unit, got, tc.want)
+		}
+	}
+}
+
+func TestDecimalFromFloat32(t *testing.T) {
+	for f, want := range map[float32]string{
+		42.1:      "42.1",
+		0.0001:    "0.0001",
+		123456.78: "123456.78",
+		// Above 2^24 cents (167772.16) a float32 cannot hold every cent, so
+		// the amount is the shortest decimal that reads back as the same
+		// float32, not the one Plaid sent.
+		167772.17:  "167772.17",
+		200000.01:  "200000.02",
+		-250000.05: "-250000.05",
+		1234567.89: "1234567.9",
+		16777216:   "16777216",
+	} {
+		if got := decimalFromFloat32(f).String(); got != want {
+			t.Errorf("decimalFromFloat32(%v) = %s, want %s", f, got, want)
+		}
+	}
+}
+
+func TestFormatAmountFromLargeFloat32(t *testing.T) {
+	for f, want := range map[float32]string{
+		200000.01:  "200000.02",
+		1234567.89: "1234567.90",
+		16777216:   "16777216.00",
+	} {
+		if got := formatAmount(decimalFromFloat32(f), "USD"); got != want {
+			t.Errorf("formatAmount(decimalFromFloat32(%v), USD) = %q, want %q", f, got, want)
+		}
+	}
+}
+
+func TestDeriveInvestTxnAmountSubCentPrice(t *testing.T) {
+	txn := plaid.InvestmentTransaction{Price: 0.0012, Quantity: 12345}
+	if got := deriveInvestTxnAmount(types.InvestmentAccount{}, txn); got.String() != "14.814" {
+		t.Errorf("expected exact product 14.814, got %s", got)
+	}
+}
+
+func TestTradePostingsDerivesPriceWithoutRounding(t *testing.T) {
+	txn := plaid.InvestmentTransaction{Type: "buy", Quantity: 3, Amount: 100}
+	postings := tradePostings(txn, Account{}, Account{Commodity: "VTI"}, "USD", "USD", decimal.Zero)
+	if got := postings[0].Cost; got != "{33.33333333 USD}" {
+		t.Errorf("expected cost rounded to %d places, got %s", maxPricePlaces, got)
+	}
+}
+
+func TestMergeSelfTransfersComparesDecimals(t *testing.T) {
+	checking := Account{Type: "Assets", Owner: "alice", Name: "Checking"}
+	card := Account{Type: "Liabilities", Owner: "alice", Name: "Card"}
+	expenses := Account{Type: "Expenses"}
+
+	txns := []BeancountTransaction{
+		{Date: "2024-01-05", FromAccount: checking, ToAccount: expenses, Amount: decimal.RequireFromString("300.10"), Unit: "USD", Metadata: map[string]string{"id": "a"}},
+		{Date: "2024-01-06", FromAccount: expenses, ToAccount: card, Amount: decimalFromFloat32(300.1), Unit: "USD", Metadata: map[string]string{"id": "b"}},
+	}
+
+	processed := map[int]bool{}
+	if merged := mergeSelfTransfers(txns, processed); len(merged) != 1 {
+		t.Fatalf("expected the transfer to merge, got %+v", merged)
+	}
+}
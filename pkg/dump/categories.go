@@ -0,0 +1,96 @@
+package dump
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultCategories is the mapping used when dump.categories.file is not
+// set.
+//
+//go:embed categories.yaml
+var defaultCategories []byte
+
+// categoryMapper maps Plaid personal finance categories to Expenses and
+// Income accounts, and counts the categories it has no account for.
+type categoryMapper struct {
+	accounts map[string][]string
+	unmapped map[string]int
+}
+
+func loadCategories(cfg types.CategoriesConfig) (*categoryMapper, error) {
+	data, source := defaultCategories, "built-in categories"
+	if cfg.File != "" {
+		var err error
+		if data, err = os.ReadFile(cfg.File); err != nil {
+			return nil, fmt.Errorf("failed to read categories file: %w", err)
+		}
+		source = cfg.File
+	}
+
+	mapping := map[string]string{}
+	if err := yaml.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", source, err)
+	}
+	for category, account := range cfg.Map {
+		mapping[category] = account
+	}
+
+	categories := make([]string, 0, len(mapping))
+	for category := range mapping {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	m := &categoryMapper{accounts: map[string][]string{}, unmapped: map[string]int{}}
+	for _, category := range categories {
+		account := mapping[category]
+		if err := validateAccountName(account); err != nil {
+			return nil, fmt.Errorf("invalid mapping for category %s: %w", category, err)
+		}
+		components := strings.Split(account, ":")
+		if components[0] != "Expenses" && components[0] != "Income" {
+			return nil, fmt.Errorf("invalid mapping for category %s: %q must be under Expenses or Income", category, account)
+		}
+		m.accounts[category] = components
+	}
+	return m, nil
+}
+
+// lookup returns the account type and category for pfc, trying its
+// detailed category before its primary one.
+func (m *categoryMapper) lookup(pfc plaid.PersonalFinanceCategory) (string, []string, bool) {
+	for _, category := range []string{pfc.Detailed, pfc.Primary} {
+		if components, ok := m.accounts[category]; ok {
+			return components[0], copyStrings(components[1:]), true
+		}
+	}
+
+	m.unmapped[categoryName(pfc)]++
+	return "", nil, false
+}
+
+// unmappedCategories lists the categories lookup found no account for, with
+// the number of transactions in each.
+func (m *categoryMapper) unmappedCategories() []string {
+	categories := make([]string, 0, len(m.unmapped))
+	for category, n := range m.unmapped {
+		categories = append(categories, fmt.Sprintf("%s (%d)", category, n))
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+func categoryName(pfc plaid.PersonalFinanceCategory) string {
+	if pfc.Detailed != "" {
+		return pfc.Detailed
+	}
+	return pfc.Primary
+}
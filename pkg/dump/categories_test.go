@@ -0,0 +1,102 @@
+package dump
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func testCategorizedTransaction(primary, detailed string, amount float32) plaid.Transaction {
+	txn := testTransaction("t1", "a1", "2024-01-02", "Shop", amount)
+	txn.PersonalFinanceCategory = *plaid.NewNullablePersonalFinanceCategory(&plaid.PersonalFinanceCategory{Primary: primary, Detailed: detailed})
+	return txn
+}
+
+func TestTxnToChangeAccountMapsPersonalFinanceCategory(t *testing.T) {
+	categoryMap, err := loadCategories(types.CategoriesConfig{})
+	if err != nil {
+		t.Fatalf("loadCategories: %v", err)
+	}
+	balanceAccount := Account{Region: "USD"}
+
+	tests := []struct {
+		name string
+		txn  plaid.Transaction
+		want string
+	}{
+		{name: "detailed", txn: testCategorizedTransaction("FOOD_AND_DRINK", "FOOD_AND_DRINK_GROCERIES", 42), want: "Expenses:Food:Groceries"},
+		{name: "refund stays in expenses", txn: testCategorizedTransaction("FOOD_AND_DRINK", "FOOD_AND_DRINK_GROCERIES", -5), want: "Expenses:Food:Groceries"},
+		{name: "primary", txn: testCategorizedTransaction("FOOD_AND_DRINK", "FOOD_AND_DRINK_SOMETHING_NEW", 9), want: "Expenses:Food"},
+		{name: "income", txn: testCategorizedTransaction("INCOME", "INCOME_WAGES", -2500), want: "Income:Salary"},
+		{name: "unmapped falls back to legacy category", txn: testCategorizedTransaction("SPACE", "SPACE_TRAVEL", 10), want: "Expenses:USD:Shops:Groceries"},
+		{name: "no personal finance category", txn: testTransaction("t2", "a1", "2024-01-02", "Shop", 10), want: "Expenses:USD:Shops:Groceries"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := txnToChangeAccount(balanceAccount, categoryMap, tt.txn).ToString(); got != tt.want {
+				t.Errorf("txnToChangeAccount = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if got, want := categoryMap.unmappedCategories(), []string{"SPACE_TRAVEL (1)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unmappedCategories = %v, want %v", got, want)
+	}
+}
+
+func TestLoadCategoriesFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "categories.yaml")
+	if err := os.WriteFile(path, []byte("FOOD_AND_DRINK: Expenses:Eating\nTRAVEL: Expenses:Trips\n"), 0644); err != nil {
+		t.Fatalf("failed to write categories: %v", err)
+	}
+
+	categoryMap, err := loadCategories(types.CategoriesConfig{
+		File: path,
+		Map:  map[string]string{"TRAVEL": "Expenses:Holidays"},
+	})
+	if err != nil {
+		t.Fatalf("loadCategories: %v", err)
+	}
+
+	for _, tt := range []struct {
+		pfc  plaid.PersonalFinanceCategory
+		want []string
+	}{
+		{pfc: plaid.PersonalFinanceCategory{Primary: "FOOD_AND_DRINK", Detailed: "FOOD_AND_DRINK_GROCERIES"}, want: []string{"Expenses", "Eating"}},
+		{pfc: plaid.PersonalFinanceCategory{Primary: "TRAVEL", Detailed: "TRAVEL_FLIGHTS"}, want: []string{"Expenses", "Holidays"}},
+	} {
+		typ, category, ok := categoryMap.lookup(tt.pfc)
+		if got := append([]string{typ}, category...); !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%s) = %v, %v, want %v", tt.pfc.Detailed, got, ok, tt.want)
+		}
+	}
+	if _, _, ok := categoryMap.lookup(plaid.PersonalFinanceCategory{Primary: "MEDICAL", Detailed: "MEDICAL_DENTAL_CARE"}); ok {
+		t.Errorf("a categories file should replace the built-in mapping")
+	}
+}
+
+func TestLoadCategoriesRejectsInvalidMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		wantErr string
+	}{
+		{name: "asset account", mapping: map[string]string{"TRAVEL": "Assets:Trips"}, wantErr: "must be under Expenses or Income"},
+		{name: "invalid component", mapping: map[string]string{"TRAVEL": "Expenses:my trips"}, wantErr: "invalid mapping for category TRAVEL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadCategories(types.CategoriesConfig{Map: tt.mapping})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadCategories error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
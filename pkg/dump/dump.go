@@ -1,50 +1,82 @@
 package dump
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"math"
 	"os"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/plaid/plaid-go/plaid"
-	"github.com/xiaomi388/beancount-automation/pkg/persistence"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
 type Account struct {
 	Type                 string   `json:"type"`
 	Owner                string   `json:"owner"`
-	Country              string   `json:"country"`
+	Region               string   `json:"region"`
 	Institution          string   `json:"institution"`
 	PlaidAccountType     string   `json:"plaid_account_type"`
 	Name                 string   `json:"name"`
 	Category             []string `json:"category"`
-	Balance              float32  `json:"balance"`
 	FirstTransactionDate string   `json:"first_transaction_date"`
+	// Assertions are the balances Plaid reported for the account, one per
+	// day, and PadDate is where the opening balance is padded before them.
+	Assertions []BalanceAssertion `json:"assertions"`
+	PadDate    string             `json:"pad_date"`
+	// Currency is the currency a balance account is held in; it constrains
+	// the open directive and denominates the balance assertion.
+	Currency string `json:"currency"`
+	// Commodity is set for per-security sub-accounts of an investment
+	// account; such accounts only ever hold units of that commodity.
+	Commodity string `json:"commodity"`
+	// FullName is the Beancount name configured for the account, which
+	// replaces the one built from the fields above.
+	FullName string `json:"full_name"`
 }
 
+// BalanceAssertion states that an account holds Amount at the start of Date.
+type BalanceAssertion struct {
+	Date   string          `json:"date"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+// ToString returns the Beancount account name. Owner, institution and
+// Plaid names are free-form, so every component is sanitized here.
 func (a Account) ToString() string {
+	if a.FullName != "" {
+		if a.Commodity != "" {
+			return a.FullName + ":" + accountComponent(a.Commodity)
+		}
+		return a.FullName
+	}
+
 	if a.Type == "Expenses" || a.Type == "Income" {
-		return fmt.Sprintf("%s:%s:%s", a.Type, a.Country, strings.Join(a.Category, ":"))
+		if a.Region == "" {
+			return accountName(a.Type, a.Category...)
+		}
+		return accountName(a.Type, append([]string{a.Region}, a.Category...)...)
 
+	} else if a.Commodity != "" {
+		return accountName(a.Type, a.Owner, a.Region, a.Institution, a.PlaidAccountType, a.Name, a.Commodity)
 	} else {
-		return fmt.Sprintf("%s:%s:%s:%s:%s:%s", a.Type, a.Owner, a.Country, a.Institution, a.PlaidAccountType, a.Name)
+		return accountName(a.Type, a.Owner, a.Region, a.Institution, a.PlaidAccountType, a.Name)
 	}
 }
 
 type ChangeAccount struct {
 	Type     string   `json:"type"`
-	Country  string   `json:"country"`
+	Region   string   `json:"region"`
 	Category []string `json:"category"`
 }
 
 func (ca ChangeAccount) ToString() string {
-	return fmt.Sprintf("%s:%s:%s", ca.Type, ca.Country, strings.Join(ca.Category, ":"))
+	return fmt.Sprintf("%s:%s:%s", ca.Type, ca.Region, strings.Join(ca.Category, ":"))
 }
 
 type BeancountTransaction struct {
@@ -55,46 +87,87 @@ type BeancountTransaction struct {
 	Metadata    map[string]string `json:"metadata"`
 	ToAccount   Account           `json:"to_account"`
 	FromAccount Account           `json:"from_account"`
-	Amount      float32           `json:"amount"`
+	Amount      decimal.Decimal   `json:"amount"`
 	Unit        string            `json:"unit"`
+	// Postings, when set, replace the two-leg From/To rendering.
+	Postings []Posting `json:"postings"`
 }
 
-func investTxnToChangeAccount(account types.InvestmentAccount, txn plaid.InvestmentTransaction) Account {
+// Accounts returns every account the transaction posts to.
+func (t BeancountTransaction) Accounts() []Account {
+	if len(t.Postings) == 0 {
+		return []Account{t.FromAccount, t.ToAccount}
+	}
+
+	accounts := make([]Account, 0, len(t.Postings))
+	for _, posting := range t.Postings {
+		accounts = append(accounts, posting.Account)
+	}
+	return accounts
+}
+
+func investTxnToChangeAccount(account types.InvestmentAccount, balanceAccount Account, txn plaid.InvestmentTransaction) Account {
 	amount := deriveInvestTxnAmount(account, txn)
 	typ := "Expenses"
-	if amount > 0 {
+	if amount.IsPositive() {
 		typ = "Income"
 	}
 
 	return Account{
 		Type:     typ,
-		Country:  account.AccoutBase.Balances.GetIsoCurrencyCode(),
+		Region:   balanceAccount.Region,
 		Category: []string{strings.Title(txn.Type), strings.Title(txn.Subtype)},
 	}
 }
 
-func txnToChangeAccount(account types.TransactionAccount, txn plaid.Transaction) Account {
+// txnToChangeAccount maps the personal finance category of txn to the
+// account configured for it, as written, falling back to Plaid's legacy
+// category list under the region when it has none or it is not mapped.
+func txnToChangeAccount(balanceAccount Account, categoryMap *categoryMapper, txn plaid.Transaction) Account {
+	if pfc, ok := txn.GetPersonalFinanceCategoryOk(); ok && pfc != nil && categoryName(*pfc) != "" {
+		if typ, category, ok := categoryMap.lookup(*pfc); ok {
+			return Account{
+				Type:     typ,
+				Category: category,
+			}
+		}
+	}
+
 	typ := "Expenses"
 	if txn.GetAmount() < 0 {
 		typ = "Income"
 	}
 
-	categories := txn.GetCategory()
-	for i := range categories {
-		categories[i] = string(regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAll([]byte(categories[i]), nil))
-	}
-
+	categories := copyStrings(txn.GetCategory())
 	if len(categories) == 0 {
 		categories = []string{"Unknown"}
 	}
 
 	return Account{
 		Type:     typ,
-		Country:  account.AccoutBase.Balances.GetIsoCurrencyCode(),
+		Region:   balanceAccount.Region,
 		Category: categories,
 	}
 }
 
+// accountCurrency returns the ISO currency of an account, falling back to
+// Plaid's unofficial code (e.g. for crypto) when there is none.
+func accountCurrency(base plaid.AccountBase) string {
+	if c := base.Balances.GetIsoCurrencyCode(); c != "" {
+		return c
+	}
+	return base.Balances.GetUnofficialCurrencyCode()
+}
+
+// accountRegion is the second segment of account names: the configured
+// region, or the account currency when none is configured.
+func accountRegion(cfg types.DumpConfig, currency string) string {
+	if cfg.Region != "" {
+		return cfg.Region
+	}
+	return currency
+}
+
 func leftDateBeforeRightDate(left string, right string) bool {
 	leftDate, err := time.Parse("2006-01-02", left)
 	if err != nil {
@@ -109,21 +182,21 @@ func leftDateBeforeRightDate(left string, right string) bool {
 	return leftDate.Before(rightDate)
 }
 
-func txnAccountToBeanCountBalanceAccount(owner types.Owner, inst types.InstitutionBase, account types.TransactionAccount) Account {
+func txnAccountToBeanCountBalanceAccount(cfg types.DumpConfig, names accountNames, override types.AccountConfig, owner types.Owner, inst types.InstitutionBase, account types.TransactionAccount) Account {
 	plaidAccountType := account.AccoutBase.GetType()
 	typ := "Liabilities"
 	if plaidAccountType != plaid.ACCOUNTTYPE_CREDIT {
 		typ = "Assets"
 	}
-	name := string(regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAll([]byte(account.AccoutBase.Name), nil))
 	balanceAccount := Account{
-		Type:             typ,
+		Type:             accountType(override, typ),
 		Owner:            owner.Name,
-		Country:          account.AccoutBase.Balances.GetIsoCurrencyCode(),
+		Region:           accountRegion(cfg, accountCurrency(account.AccoutBase)),
 		Institution:      inst.Name,
 		PlaidAccountType: strings.Title(string(plaidAccountType)),
-		Name:             name,
-		Balance:          account.AccoutBase.Balances.GetAvailable(),
+		Name:             names.name(account.AccoutBase),
+		Currency:         accountCurrency(account.AccoutBase),
+		FullName:         override.Name,
 	}
 
 	for _, txn := range account.Transactions {
@@ -132,19 +205,85 @@ func txnAccountToBeanCountBalanceAccount(owner types.Owner, inst types.Instituti
 		}
 	}
 
+	balanceAccount.Assertions = balanceAssertions(cfg, plaidAccountType, balanceAccount.Type, account.BalanceHistory)
+	balanceAccount.PadDate = padDate(balanceAccount.FirstTransactionDate, balanceAccount.Assertions)
+
 	return balanceAccount
 }
 
-func investAccountToBeanCountBalanceAccount(owner types.Owner, inst types.InstitutionBase, account types.InvestmentAccount) Account {
-	name := string(regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAll([]byte(account.AccoutBase.Name), nil))
+// balanceAssertions turns the balance history of an account into one
+// assertion per day, dated the day after the last snapshot of that day so
+// it covers every transaction Plaid had posted by then. Plaid reports
+// credit, loan and other liability balances as the amount owed, so those
+// assert the current balance, negated when the ledger holds the account
+// under Liabilities. An investment account's current balance includes the
+// market value of its holdings, so it asserts the available cash instead.
+func balanceAssertions(cfg types.DumpConfig, typ plaid.AccountType, accountType string, history []types.BalanceSnapshot) []BalanceAssertion {
+	liability := accountType == "Liabilities"
+	var assertions []BalanceAssertion
+	for _, snapshot := range history {
+		var balance *float32
+		switch {
+		case liability || typ == plaid.ACCOUNTTYPE_CREDIT || typ == plaid.ACCOUNTTYPE_LOAN:
+			balance = snapshot.Balances.Current.Get()
+			if balance != nil && liability {
+				owed := -*balance
+				balance = &owed
+			}
+		case typ == plaid.ACCOUNTTYPE_INVESTMENT:
+			balance = snapshot.Balances.Available.Get()
+		case cfg.Balance == balanceCurrent:
+			balance = snapshot.Balances.Current.Get()
+		default:
+			balance = snapshot.Balances.Available.Get()
+			if balance == nil {
+				balance = snapshot.Balances.Current.Get()
+			}
+		}
+		if balance == nil {
+			continue
+		}
+
+		assertion := BalanceAssertion{
+			Date:   snapshot.FetchedAt.In(assertionLocation).AddDate(0, 0, 1).Format(dateLayout),
+			Amount: decimalFromFloat32(*balance),
+		}
+		if n := len(assertions); n > 0 && assertions[n-1].Date == assertion.Date {
+			assertions[n-1] = assertion
+			continue
+		}
+		assertions = append(assertions, assertion)
+	}
+	return assertions
+}
+
+// padDate is the first transaction date, or the day before the first
+// assertion when that comes earlier, as a pad must precede its balance.
+func padDate(firstTransactionDate string, assertions []BalanceAssertion) string {
+	if len(assertions) == 0 {
+		return ""
+	}
+	if firstTransactionDate != "" && firstTransactionDate < assertions[0].Date {
+		return firstTransactionDate
+	}
+
+	first, err := time.Parse(dateLayout, assertions[0].Date)
+	if err != nil {
+		return assertions[0].Date
+	}
+	return first.AddDate(0, 0, -1).Format(dateLayout)
+}
+
+func investAccountToBeanCountBalanceAccount(cfg types.DumpConfig, names accountNames, override types.AccountConfig, owner types.Owner, inst types.InstitutionBase, account types.InvestmentAccount) Account {
 	balanceAccount := Account{
-		Type:             "Assets",
+		Type:             accountType(override, "Assets"),
 		Owner:            owner.Name,
-		Country:          account.AccoutBase.Balances.GetIsoCurrencyCode(),
+		Region:           accountRegion(cfg, accountCurrency(account.AccoutBase)),
 		Institution:      inst.Name,
 		PlaidAccountType: strings.Title(string(account.AccoutBase.Type)),
-		Name:             name,
-		Balance:          account.AccoutBase.Balances.GetCurrent(),
+		Name:             names.name(account.AccoutBase),
+		Currency:         accountCurrency(account.AccoutBase),
+		FullName:         override.Name,
 	}
 
 	for _, txn := range account.Transactions {
@@ -153,33 +292,135 @@ func investAccountToBeanCountBalanceAccount(owner types.Owner, inst types.Instit
 		}
 	}
 
+	balanceAccount.Assertions = balanceAssertions(cfg, account.AccoutBase.Type, balanceAccount.Type, account.BalanceHistory)
+	// Holdings are fetched with the latest balance, and their cash position
+	// is the cash the account holds, whatever Plaid counts as available.
+	if cash, ok := cashPosition(account, balanceAccount.Currency); ok && len(balanceAccount.Assertions) > 0 && balanceAccount.Type == "Assets" {
+		balanceAccount.Assertions[len(balanceAccount.Assertions)-1].Amount = cash
+	}
+	balanceAccount.PadDate = padDate(balanceAccount.FirstTransactionDate, balanceAccount.Assertions)
+
 	return balanceAccount
 }
 
+// cashPosition sums the holdings of an investment account in its cash
+// security for currency.
+func cashPosition(account types.InvestmentAccount, currency string) (decimal.Decimal, bool) {
+	var cash decimal.Decimal
+	var found bool
+	for _, holding := range account.Holdings {
+		if c, ok := cashSecurityCurrency(account.Securities[holding.SecurityId]); ok && c == currency {
+			cash = cash.Add(decimalFromFloat32(holding.Quantity))
+			found = true
+		}
+	}
+	return cash, found
+}
+
+const (
+	dateLayout = "2006-01-02"
+
+	balanceAvailable = "available"
+	balanceCurrent   = "current"
+)
+
+// assertionLocation is the time zone in which a balance snapshot's day is
+// taken.
+var assertionLocation = time.Local
+
+func validateDumpConfig(cfg types.DumpConfig) error {
+	switch cfg.Balance {
+	case "", balanceAvailable, balanceCurrent:
+		return nil
+	default:
+		return fmt.Errorf("invalid dump.balance %q: want %q or %q", cfg.Balance, balanceAvailable, balanceCurrent)
+	}
+}
+
+// ledger is everything a dump writes, before it is laid out into files.
+type ledger struct {
+	transactions []BeancountTransaction
+	accounts     map[string]Account
+	holdings     Holdings
+}
+
+func buildLedger(cfg types.Config, owners []types.Owner) (ledger, error) {
+	if err := validateDumpConfig(cfg.Dump); err != nil {
+		return ledger{}, err
+	}
+	if err := validateAccountConfigs(cfg.Accounts); err != nil {
+		return ledger{}, err
+	}
+	// A no-op for configs from LoadConfig, which compiles the rules.
+	if err := cfg.Postprocess.Compile(); err != nil {
+		return ledger{}, err
+	}
+	owners = excludeAccounts(cfg.Accounts, owners)
+
+	names, err := resolveAccountNames(cfg, owners)
+	if err != nil {
+		return ledger{}, err
+	}
+
+	categoryMap, err := loadCategories(cfg.Dump.Categories)
+	if err != nil {
+		return ledger{}, err
+	}
+
+	bcTxns, accounts, err := processTransactions(owners, cfg, names, categoryMap)
+	if err != nil {
+		return ledger{}, err
+	}
+	if unmapped := categoryMap.unmappedCategories(); len(unmapped) > 0 {
+		logrus.Warnf("no account mapped for Plaid categories %s; add them to dump.categories", strings.Join(unmapped, ", "))
+	}
+
+	holdings := processHoldings(owners, cfg, names)
+	for _, position := range holdings.Positions {
+		accounts[position.Account.ToString()] = position.Account
+	}
+	addCurrencyCommodities(holdings.Commodities, bcTxns, accounts)
+
+	return ledger{transactions: bcTxns, accounts: accounts, holdings: holdings}, nil
+}
+
 func dumpTransactions(cfg types.Config, owners []types.Owner, w io.Writer) error {
-	bcTxns, accounts, err := processTransactions(owners, cfg.Postprocess)
+	tpls, err := loadTemplates(cfg.Dump.Templates)
 	if err != nil {
 		return err
 	}
+	return writeLedger(w, tpls, cfg, owners)
+}
 
-	if err := writeTransactions(w, bcTxns, accounts); err != nil {
+func writeLedger(w io.Writer, tpls templateSet, cfg types.Config, owners []types.Owner) error {
+	l, err := buildLedger(cfg, owners)
+	if err != nil {
+		return err
+	}
+
+	if err := writeTransactions(w, tpls, l.transactions, l.accounts); err != nil {
+		return err
+	}
+
+	if err := writeHoldings(w, tpls, l.holdings); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func processTransactions(owners []types.Owner, postCfg types.PostprocessConfig) ([]BeancountTransaction, map[string]Account, error) {
+func processTransactions(owners []types.Owner, cfg types.Config, names accountNames, categoryMap *categoryMapper) ([]BeancountTransaction, map[string]Account, error) {
 	var bcTxns []BeancountTransaction
 	accounts := make(map[string]Account)
 
 	for _, owner := range owners {
 		for _, inst := range owner.TransactionInstitutions {
 			for _, account := range inst.TransactionAccounts {
-				balanceAccount := txnAccountToBeanCountBalanceAccount(owner, inst.InstitutionBase, account)
+				override := accountConfig(cfg.Accounts, owner, inst.InstitutionBase, account.AccoutBase)
+				balanceAccount := txnAccountToBeanCountBalanceAccount(cfg.Dump, names, override, owner, inst.InstitutionBase, account)
 				accounts[balanceAccount.ToString()] = balanceAccount
 				for _, txn := range account.Transactions {
-					changeAccount := txnToChangeAccount(account, txn)
+					changeAccount := txnToChangeAccount(balanceAccount, categoryMap, txn)
 					accounts[changeAccount.ToString()] = changeAccount
 
 					bcTxn := txnToBeancountTransaction(owner, balanceAccount, changeAccount, txn)
@@ -190,35 +431,73 @@ func processTransactions(owners []types.Owner, postCfg types.PostprocessConfig)
 
 		for _, inst := range owner.InvestmentInstitutions {
 			for _, account := range inst.InvestmentAccounts {
-				balanceAccount := investAccountToBeanCountBalanceAccount(owner, inst.InstitutionBase, account)
+				override := accountConfig(cfg.Accounts, owner, inst.InstitutionBase, account.AccoutBase)
+				balanceAccount := investAccountToBeanCountBalanceAccount(cfg.Dump, names, override, owner, inst.InstitutionBase, account)
 				accounts[balanceAccount.ToString()] = balanceAccount
 				for _, txn := range account.Transactions {
-					changeAccount := investTxnToChangeAccount(account, txn)
-					accounts[changeAccount.ToString()] = changeAccount
-
+					changeAccount := investTxnToChangeAccount(account, balanceAccount, txn)
 					bcTxn := investTxnToBeancountTransaction(owner, account, balanceAccount, changeAccount, txn)
+					for _, a := range bcTxn.Accounts() {
+						accounts[a.ToString()] = a
+					}
+
 					bcTxns = append(bcTxns, bcTxn)
 				}
 			}
 		}
 	}
 
-	bcTxns = applyPostprocessTransactions(bcTxns, postCfg)
+	// Transactions come out of maps; sort before merging so transfers pair
+	// up the same way every run, and again after merging so the output is
+	// stable.
+	sortTransactions(bcTxns)
+	bcTxns = applyPostprocessTransactions(bcTxns, cfg.Postprocess)
+	sortTransactions(bcTxns)
 
 	for _, bcTxn := range bcTxns {
-		accounts[bcTxn.FromAccount.ToString()] = bcTxn.FromAccount
-		accounts[bcTxn.ToAccount.ToString()] = bcTxn.ToAccount
+		for _, a := range bcTxn.Accounts() {
+			accounts[a.ToString()] = a
+		}
 	}
 
 	return bcTxns, accounts, nil
 }
 
-func deriveInvestTxnAmount(account types.InvestmentAccount, txn plaid.InvestmentTransaction) float32 {
-	amount := txn.Amount
-	if amount == 0 {
-		amount = txn.Price * txn.Quantity
-		if amount == 0 {
-			amount = txn.Quantity * (*account.Securities[*txn.SecurityId.Get()].ClosePrice.Get())
+// sortTransactions orders transactions by date, then account, then Plaid id.
+func sortTransactions(bcTxns []BeancountTransaction) {
+	sort.SliceStable(bcTxns, func(i, j int) bool {
+		a, b := bcTxns[i], bcTxns[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if aa, ba := a.sortAccount(), b.sortAccount(); aa != ba {
+			return aa < ba
+		}
+		return a.sortID() < b.sortID()
+	})
+}
+
+func (t BeancountTransaction) sortAccount() string {
+	accounts := t.Accounts()
+	return accounts[0].ToString()
+}
+
+func (t BeancountTransaction) sortID() string {
+	if id, ok := t.Metadata["id"]; ok {
+		return id
+	}
+	return t.Metadata["from_id"] + "/" + t.Metadata["to_id"]
+}
+
+func deriveInvestTxnAmount(account types.InvestmentAccount, txn plaid.InvestmentTransaction) decimal.Decimal {
+	amount := decimalFromFloat32(txn.Amount)
+	if amount.IsZero() {
+		quantity := decimalFromFloat32(txn.Quantity)
+		amount = decimalFromFloat32(txn.Price).Mul(quantity)
+		if amount.IsZero() {
+			if closePrice := account.Securities[txn.GetSecurityId()].ClosePrice.Get(); closePrice != nil {
+				amount = decimalFromFloat32(*closePrice).Mul(quantity)
+			}
 		}
 	}
 
@@ -228,7 +507,7 @@ func deriveInvestTxnAmount(account types.InvestmentAccount, txn plaid.Investment
 func investTxnToBeancountTransaction(owner types.Owner, investAccount types.InvestmentAccount, balanceAccount, changeAccount Account, txn plaid.InvestmentTransaction) BeancountTransaction {
 	amount := deriveInvestTxnAmount(investAccount, txn)
 	var fa, ta *Account
-	if amount < 0 {
+	if amount.IsNegative() {
 		fa = &balanceAccount
 		ta = &changeAccount
 	} else {
@@ -236,18 +515,18 @@ func investTxnToBeancountTransaction(owner types.Owner, investAccount types.Inve
 		ta = &balanceAccount
 	}
 
-	re := regexp.MustCompile(`[^a-zA-Z0-9]`)
 	bcTxn := BeancountTransaction{
 		Date:        txn.Date,
-		Desc:        string(re.ReplaceAll([]byte(txn.GetName()), nil)),
+		Desc:        txn.GetName(),
 		FromAccount: *fa,
 		ToAccount:   *ta,
 		Metadata: map[string]string{
 			"id": txn.GetInvestmentTransactionId(),
 		},
-		Tags:   []string{},
-		Unit:   txn.GetIsoCurrencyCode(),
-		Amount: float32(math.Abs(float64(amount))),
+		Tags:     []string{},
+		Unit:     txnCurrency(txn.IsoCurrencyCode, txn.UnofficialCurrencyCode),
+		Amount:   amount.Abs(),
+		Postings: investTxnPostings(investAccount, balanceAccount, txn),
 	}
 	if txn.Amount > 0 {
 		bcTxn.Metadata["payer"] = owner.Name
@@ -257,7 +536,6 @@ func investTxnToBeancountTransaction(owner types.Owner, investAccount types.Inve
 }
 
 func txnToBeancountTransaction(owner types.Owner, balanceAccount, changeAccount Account, txn plaid.Transaction) BeancountTransaction {
-	re := regexp.MustCompile(`[^a-zA-Z0-9]`)
 	var fa, ta *Account
 	if txn.Amount > 0 {
 		fa = &balanceAccount
@@ -269,16 +547,16 @@ func txnToBeancountTransaction(owner types.Owner, balanceAccount, changeAccount
 
 	bcTxn := BeancountTransaction{
 		Date:        txn.Date,
-		Payee:       string(re.ReplaceAll([]byte(txn.GetMerchantName()), nil)),
-		Desc:        string(re.ReplaceAll([]byte(txn.GetName()), nil)),
+		Payee:       txn.GetMerchantName(),
+		Desc:        txn.GetName(),
 		FromAccount: *fa,
 		ToAccount:   *ta,
 		Metadata: map[string]string{
 			"id": txn.GetTransactionId(),
 		},
 		Tags:   []string{},
-		Unit:   txn.GetIsoCurrencyCode(),
-		Amount: float32(math.Abs(float64(txn.Amount))),
+		Unit:   txnCurrency(txn.IsoCurrencyCode, txn.UnofficialCurrencyCode),
+		Amount: decimalFromFloat32(txn.Amount).Abs(),
 	}
 	if txn.Amount > 0 {
 		bcTxn.Metadata["payer"] = owner.Name
@@ -287,66 +565,60 @@ func txnToBeancountTransaction(owner types.Owner, balanceAccount, changeAccount
 	return bcTxn
 }
 
-func writeTransactions(w io.Writer, bcTxns []BeancountTransaction, accounts map[string]Account) error {
-	for _, bcTxn := range bcTxns {
-		if err := template.Must(template.New("transaction").Parse(transactionTemplate)).Execute(w, bcTxn); err != nil {
-			return fmt.Errorf("failed to generate transaction: %w", err)
-		}
+func txnCurrency(iso, unofficial plaid.NullableString) string {
+	if c := nullableString(iso); c != "" {
+		return c
 	}
+	return nullableString(unofficial)
+}
 
-	if err := template.Must(template.New("open-account").Parse(openAccountTemplate)).Execute(w, accounts); err != nil {
-		return fmt.Errorf("failed to generate open balance account: %w", err)
+// addCurrencyCommodities declares every currency the ledger uses.
+func addCurrencyCommodities(commodities map[string]Commodity, bcTxns []BeancountTransaction, accounts map[string]Account) {
+	add := func(currency string) {
+		if currency == "" {
+			return
+		}
+		if _, ok := commodities[currency]; !ok {
+			commodities[currency] = Commodity{Name: currency}
+		}
 	}
 
-	return nil
+	for _, account := range accounts {
+		add(account.Currency)
+	}
+	for _, bcTxn := range bcTxns {
+		add(bcTxn.Unit)
+		for _, posting := range bcTxn.Postings {
+			if isoCurrencies[posting.Unit] {
+				add(posting.Unit)
+			}
+		}
+	}
 }
 
-func dumpHoldings(owners []types.Owner, w io.Writer) error {
-	for _, owner := range owners {
-		for _, inst := range owner.InvestmentInstitutions {
-			for _, account := range inst.InvestmentAccounts {
-				holdings := account.Holdings
-				for _, holding := range holdings {
-					if holding.InstitutionPriceAsOf.Get() == nil {
-						continue
-					}
-
-					type Data struct {
-						Owner       string
-						Institution string
-						Holding     plaid.Holding
-						Security    plaid.Security
-					}
-
-					if err := template.Must(template.New("holding").Funcs(template.FuncMap{
-						"Deref":   func(s *string) string { return *s },
-						"Replace": func(s string) string { return string(regexp.MustCompile(`[^a-zA-Z0-9]`).ReplaceAll([]byte(s), nil)) },
-					}).Parse(holdingTemplate)).Execute(w, Data{
-						Owner:       owner.Name,
-						Institution: inst.InstitutionBase.Name,
-						Holding:     holding,
-						Security:    account.Securities[holding.SecurityId],
-					}); err != nil {
-						return fmt.Errorf("failed to generate holding for %#v: %w", holding, err)
-					}
-
-				}
-			}
+func writeTransactions(w io.Writer, tpls templateSet, bcTxns []BeancountTransaction, accounts map[string]Account) error {
+	for _, bcTxn := range bcTxns {
+		if err := tpls.transaction.Execute(w, bcTxn); err != nil {
+			return fmt.Errorf("failed to generate transaction: %w", err)
 		}
 	}
 
+	if err := tpls.openAccount.Execute(w, accounts); err != nil {
+		return fmt.Errorf("failed to generate open balance account: %w", err)
+	}
+
 	return nil
 }
 
-func Dump() error {
-	config, err := persistence.LoadConfig(persistence.DefaultConfigPath)
+func Dump(appCtx *app.Context) error {
+	tpls, err := loadTemplates(appCtx.Config.Dump.Templates)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return err
 	}
 
-	store, err := persistence.NewStore(config.Storage)
+	store, err := appCtx.OpenStore()
 	if err != nil {
-		return fmt.Errorf("failed to create store: %w", err)
+		return err
 	}
 	defer store.Close()
 
@@ -355,21 +627,33 @@ func Dump() error {
 		return fmt.Errorf("failed to load owners: %w", err)
 	}
 
-	var buf bytes.Buffer
-	w := io.Writer(&buf)
-
-	if err := dumpTransactions(config, owners, w); err != nil {
+	indexName := filepath.Base(appCtx.OutputPath)
+	files, err := renderFiles(appCtx.Config, tpls, owners, indexName)
+	if err != nil {
 		return fmt.Errorf("failed to dump transactions: %w", err)
 	}
 
-	// if err := dumpHoldings(owners, w); err != nil {
-	// 	return fmt.Errorf("failed to dump holdings: %w", err)
-	// }
+	// The index is written last, so it never includes a file that is
+	// missing.
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name != indexName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
 
-	if err := os.WriteFile(persistence.DefaultBeancountPath, buf.Bytes(), 0644); err != nil {
-		return fmt.Errorf("failed to write beancount file: %w", err)
+	dir := filepath.Dir(appCtx.OutputPath)
+	for _, name := range append(names, indexName) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", name, err)
+		}
+		if err := os.WriteFile(path, files[name], 0644); err != nil {
+			return fmt.Errorf("failed to write beancount file: %w", err)
+		}
 	}
 
-	fmt.Printf("Successfully generated beancount file: %q.\n", persistence.DefaultBeancountPath)
+	fmt.Printf("Successfully generated beancount file: %q.\n", appCtx.OutputPath)
 	return nil
 }
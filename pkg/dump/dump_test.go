@@ -0,0 +1,362 @@
+package dump
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
+	"github.com/xiaomi388/beancount-automation/pkg/persistence"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func newNullableString(s string) plaid.NullableString {
+	return *plaid.NewNullableString(&s)
+}
+
+func newNullableFloat(f float32) plaid.NullableFloat32 {
+	return *plaid.NewNullableFloat32(&f)
+}
+
+func testAccountBase(id, name string, typ plaid.AccountType, current float32) plaid.AccountBase {
+	return plaid.AccountBase{
+		AccountId: id,
+		Name:      name,
+		Type:      typ,
+		Balances: plaid.AccountBalance{
+			Available:       newNullableFloat(current),
+			Current:         newNullableFloat(current),
+			IsoCurrencyCode: newNullableString("USD"),
+		},
+	}
+}
+
+func testTransaction(id, accountID, date, name string, amount float32) plaid.Transaction {
+	return plaid.Transaction{
+		TransactionId:   id,
+		AccountId:       accountID,
+		Date:            date,
+		Name:            name,
+		MerchantName:    newNullableString(name),
+		Amount:          amount,
+		IsoCurrencyCode: newNullableString("USD"),
+		Category:        []string{"Shops", "Groceries"},
+		PaymentChannel:  "in store",
+	}
+}
+
+func testBalanceSnapshot(accountID, fetchedAt string, available, current float32) types.BalanceSnapshot {
+	at, err := time.Parse(time.RFC3339, fetchedAt)
+	if err != nil {
+		panic(err)
+	}
+	return types.BalanceSnapshot{
+		AccountID: accountID,
+		FetchedAt: at,
+		Balances: plaid.AccountBalance{
+			Available:       newNullableFloat(available),
+			Current:         newNullableFloat(current),
+			IsoCurrencyCode: newNullableString("USD"),
+		},
+	}
+}
+
+// newTestOwners builds two owners whose transactions exercise self and
+// cross-owner transfer merging, plus an investment account with a trade.
+func newTestOwners() []types.Owner {
+	return []types.Owner{
+		{
+			Name: "alice",
+			TransactionInstitutions: []types.TransactionInstitution{
+				{
+					InstitutionBase: types.InstitutionBase{Name: "bank"},
+					TransactionAccounts: []types.TransactionAccount{
+						{
+							AccoutBase: testAccountBase("alice-checking", "Checking", plaid.ACCOUNTTYPE_DEPOSITORY, 1200),
+							Transactions: map[string]plaid.Transaction{
+								"a1": testTransaction("a1", "alice-checking", "2024-01-03", "Grocer", 42.1),
+								"a2": testTransaction("a2", "alice-checking", "2024-01-05", "Card Payment", 300),
+								"a3": testTransaction("a3", "alice-checking", "2024-01-07", "Transfer To Bob", 50),
+								"a4": testTransaction("a4", "alice-checking", "2024-01-03", "Bakery", 7.25),
+								"a5": testTransaction("a5", "alice-checking", "2024-01-10", "Payroll", -2500),
+							},
+							BalanceHistory: []types.BalanceSnapshot{
+								testBalanceSnapshot("alice-checking", "2024-01-31T08:00:00Z", 1100, 1100),
+								testBalanceSnapshot("alice-checking", "2024-01-31T12:00:00Z", 1200, 1250),
+								testBalanceSnapshot("alice-checking", "2024-02-01T12:00:00Z", 1200, 1200),
+							},
+						},
+						{
+							AccoutBase: testAccountBase("alice-card", "Card", plaid.ACCOUNTTYPE_CREDIT, 80),
+							Transactions: map[string]plaid.Transaction{
+								"c1": testTransaction("c1", "alice-card", "2024-01-06", "Payment Thank You", -300),
+								"c2": testTransaction("c2", "alice-card", "2024-01-03", "Coffee", 4.5),
+							},
+							BalanceHistory: []types.BalanceSnapshot{
+								testBalanceSnapshot("alice-card", "2024-01-31T12:00:00Z", 0, 80),
+							},
+						},
+					},
+				},
+			},
+			InvestmentInstitutions: []types.InvestmentInstitution{
+				{
+					InstitutionBase: types.InstitutionBase{Name: "broker"},
+					InvestmentAccounts: []types.InvestmentAccount{
+						{
+							AccoutBase: testAccountBase("alice-brokerage", "Brokerage", plaid.ACCOUNTTYPE_INVESTMENT, 1500),
+							Holdings: []plaid.Holding{
+								{
+									AccountId:            "alice-brokerage",
+									SecurityId:           "sec-vti",
+									Quantity:             1,
+									CostBasis:            newNullableFloat(240),
+									InstitutionPrice:     250,
+									InstitutionPriceAsOf: newNullableString("2024-01-31"),
+									IsoCurrencyCode:      newNullableString("USD"),
+								},
+							},
+							Securities: map[string]plaid.Security{
+								"sec-vti": {
+									SecurityId:      "sec-vti",
+									Name:            newNullableString("Vanguard Total Stock Market ETF"),
+									TickerSymbol:    newNullableString("VTI"),
+									IsoCurrencyCode: newNullableString("USD"),
+									Type:            newNullableString("etf"),
+								},
+							},
+							BalanceHistory: []types.BalanceSnapshot{
+								testBalanceSnapshot("alice-brokerage", "2024-01-31T12:00:00Z", 20, 1520),
+							},
+							Transactions: map[string]plaid.InvestmentTransaction{
+								"i1": {
+									InvestmentTransactionId: "i1",
+									AccountId:               "alice-brokerage",
+									SecurityId:              newNullableString("sec-vti"),
+									Date:                    "2024-01-15",
+									Name:                    "Buy VTI",
+									Quantity:                2,
+									Price:                   240,
+									Amount:                  480,
+									IsoCurrencyCode:         newNullableString("USD"),
+									Type:                    "buy",
+									Subtype:                 "buy",
+								},
+								// Sells the opening lot and part of the buy.
+								"i2": {
+									InvestmentTransactionId: "i2",
+									AccountId:               "alice-brokerage",
+									SecurityId:              newNullableString("sec-vti"),
+									Date:                    "2024-02-01",
+									Name:                    "Sell VTI",
+									Quantity:                -3,
+									Price:                   260,
+									Amount:                  -780,
+									IsoCurrencyCode:         newNullableString("USD"),
+									Type:                    "sell",
+									Subtype:                 "sell",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "bob",
+			TransactionInstitutions: []types.TransactionInstitution{
+				{
+					InstitutionBase: types.InstitutionBase{Name: "bank"},
+					TransactionAccounts: []types.TransactionAccount{
+						{
+							AccoutBase: testAccountBase("bob-checking", "Checking", plaid.ACCOUNTTYPE_DEPOSITORY, 640),
+							Transactions: map[string]plaid.Transaction{
+								"b1": testTransaction("b1", "bob-checking", "2024-01-08", "Transfer From Alice", -50),
+								"b2": testTransaction("b2", "bob-checking", "2024-01-03", "Grocer", 42.1),
+							},
+							BalanceHistory: []types.BalanceSnapshot{
+								testBalanceSnapshot("bob-checking", "2024-01-31T12:00:00Z", 640, 650),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDumpIsDeterministic(t *testing.T) {
+	origLocation := assertionLocation
+	assertionLocation = time.UTC
+	t.Cleanup(func() { assertionLocation = origLocation })
+
+	dir := t.TempDir()
+	storePath := filepath.Join(dir, "owners.yaml")
+	if err := persistence.NewJSONStore(storePath).DumpOwners(newTestOwners()); err != nil {
+		t.Fatalf("failed to write store: %v", err)
+	}
+
+	var outputs [][]byte
+	for i := 0; i < 5; i++ {
+		appCtx := &app.Context{
+			OutputPath: filepath.Join(dir, "plaid_gen.beancount"),
+			Config: types.Config{
+				Storage: types.StorageConfig{Backend: "json", Path: storePath},
+			},
+		}
+		if err := Dump(appCtx); err != nil {
+			t.Fatalf("Dump: %v", err)
+		}
+
+		data, err := os.ReadFile(appCtx.OutputPath)
+		if err != nil {
+			t.Fatalf("failed to read output: %v", err)
+		}
+		outputs = append(outputs, data)
+	}
+
+	for i := 1; i < len(outputs); i++ {
+		if !bytes.Equal(outputs[0], outputs[i]) {
+			t.Fatalf("dump %d differs from dump 0:\n%s\n---\n%s", i, outputs[i], outputs[0])
+		}
+	}
+
+	goldenPath := filepath.Join("testdata", "plaid_gen.golden.beancount")
+	if os.Getenv("UPDATE_DUMP_GOLDEN") == "1" {
+		if err := os.WriteFile(goldenPath, outputs[0], 0644); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if !bytes.Equal(outputs[0], golden) {
+		t.Fatalf("dump mismatch golden file\n got: %s\nwant: %s", outputs[0], golden)
+	}
+}
+
+func TestDumpUsesAccountCurrency(t *testing.T) {
+	base := testAccountBase("carol-chequing", "Chequing", plaid.ACCOUNTTYPE_DEPOSITORY, 310.5)
+	base.Balances.IsoCurrencyCode = newNullableString("CAD")
+	txn := testTransaction("k1", "carol-chequing", "2024-02-01", "Grocer", 12.3)
+	txn.IsoCurrencyCode = newNullableString("CAD")
+	snapshot := testBalanceSnapshot("carol-chequing", "2024-02-03T12:00:00Z", 310.5, 310.5)
+	snapshot.Balances.IsoCurrencyCode = newNullableString("CAD")
+
+	owners := []types.Owner{{
+		Name: "carol",
+		TransactionInstitutions: []types.TransactionInstitution{{
+			InstitutionBase: types.InstitutionBase{Name: "bank"},
+			TransactionAccounts: []types.TransactionAccount{{
+				AccoutBase:     base,
+				Transactions:   map[string]plaid.Transaction{"k1": txn},
+				BalanceHistory: []types.BalanceSnapshot{snapshot},
+			}},
+		}},
+	}}
+
+	tests := []struct {
+		name    string
+		cfg     types.DumpConfig
+		account string
+	}{
+		{name: "default region", account: "Assets:Carol:CAD:Bank:Depository:Chequing"},
+		{name: "configured region", cfg: types.DumpConfig{Region: "CA"}, account: "Assets:Carol:CA:Bank:Depository:Chequing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := dumpTransactions(types.Config{Dump: tt.cfg}, owners, &buf); err != nil {
+				t.Fatalf("dumpTransactions: %v", err)
+			}
+			out := buf.String()
+
+			for _, want := range []string{
+				"2000-01-01 open " + tt.account + " CAD\n",
+				" balance " + tt.account + " 310.50 CAD\n",
+				"2000-01-01 commodity CAD\n",
+				tt.account + "\n",
+				" 12.30 CAD\n",
+			} {
+				if !strings.Contains(out, want) {
+					t.Errorf("output missing %q:\n%s", want, out)
+				}
+			}
+			if strings.Contains(out, "USD") {
+				t.Errorf("output mentions USD:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestBalanceAssertions(t *testing.T) {
+	origLocation := assertionLocation
+	assertionLocation = time.UTC
+	t.Cleanup(func() { assertionLocation = origLocation })
+
+	noAvailable := testBalanceSnapshot("acct", "2024-03-02T09:00:00Z", 0, 75)
+	noAvailable.Balances.Available = plaid.NullableFloat32{}
+	history := []types.BalanceSnapshot{
+		testBalanceSnapshot("acct", "2024-03-01T09:00:00Z", 90, 100),
+		testBalanceSnapshot("acct", "2024-03-01T18:00:00Z", 95, 105),
+		noAvailable,
+	}
+
+	tests := []struct {
+		name    string
+		cfg     types.DumpConfig
+		typ     plaid.AccountType
+		account string
+		want    []string
+	}{
+		{name: "available by default", typ: plaid.ACCOUNTTYPE_DEPOSITORY, account: "Assets", want: []string{"2024-03-02 95", "2024-03-03 75"}},
+		{name: "current when configured", cfg: types.DumpConfig{Balance: "current"}, typ: plaid.ACCOUNTTYPE_DEPOSITORY, account: "Assets", want: []string{"2024-03-02 105", "2024-03-03 75"}},
+		{name: "credit owes current", cfg: types.DumpConfig{Balance: "available"}, typ: plaid.ACCOUNTTYPE_CREDIT, account: "Liabilities", want: []string{"2024-03-02 -105", "2024-03-03 -75"}},
+		{name: "loan owes current", typ: plaid.ACCOUNTTYPE_LOAN, account: "Liabilities", want: []string{"2024-03-02 -105", "2024-03-03 -75"}},
+		{name: "credit held as assets", typ: plaid.ACCOUNTTYPE_CREDIT, account: "Assets", want: []string{"2024-03-02 105", "2024-03-03 75"}},
+		{name: "investment asserts available cash", cfg: types.DumpConfig{Balance: "current"}, typ: plaid.ACCOUNTTYPE_INVESTMENT, account: "Assets", want: []string{"2024-03-02 95"}},
+		{name: "depository held as liabilities", typ: plaid.ACCOUNTTYPE_DEPOSITORY, account: "Liabilities", want: []string{"2024-03-02 -105", "2024-03-03 -75"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, a := range balanceAssertions(tt.cfg, tt.typ, tt.account, history) {
+				got = append(got, a.Date+" "+a.Amount.String())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("balanceAssertions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPadDate(t *testing.T) {
+	assertions := []BalanceAssertion{{Date: "2024-03-02"}}
+	if got := padDate("2024-01-05", assertions); got != "2024-01-05" {
+		t.Errorf("padDate before first assertion = %s, want 2024-01-05", got)
+	}
+	if got := padDate("2024-03-02", assertions); got != "2024-03-01" {
+		t.Errorf("padDate on first assertion = %s, want 2024-03-01", got)
+	}
+	if got := padDate("", assertions); got != "2024-03-01" {
+		t.Errorf("padDate without transactions = %s, want 2024-03-01", got)
+	}
+	if got := padDate("2024-01-05", nil); got != "" {
+		t.Errorf("padDate without assertions = %s, want empty", got)
+	}
+}
+
+func TestDumpRejectsUnknownBalanceKind(t *testing.T) {
+	var buf bytes.Buffer
+	err := dumpTransactions(types.Config{Dump: types.DumpConfig{Balance: "ledger"}}, nil, &buf)
+	if err == nil || !strings.Contains(err.Error(), "dump.balance") {
+		t.Fatalf("dumpTransactions error = %v, want invalid dump.balance", err)
+	}
+}
@@ -0,0 +1,64 @@
+package dump
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// stringEscaper keeps a value inside one double-quoted Beancount string on
+// one line.
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r\n", " ", "\n", " ", "\r", " ")
+
+// escapeString escapes s for use between double quotes in Beancount, e.g.
+// as a payee, narration or metadata value.
+func escapeString(s string) string {
+	return stringEscaper.Replace(strings.ToValidUTF8(s, "�"))
+}
+
+// accountComponentRE is Beancount's rule for the components of an account
+// name after the root. accountComponent produces, and validateAccountName
+// accepts, exactly these.
+var accountComponentRE = regexp.MustCompile(`^[\p{Lu}\p{Nd}][\p{L}\p{Nd}\-]*$`)
+
+// accountComponent turns s into one component of a Beancount account name:
+// an uppercase letter or digit followed by letters, digits and dashes,
+// Unicode included. Everything else, such as spaces and punctuation, is
+// dropped, and so are leading dashes. A first letter without an uppercase
+// form is prefixed with "X".
+func accountComponent(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '-' && b.Len() > 0 {
+			b.WriteRune(r)
+			continue
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			continue
+		}
+		if b.Len() == 0 && !unicode.IsUpper(r) && !unicode.IsDigit(r) {
+			if upper := unicode.ToUpper(r); unicode.IsUpper(upper) {
+				r = upper
+			} else {
+				b.WriteRune('X')
+			}
+		}
+		b.WriteRune(r)
+	}
+
+	if b.Len() == 0 {
+		return "Unknown"
+	}
+	return b.String()
+}
+
+// accountName joins the account type and components into a Beancount
+// account name, sanitizing every component.
+func accountName(typ string, components ...string) string {
+	parts := make([]string, 0, len(components)+1)
+	parts = append(parts, typ)
+	for _, c := range components {
+		parts = append(parts, accountComponent(c))
+	}
+	return strings.Join(parts, ":")
+}
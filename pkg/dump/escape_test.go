@@ -0,0 +1,101 @@
+package dump
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEscapeString(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"Trader Joe's #123", "Trader Joe's #123"},
+		{`The "Best" Cafe`, `The \"Best\" Cafe`},
+		{`C:\path`, `C:\\path`},
+		{"line one\nline two", "line one line two"},
+		{"Café Déjà Vu", "Café Déjà Vu"},
+	} {
+		if got := escapeString(tc.in); got != tc.want {
+			t.Errorf("escapeString(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAccountComponent(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"Plaid Checking", "PlaidChecking"},
+		{"alice", "Alice"},
+		{"401k", "401k"},
+		{"Shops", "Shops"},
+		{"épargne", "Épargne"},
+		{"Crédit Agricole", "CréditAgricole"},
+		{"招商银行", "X招商银行"},
+		{"Health-Savings", "Health-Savings"},
+		{"- Checking -", "Checking-"},
+		{"--", "Unknown"},
+		{"", "Unknown"},
+	} {
+		if got := accountComponent(tc.in); got != tc.want {
+			t.Errorf("accountComponent(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAccountName(t *testing.T) {
+	got := accountName("Assets", "alice", "USD", "Chase Bank", "depository", "Total Checking")
+	if want := "Assets:Alice:USD:ChaseBank:Depository:TotalChecking"; got != want {
+		t.Errorf("accountName() = %q, want %q", got, want)
+	}
+}
+
+func FuzzAccountComponent(f *testing.F) {
+	for _, seed := range []string{"", "alice", "Plaid Checking", "401k", "ß", "招商银行", "ǆ", "a:b", "-x-", "\xff"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		got := accountComponent(s)
+		if !accountComponentRE.MatchString(got) {
+			t.Fatalf("accountComponent(%q) = %q, not a valid account component", s, got)
+		}
+		if again := accountComponent(got); again != got {
+			t.Fatalf("accountComponent(%q) = %q, but sanitizing again gives %q", s, got, again)
+		}
+	})
+}
+
+func FuzzEscapeString(f *testing.F) {
+	for _, seed := range []string{"", "Trader Joe's", `"quoted"`, `back\slash`, "new\nline", `\"`, "\xff"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		got := escapeString(s)
+		if strings.ContainsAny(got, "\r\n") {
+			t.Fatalf("escapeString(%q) = %q, contains a line break", s, got)
+		}
+		if !utf8.ValidString(got) {
+			t.Fatalf("escapeString(%q) = %q, not valid UTF-8", s, got)
+		}
+
+		// Undo the escaping and check the original text comes back.
+		var b strings.Builder
+		for i := 0; i < len(got); i++ {
+			switch got[i] {
+			case '"':
+				t.Fatalf("escapeString(%q) = %q, has an unescaped quote", s, got)
+			case '\\':
+				i++
+				if i == len(got) || (got[i] != '\\' && got[i] != '"') {
+					t.Fatalf("escapeString(%q) = %q, has a dangling backslash", s, got)
+				}
+			}
+			b.WriteByte(got[i])
+		}
+		want := strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(strings.ToValidUTF8(s, "\uFFFD"))
+		if b.String() != want {
+			t.Fatalf("escapeString(%q) unescapes to %q, want %q", s, b.String(), want)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package dump
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/shopspring/decimal"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// cashTickerPrefix marks Plaid securities that represent a currency balance
+// (e.g. "CUR:USD") rather than a tradable instrument.
+const cashTickerPrefix = "CUR:"
+
+// defaultOpeningDate dates the opening positions of accounts without
+// investment transactions, matching the open directives.
+const defaultOpeningDate = "2000-01-01"
+
+type Position struct {
+	Date      string          `json:"date"`
+	Account   Account         `json:"account"`
+	Quantity  decimal.Decimal `json:"quantity"`
+	Commodity string          `json:"commodity"`
+	Cost      decimal.Decimal `json:"cost"`
+	HasCost   bool            `json:"has_cost"`
+	Unit      string          `json:"unit"`
+}
+
+type Price struct {
+	Date      string          `json:"date"`
+	Commodity string          `json:"commodity"`
+	Amount    decimal.Decimal `json:"amount"`
+	Unit      string          `json:"unit"`
+}
+
+type Commodity struct {
+	Name string `json:"name"`
+	Desc string `json:"desc"`
+}
+
+type Holdings struct {
+	Positions   []Position           `json:"positions"`
+	Prices      map[string]Price     `json:"prices"`
+	Commodities map[string]Commodity `json:"commodities"`
+}
+
+func processHoldings(owners []types.Owner, cfg types.Config, names accountNames) Holdings {
+	holdings := Holdings{
+		Prices:      map[string]Price{},
+		Commodities: map[string]Commodity{},
+	}
+
+	for _, owner := range owners {
+		for _, inst := range owner.InvestmentInstitutions {
+			for _, account := range inst.InvestmentAccounts {
+				override := accountConfig(cfg.Accounts, owner, inst.InstitutionBase, account.AccoutBase)
+				balanceAccount := investAccountToBeanCountBalanceAccount(cfg.Dump, names, override, owner, inst.InstitutionBase, account)
+				booked := investTxnLots(account)
+				opened := openingDate(account)
+				for _, holding := range account.Holdings {
+					security := account.Securities[holding.SecurityId]
+					unit := holdingCurrency(holding, security)
+
+					if currency, ok := cashSecurityCurrency(security); ok {
+						if holding.Quantity != 0 {
+							holdings.Positions = append(holdings.Positions, Position{
+								Date:      opened,
+								Account:   balanceAccount,
+								Quantity:  decimalFromFloat32(holding.Quantity),
+								Commodity: currency,
+							})
+						}
+						continue
+					}
+
+					commodity := securityCommodity(security, holding.SecurityId)
+					holdings.Commodities[commodity] = Commodity{
+						Name: commodity,
+						Desc: nullableString(security.Name),
+					}
+
+					addPrice(holdings.Prices, nullableString(holding.InstitutionPriceAsOf), commodity, decimalFromFloat32(holding.InstitutionPrice), unit)
+					if closePrice := security.ClosePrice.Get(); closePrice != nil {
+						closeUnit := nullableString(security.IsoCurrencyCode)
+						if closeUnit == "" {
+							closeUnit = unit
+						}
+						addPrice(holdings.Prices, nullableString(security.ClosePriceAsOf), commodity, decimalFromFloat32(*closePrice), closeUnit)
+					}
+
+					// Units bought and sold through booked transactions are
+					// already on the ledger at their own cost; only the rest
+					// is an opening lot, at the cost basis they leave.
+					lot := booked[commodity]
+					quantity := decimalFromFloat32(holding.Quantity).Sub(lot.Quantity)
+					if quantity.IsZero() {
+						continue
+					}
+
+					securityAccount := balanceAccount
+					securityAccount.Commodity = commodity
+					position := Position{
+						Date:      opened,
+						Account:   securityAccount,
+						Quantity:  quantity,
+						Commodity: commodity,
+						Unit:      unit,
+					}
+					if costBasis := holding.CostBasis.Get(); costBasis != nil && unit != "" && quantity.IsPositive() {
+						if cost := decimalFromFloat32(*costBasis).Sub(lot.Cost); !cost.IsNegative() {
+							position.Cost = cost.DivRound(quantity, maxPricePlaces)
+							position.HasCost = true
+						}
+					}
+					holdings.Positions = append(holdings.Positions, position)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(holdings.Positions, func(i, j int) bool {
+		a, b := holdings.Positions[i], holdings.Positions[j]
+		if an, bn := a.Account.ToString(), b.Account.ToString(); an != bn {
+			return an < bn
+		}
+		return a.Commodity < b.Commodity
+	})
+
+	return holdings
+}
+
+func addPrice(prices map[string]Price, date, commodity string, amount decimal.Decimal, unit string) {
+	if date == "" || unit == "" || !amount.IsPositive() {
+		return
+	}
+
+	prices[date+" "+commodity+" "+unit] = Price{
+		Date:      date,
+		Commodity: commodity,
+		Amount:    amount,
+		Unit:      unit,
+	}
+}
+
+func holdingCurrency(holding plaid.Holding, security plaid.Security) string {
+	for _, code := range []plaid.NullableString{
+		holding.IsoCurrencyCode,
+		holding.UnofficialCurrencyCode,
+		security.IsoCurrencyCode,
+		security.UnofficialCurrencyCode,
+	} {
+		if c := nullableString(code); c != "" {
+			return c
+		}
+	}
+
+	return ""
+}
+
+func cashSecurityCurrency(security plaid.Security) (string, bool) {
+	ticker := nullableString(security.TickerSymbol)
+	if !strings.HasPrefix(ticker, cashTickerPrefix) {
+		return "", false
+	}
+
+	currency := strings.TrimPrefix(ticker, cashTickerPrefix)
+	return currency, currency != ""
+}
+
+// securityCommodity derives a Beancount commodity name for a security,
+// preferring its ticker and falling back to other identifiers.
+func securityCommodity(security plaid.Security, securityID string) string {
+	for _, candidate := range []string{
+		nullableString(security.TickerSymbol),
+		nullableString(security.Cusip),
+		nullableString(security.Isin),
+		securityID,
+	} {
+		if name := sanitizeCommodity(candidate); name != "" {
+			return name
+		}
+	}
+
+	return "UNKNOWN"
+}
+
+// sanitizeCommodity coerces s into Beancount's commodity syntax: an upper
+// case letter followed by up to 23 of [A-Z0-9'._-], ending in a letter or
+// digit.
+func sanitizeCommodity(s string) string {
+	name := regexp.MustCompile(`[^A-Z0-9'._-]`).ReplaceAllString(strings.ToUpper(s), "")
+	name = strings.TrimLeft(name, "0123456789'._-")
+	if len(name) > 24 {
+		name = name[:24]
+	}
+	name = strings.TrimRight(name, "'._-")
+
+	return name
+}
+
+func nullableString(ns plaid.NullableString) string {
+	if v := ns.Get(); v != nil {
+		return *v
+	}
+
+	return ""
+}
+
+func writeHoldings(w io.Writer, tpls templateSet, holdings Holdings) error {
+	if err := tpls.commodity.Execute(w, holdings.Commodities); err != nil {
+		return fmt.Errorf("failed to generate commodities: %w", err)
+	}
+
+	for _, position := range holdings.Positions {
+		if err := tpls.holding.Execute(w, position); err != nil {
+			return fmt.Errorf("failed to generate holding for %#v: %w", position, err)
+		}
+	}
+
+	if err := tpls.price.Execute(w, holdings.Prices); err != nil {
+		return fmt.Errorf("failed to generate prices: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package dump
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/shopspring/decimal"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// Posting is a single leg of a multi-leg Beancount transaction. When Elided
+// is set the amount is left for Beancount to interpolate.
+type Posting struct {
+	Account Account         `json:"account"`
+	Amount  decimal.Decimal `json:"amount"`
+	Unit    string          `json:"unit"`
+	Cost    string          `json:"cost"`
+	Price   string          `json:"price"`
+	Elided  bool            `json:"elided"`
+}
+
+// investTxnPostings renders buys, sells, income and fees as explicit
+// postings. It returns nil when the transaction should fall back to the
+// plain two-leg cash form.
+func investTxnPostings(investAccount types.InvestmentAccount, balanceAccount Account, txn plaid.InvestmentTransaction) []Posting {
+	unit := txn.GetIsoCurrencyCode()
+	if unit == "" {
+		unit = txn.GetUnofficialCurrencyCode()
+	}
+	if unit == "" {
+		return nil
+	}
+
+	region := balanceAccount.Region
+	fees := investTxnFees(txn)
+
+	switch txn.Type {
+	case "buy", "sell":
+		securityAccount, ok := investTxnSecurityAccount(investAccount, balanceAccount, txn)
+		if !ok || txn.Quantity == 0 {
+			return nil
+		}
+		return tradePostings(txn, balanceAccount, securityAccount, region, unit, fees)
+	case "cash":
+		if !isInvestmentIncome(txn.Subtype) {
+			return nil
+		}
+		return []Posting{
+			{Account: balanceAccount, Amount: decimalFromFloat32(txn.Amount).Neg(), Unit: unit},
+			{Account: investmentChangeAccount("Income", region, txn.Subtype), Elided: true},
+		}
+	case "fee":
+		return []Posting{
+			{Account: investmentChangeAccount("Expenses", region, "Fees"), Amount: decimalFromFloat32(txn.Amount), Unit: unit},
+			{Account: balanceAccount, Elided: true},
+		}
+	default:
+		return nil
+	}
+}
+
+func tradePostings(txn plaid.InvestmentTransaction, balanceAccount, securityAccount Account, region, unit string, fees decimal.Decimal) []Posting {
+	quantity := decimalFromFloat32(txn.Quantity).Abs()
+	amount := decimalFromFloat32(txn.Amount)
+	price := tradePrice(txn, fees)
+
+	var postings []Posting
+	if txn.Type == "buy" {
+		postings = append(postings,
+			Posting{
+				Account: securityAccount,
+				Amount:  quantity,
+				Unit:    securityAccount.Commodity,
+				Cost:    fmt.Sprintf("{%s %s}", formatAmount(price, unit), unit),
+			},
+			Posting{Account: balanceAccount, Elided: true},
+		)
+	} else {
+		postings = append(postings,
+			Posting{
+				Account: securityAccount,
+				Amount:  quantity.Neg(),
+				Unit:    securityAccount.Commodity,
+				Cost:    "{}",
+				Price:   fmt.Sprintf("%s %s", formatAmount(price, unit), unit),
+			},
+			Posting{Account: balanceAccount, Amount: amount.Neg(), Unit: unit},
+			Posting{Account: investmentChangeAccount("Income", region, "CapitalGains"), Elided: true},
+		)
+	}
+
+	if !fees.IsZero() {
+		postings = append(postings, Posting{
+			Account: investmentChangeAccount("Expenses", region, "Fees"),
+			Amount:  fees,
+			Unit:    unit,
+		})
+	}
+
+	return postings
+}
+
+// tradePrice is the per-unit price of a trade, derived from its amount net
+// of fees when Plaid leaves the price out.
+func tradePrice(txn plaid.InvestmentTransaction, fees decimal.Decimal) decimal.Decimal {
+	price := decimalFromFloat32(txn.Price)
+	if price.IsZero() {
+		quantity := decimalFromFloat32(txn.Quantity).Abs()
+		price = decimalFromFloat32(txn.Amount).Abs().Sub(fees).DivRound(quantity, maxPricePlaces)
+	}
+	return price
+}
+
+func investTxnFees(txn plaid.InvestmentTransaction) decimal.Decimal {
+	if f := txn.Fees.Get(); f != nil {
+		return decimalFromFloat32(*f)
+	}
+	return decimal.Zero
+}
+
+func investTxnSecurityAccount(investAccount types.InvestmentAccount, balanceAccount Account, txn plaid.InvestmentTransaction) (Account, bool) {
+	securityID := txn.GetSecurityId()
+	if securityID == "" {
+		return Account{}, false
+	}
+
+	security, ok := investAccount.Securities[securityID]
+	if !ok {
+		return Account{}, false
+	}
+	if _, isCash := cashSecurityCurrency(security); isCash {
+		return Account{}, false
+	}
+
+	securityAccount := balanceAccount
+	securityAccount.Commodity = securityCommodity(security, securityID)
+	return securityAccount, true
+}
+
+func isInvestmentIncome(subtype string) bool {
+	return strings.Contains(subtype, "dividend") ||
+		strings.Contains(subtype, "interest") ||
+		strings.Contains(subtype, "capital gain")
+}
+
+func investmentChangeAccount(typ, region, category string) Account {
+	return Account{
+		Type:     typ,
+		Region:   region,
+		Category: []string{"Investment", strings.Title(category)},
+	}
+}
+
+// bookedLot is what booked trades leave in a commodity: the units they
+// move and the cost of the units still held.
+type bookedLot struct {
+	Quantity decimal.Decimal
+	Cost     decimal.Decimal
+}
+
+// investTxnLots sums the lots booked trades leave in each commodity, so
+// holdings only open the remainder as an opening lot. Sells reduce the
+// booked cost at its average.
+func investTxnLots(account types.InvestmentAccount) map[string]bookedLot {
+	ids := make([]string, 0, len(account.Transactions))
+	for id := range account.Transactions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := account.Transactions[ids[i]], account.Transactions[ids[j]]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		return ids[i] < ids[j]
+	})
+
+	lots := map[string]bookedLot{}
+	for _, id := range ids {
+		txn := account.Transactions[id]
+		for _, posting := range investTxnPostings(account, Account{}, txn) {
+			if posting.Account.Commodity == "" {
+				continue
+			}
+			lot := lots[posting.Account.Commodity]
+			if posting.Amount.IsPositive() {
+				lot.Cost = lot.Cost.Add(posting.Amount.Mul(tradePrice(txn, investTxnFees(txn))))
+			} else if lot.Quantity.IsPositive() {
+				sold := decimal.Min(posting.Amount.Neg(), lot.Quantity)
+				lot.Cost = lot.Cost.Sub(lot.Cost.Mul(sold).Div(lot.Quantity))
+			}
+			lot.Quantity = lot.Quantity.Add(posting.Amount)
+			lots[posting.Account.Commodity] = lot
+		}
+	}
+
+	return lots
+}
+
+// openingDate is the day before the account's first investment
+// transaction, so opening positions precede every booked trade.
+func openingDate(account types.InvestmentAccount) string {
+	first := ""
+	for _, txn := range account.Transactions {
+		if first == "" || txn.Date < first {
+			first = txn.Date
+		}
+	}
+
+	date, err := time.Parse(dateLayout, first)
+	if err != nil {
+		return defaultOpeningDate
+	}
+	return date.AddDate(0, 0, -1).Format(dateLayout)
+}
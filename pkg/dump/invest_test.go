@@ -0,0 +1,268 @@
+package dump
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func testInvestTxn(id, date, typ, subtype string, quantity, price, amount, fees float32) plaid.InvestmentTransaction {
+	txn := plaid.InvestmentTransaction{
+		InvestmentTransactionId: id,
+		AccountId:               "brokerage",
+		Date:                    date,
+		Type:                    typ,
+		Subtype:                 subtype,
+		Quantity:                quantity,
+		Price:                   price,
+		Amount:                  amount,
+		IsoCurrencyCode:         newNullableString("USD"),
+	}
+	if quantity != 0 {
+		txn.SecurityId = newNullableString("sec-vti")
+	}
+	if fees != 0 {
+		txn.Fees = newNullableFloat(fees)
+	}
+	return txn
+}
+
+func testInvestAccount(holdings []plaid.Holding, txns ...plaid.InvestmentTransaction) types.InvestmentAccount {
+	account := types.InvestmentAccount{
+		AccoutBase: testAccountBase("brokerage", "Brokerage", plaid.ACCOUNTTYPE_INVESTMENT, 0),
+		Holdings:   holdings,
+		Securities: map[string]plaid.Security{
+			"sec-vti": {SecurityId: "sec-vti", TickerSymbol: newNullableString("VTI"), IsoCurrencyCode: newNullableString("USD")},
+			"sec-usd": {SecurityId: "sec-usd", TickerSymbol: newNullableString("CUR:USD"), IsoCurrencyCode: newNullableString("USD")},
+		},
+		Transactions: map[string]plaid.InvestmentTransaction{},
+	}
+	for _, txn := range txns {
+		account.Transactions[txn.InvestmentTransactionId] = txn
+	}
+	return account
+}
+
+func postingStrings(postings []Posting) []string {
+	var lines []string
+	for _, p := range postings {
+		if p.Elided {
+			lines = append(lines, p.Account.ToString())
+			continue
+		}
+		line := fmt.Sprintf("%s %s %s", p.Account.ToString(), formatAmount(p.Amount, p.Unit), p.Unit)
+		if p.Cost != "" {
+			line += " " + p.Cost
+		}
+		if p.Price != "" {
+			line += " @ " + p.Price
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestInvestTxnPostings(t *testing.T) {
+	balanceAccount := Account{Type: "Assets", Owner: "alice", Region: "USD", Institution: "broker", PlaidAccountType: "Investment", Name: "Brokerage"}
+	account := testInvestAccount(nil)
+
+	tests := []struct {
+		name string
+		txn  plaid.InvestmentTransaction
+		want []string
+	}{
+		{
+			name: "buy",
+			txn:  testInvestTxn("t", "2024-01-15", "buy", "buy", 2, 240, 480, 0),
+			want: []string{
+				"Assets:Alice:USD:Broker:Investment:Brokerage:VTI 2 VTI {240.00 USD}",
+				"Assets:Alice:USD:Broker:Investment:Brokerage",
+			},
+		},
+		{
+			name: "buy without price",
+			txn:  testInvestTxn("t", "2024-01-15", "buy", "buy", 4, 0, 1000, 0),
+			want: []string{
+				"Assets:Alice:USD:Broker:Investment:Brokerage:VTI 4 VTI {250.00 USD}",
+				"Assets:Alice:USD:Broker:Investment:Brokerage",
+			},
+		},
+		{
+			name: "sell",
+			txn:  testInvestTxn("t", "2024-02-01", "sell", "sell", -1, 260, -260, 0),
+			want: []string{
+				"Assets:Alice:USD:Broker:Investment:Brokerage:VTI -1 VTI {} @ 260.00 USD",
+				"Assets:Alice:USD:Broker:Investment:Brokerage 260.00 USD",
+				"Income:USD:Investment:CapitalGains",
+			},
+		},
+		{
+			name: "buy with fees",
+			txn:  testInvestTxn("t", "2024-01-15", "buy", "buy", 2, 0, 490, 10),
+			want: []string{
+				"Assets:Alice:USD:Broker:Investment:Brokerage:VTI 2 VTI {240.00 USD}",
+				"Assets:Alice:USD:Broker:Investment:Brokerage",
+				"Expenses:USD:Investment:Fees 10.00 USD",
+			},
+		},
+		{
+			name: "sell with fees",
+			txn:  testInvestTxn("t", "2024-02-01", "sell", "sell", -1, 260, -255, 5),
+			want: []string{
+				"Assets:Alice:USD:Broker:Investment:Brokerage:VTI -1 VTI {} @ 260.00 USD",
+				"Assets:Alice:USD:Broker:Investment:Brokerage 255.00 USD",
+				"Income:USD:Investment:CapitalGains",
+				"Expenses:USD:Investment:Fees 5.00 USD",
+			},
+		},
+		{
+			name: "cash dividend",
+			txn:  testInvestTxn("t", "2024-03-01", "cash", "dividend", 0, 0, -12.5, 0),
+			want: []string{
+				"Assets:Alice:USD:Broker:Investment:Brokerage 12.50 USD",
+				"Income:USD:Investment:Dividend",
+			},
+		},
+		{
+			name: "capital gain distribution",
+			txn:  testInvestTxn("t", "2024-12-20", "cash", "long-term capital gain", 0, 0, -30, 0),
+			want: []string{
+				"Assets:Alice:USD:Broker:Investment:Brokerage 30.00 USD",
+				"Income:USD:Investment:Long-TermCapitalGain",
+			},
+		},
+		{
+			name: "account fee",
+			txn:  testInvestTxn("t", "2024-03-31", "fee", "account fee", 0, 0, 3, 0),
+			want: []string{
+				"Expenses:USD:Investment:Fees 3.00 USD",
+				"Assets:Alice:USD:Broker:Investment:Brokerage",
+			},
+		},
+		{name: "deposit falls back", txn: testInvestTxn("t", "2024-01-02", "cash", "deposit", 0, 0, -1000, 0)},
+		{name: "buy without security falls back", txn: testInvestTxn("t", "2024-01-15", "buy", "buy", 0, 240, 480, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postingStrings(investTxnPostings(account, balanceAccount, tt.txn)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("investTxnPostings =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessHoldings(t *testing.T) {
+	holding := func(securityID string, quantity float32, costBasis *float32) plaid.Holding {
+		h := plaid.Holding{AccountId: "brokerage", SecurityId: securityID, Quantity: quantity, IsoCurrencyCode: newNullableString("USD")}
+		if costBasis != nil {
+			h.CostBasis = newNullableFloat(*costBasis)
+		}
+		return h
+	}
+	basis := func(f float32) *float32 { return &f }
+	buy := testInvestTxn("buy", "2024-01-15", "buy", "buy", 2, 240, 480, 0)
+	sell := testInvestTxn("sell", "2024-02-01", "sell", "sell", -1, 260, -260, 0)
+
+	tests := []struct {
+		name    string
+		account types.InvestmentAccount
+		want    []string
+	}{
+		{
+			name:    "no trades",
+			account: testInvestAccount([]plaid.Holding{holding("sec-vti", 6, basis(1200))}),
+			want:    []string{"2000-01-01 Assets:Alice:USD:Broker:Investment:Brokerage:VTI 6 VTI {200 USD}"},
+		},
+		{
+			name:    "remainder at residual cost",
+			account: testInvestAccount([]plaid.Holding{holding("sec-vti", 6, basis(1200))}, buy),
+			want:    []string{"2024-01-14 Assets:Alice:USD:Broker:Investment:Brokerage:VTI 4 VTI {180 USD}"},
+		},
+		{
+			name:    "sells reduce booked cost at its average",
+			account: testInvestAccount([]plaid.Holding{holding("sec-vti", 5, basis(1000))}, buy, sell),
+			want:    []string{"2024-01-14 Assets:Alice:USD:Broker:Investment:Brokerage:VTI 4 VTI {190 USD}"},
+		},
+		{
+			name:    "fully explained by trades",
+			account: testInvestAccount([]plaid.Holding{holding("sec-vti", 2, basis(480))}, buy),
+		},
+		{
+			name:    "trades exceed holdings",
+			account: testInvestAccount([]plaid.Holding{holding("sec-vti", 1, basis(250))}, buy),
+			want:    []string{"2024-01-14 Assets:Alice:USD:Broker:Investment:Brokerage:VTI -1 VTI"},
+		},
+		{
+			name:    "missing cost basis",
+			account: testInvestAccount([]plaid.Holding{holding("sec-vti", 6, nil)}, buy),
+			want:    []string{"2024-01-14 Assets:Alice:USD:Broker:Investment:Brokerage:VTI 4 VTI"},
+		},
+		{
+			name:    "cash",
+			account: testInvestAccount([]plaid.Holding{holding("sec-usd", 150, nil)}, buy),
+			want:    []string{"2024-01-14 Assets:Alice:USD:Broker:Investment:Brokerage 150 USD"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owners := []types.Owner{{
+				Name: "alice",
+				InvestmentInstitutions: []types.InvestmentInstitution{{
+					InstitutionBase:    types.InstitutionBase{Name: "broker"},
+					InvestmentAccounts: []types.InvestmentAccount{tt.account},
+				}},
+			}}
+
+			var got []string
+			for _, p := range processHoldings(owners, types.Config{}, nil).Positions {
+				line := fmt.Sprintf("%s %s %s %s", p.Date, p.Account.ToString(), p.Quantity, p.Commodity)
+				if p.HasCost {
+					line += fmt.Sprintf(" {%s %s}", p.Cost, p.Unit)
+				}
+				got = append(got, line)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("processHoldings =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvestAccountAssertsCash(t *testing.T) {
+	origLocation := assertionLocation
+	assertionLocation = time.UTC
+	t.Cleanup(func() { assertionLocation = origLocation })
+
+	account := testInvestAccount([]plaid.Holding{{AccountId: "brokerage", SecurityId: "sec-usd", Quantity: 150}})
+	account.BalanceHistory = []types.BalanceSnapshot{
+		testBalanceSnapshot("brokerage", "2024-03-01T09:00:00Z", 90, 1000),
+		testBalanceSnapshot("brokerage", "2024-03-02T09:00:00Z", 400, 1100),
+	}
+	owner := types.Owner{Name: "alice"}
+	inst := types.InstitutionBase{Name: "broker"}
+
+	var got []string
+	for _, a := range investAccountToBeanCountBalanceAccount(types.DumpConfig{}, nil, types.AccountConfig{}, owner, inst, account).Assertions {
+		got = append(got, a.Date+" "+a.Amount.String())
+	}
+	// Earlier days assert what Plaid reported as available; the latest one
+	// the cash the holdings were fetched with.
+	if want := []string{"2024-03-02 90", "2024-03-03 150"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("assertions = %v, want %v", got, want)
+	}
+
+	account.Holdings = nil
+	got = nil
+	for _, a := range investAccountToBeanCountBalanceAccount(types.DumpConfig{}, nil, types.AccountConfig{}, owner, inst, account).Assertions {
+		got = append(got, a.Date+" "+a.Amount.String())
+	}
+	if want := []string{"2024-03-02 90", "2024-03-03 400"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("assertions without cash holding = %v, want %v", got, want)
+	}
+}
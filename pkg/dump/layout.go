@@ -0,0 +1,159 @@
+package dump
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// accountsFile holds the open directives, balance assertions, commodities
+// and prices shared by every file of a layout.
+const accountsFile = "accounts.beancount"
+
+var layoutPlaceholders = []string{"{owner}", "{institution}"}
+
+func validateLayout(layout string) error {
+	rest := layout
+	for _, p := range layoutPlaceholders {
+		rest = strings.ReplaceAll(rest, p, "x")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("invalid dump.layout %q: only %s may be used", layout, strings.Join(layoutPlaceholders, " and "))
+	}
+	if strings.Contains(rest, `\`) || !isLocalPath(rest) {
+		return fmt.Errorf("invalid dump.layout %q: must be a relative path inside the output directory", layout)
+	}
+	return nil
+}
+
+func isLocalPath(p string) bool {
+	if p == "" || path.IsAbs(p) {
+		return false
+	}
+	clean := path.Clean(p)
+	return clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// layoutFile is the file, relative to the index, that layout puts the
+// entries of account in.
+func layoutFile(layout string, account Account) string {
+	return path.Clean(strings.NewReplacer(
+		"{owner}", layoutSegment(account.Owner),
+		"{institution}", layoutSegment(account.Institution),
+	).Replace(layout))
+}
+
+// layoutSegment keeps a name from adding or escaping directories.
+func layoutSegment(name string) string {
+	name = strings.NewReplacer("/", "-", `\`, "-").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// homeAccount is the owned account a transaction is filed under: the payer
+// side of a transfer, or the bank or brokerage account it posted to.
+func (t BeancountTransaction) homeAccount() Account {
+	for _, account := range t.Accounts() {
+		if account.Owner != "" {
+			return account
+		}
+	}
+	return Account{}
+}
+
+// renderLayout renders l as one file per owner and institution named by
+// layout, plus accounts.beancount and an index, named indexName, that
+// includes them all. Keys are slash-separated paths relative to the index.
+func renderLayout(layout, indexName string, tpls templateSet, l ledger) (map[string][]byte, error) {
+	if err := validateLayout(layout); err != nil {
+		return nil, err
+	}
+
+	bufs := map[string]*bytes.Buffer{}
+	buffer := func(name string) (*bytes.Buffer, error) {
+		if name == indexName || name == accountsFile {
+			return nil, fmt.Errorf("dump.layout %q names %s, which is reserved", layout, name)
+		}
+		if bufs[name] == nil {
+			bufs[name] = &bytes.Buffer{}
+		}
+		return bufs[name], nil
+	}
+
+	for _, bcTxn := range l.transactions {
+		buf, err := buffer(layoutFile(layout, bcTxn.homeAccount()))
+		if err != nil {
+			return nil, err
+		}
+		if err := tpls.transaction.Execute(buf, bcTxn); err != nil {
+			return nil, fmt.Errorf("failed to generate transaction: %w", err)
+		}
+	}
+
+	for _, position := range l.holdings.Positions {
+		buf, err := buffer(layoutFile(layout, position.Account))
+		if err != nil {
+			return nil, err
+		}
+		if err := tpls.holding.Execute(buf, position); err != nil {
+			return nil, fmt.Errorf("failed to generate holding for %#v: %w", position, err)
+		}
+	}
+
+	var accounts bytes.Buffer
+	if err := tpls.openAccount.Execute(&accounts, l.accounts); err != nil {
+		return nil, fmt.Errorf("failed to generate open balance account: %w", err)
+	}
+	if err := tpls.commodity.Execute(&accounts, l.holdings.Commodities); err != nil {
+		return nil, fmt.Errorf("failed to generate commodities: %w", err)
+	}
+	if err := tpls.price.Execute(&accounts, l.holdings.Prices); err != nil {
+		return nil, fmt.Errorf("failed to generate prices: %w", err)
+	}
+
+	names := make([]string, 0, len(bufs))
+	for name := range bufs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var index bytes.Buffer
+	fmt.Fprintf(&index, "include %q\n", accountsFile)
+	for _, name := range names {
+		fmt.Fprintf(&index, "include %q\n", name)
+	}
+
+	files := map[string][]byte{
+		indexName:    index.Bytes(),
+		accountsFile: accounts.Bytes(),
+	}
+	for name, buf := range bufs {
+		files[name] = buf.Bytes()
+	}
+	return files, nil
+}
+
+// renderFiles renders the dump as the files cfg lays it out in, keyed by
+// path relative to the output file's directory. Without a layout that is
+// the single file indexName.
+func renderFiles(cfg types.Config, tpls templateSet, owners []types.Owner, indexName string) (map[string][]byte, error) {
+	if cfg.Dump.Layout == "" {
+		var buf bytes.Buffer
+		if err := writeLedger(&buf, tpls, cfg, owners); err != nil {
+			return nil, err
+		}
+		return map[string][]byte{indexName: buf.Bytes()}, nil
+	}
+
+	l, err := buildLedger(cfg, owners)
+	if err != nil {
+		return nil, err
+	}
+	return renderLayout(cfg.Dump.Layout, indexName, tpls, l)
+}
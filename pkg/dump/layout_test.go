@@ -0,0 +1,95 @@
+package dump
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xiaomi388/beancount-automation/pkg/app"
+	"github.com/xiaomi388/beancount-automation/pkg/persistence"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func TestDumpLayout(t *testing.T) {
+	dir := t.TempDir()
+	storePath := filepath.Join(dir, "owners.yaml")
+	if err := persistence.NewJSONStore(storePath).DumpOwners(newTestOwners()); err != nil {
+		t.Fatalf("failed to write store: %v", err)
+	}
+
+	appCtx := &app.Context{
+		OutputPath: filepath.Join(dir, "main.beancount"),
+		Config: types.Config{
+			Storage: types.StorageConfig{Backend: "json", Path: storePath},
+			Dump:    types.DumpConfig{Layout: "{owner}/{institution}.beancount"},
+		},
+	}
+	if err := Dump(appCtx); err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		return string(data)
+	}
+
+	wantIndex := `include "accounts.beancount"
+include "alice/bank.beancount"
+include "alice/broker.beancount"
+include "bob/bank.beancount"
+`
+	if got := read("main.beancount"); got != wantIndex {
+		t.Fatalf("index = %q, want %q", got, wantIndex)
+	}
+
+	accounts := read("accounts.beancount")
+	for _, want := range []string{"open Assets:Alice:USD:Bank:Depository:Checking USD", "commodity VTI", "price VTI 250.00 USD"} {
+		if !strings.Contains(accounts, want) {
+			t.Errorf("accounts.beancount missing %q:\n%s", want, accounts)
+		}
+	}
+
+	// Transfers are filed with the payer; every transaction is written once.
+	if got := read("alice/bank.beancount"); !strings.Contains(got, `"transfer alice -> bob"`) {
+		t.Errorf("alice/bank.beancount missing the transfer to bob:\n%s", got)
+	}
+	if got := read("alice/broker.beancount"); !strings.Contains(got, `"Opening position"`) || !strings.Contains(got, `"Buy VTI"`) {
+		t.Errorf("alice/broker.beancount missing investment entries:\n%s", got)
+	}
+
+	var split int
+	for _, name := range []string{"alice/bank.beancount", "alice/broker.beancount", "bob/bank.beancount"} {
+		split += strings.Count(read(name), " * ")
+	}
+	single, err := renderFiles(types.Config{}, mustLoadTemplates(t), newTestOwners(), "single.beancount")
+	if err != nil {
+		t.Fatalf("renderFiles: %v", err)
+	}
+	if want := strings.Count(string(single["single.beancount"]), " * "); split != want {
+		t.Errorf("layout wrote %d transactions, single file has %d", split, want)
+	}
+}
+
+func TestValidateLayout(t *testing.T) {
+	for _, layout := range []string{"{owner}/{institution}.beancount", "{owner}.beancount", "ledgers/{institution}/{owner}.beancount"} {
+		if err := validateLayout(layout); err != nil {
+			t.Errorf("validateLayout(%q) = %v, want nil", layout, err)
+		}
+	}
+	for _, layout := range []string{"{year}/{owner}.beancount", "/abs/{owner}.beancount", "../{owner}.beancount", `{owner}\x.beancount`, "{owner"} {
+		if err := validateLayout(layout); err == nil {
+			t.Errorf("validateLayout(%q) = nil, want error", layout)
+		}
+	}
+}
+
+func TestLayoutFileKeepsNamesInside(t *testing.T) {
+	got := layoutFile("{owner}/{institution}.beancount", Account{Owner: "..", Institution: "a/b"})
+	if got != "_/a-b.beancount" {
+		t.Fatalf("layoutFile = %q, want _/a-b.beancount", got)
+	}
+}
@@ -0,0 +1,124 @@
+package dump
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/sirupsen/logrus"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// accountNames maps Plaid account ids to the name segment of their
+// Beancount accounts where that is not the Plaid account name.
+type accountNames map[string]string
+
+func (n accountNames) name(base plaid.AccountBase) string {
+	if name, ok := n[base.AccountId]; ok {
+		return name
+	}
+	return base.Name
+}
+
+// resolveAccountNames names every account by its alias or Plaid name, then
+// tells apart accounts whose Beancount names collide, e.g. two cards both
+// called "Credit Card" at one institution, so their ledgers are not merged.
+// The first account seen keeps the name, so linking another card does not
+// rename one already in the ledger; the others without an alias get their
+// mask appended, or their account id when they have no mask or the mask
+// does not help.
+func resolveAccountNames(cfg types.Config, owners []types.Owner) (accountNames, error) {
+	names := accountNames{}
+	for id, alias := range cfg.Dump.Aliases {
+		names[id] = alias
+	}
+
+	suffixed := map[string]string{}
+	for _, group := range findCollisions(cfg, names, owners) {
+		keeper := ""
+		for _, base := range group.bases {
+			if _, ok := cfg.Dump.Aliases[base.AccountId]; ok {
+				keeper = base.AccountId
+				break
+			}
+		}
+		if keeper == "" {
+			keeper = group.bases[0].AccountId
+		}
+
+		for _, base := range group.bases {
+			if _, ok := cfg.Dump.Aliases[base.AccountId]; ok || base.AccountId == keeper {
+				continue
+			}
+			if mask := base.GetMask(); mask != "" {
+				names[base.AccountId] = base.Name + " " + mask
+				suffixed[base.AccountId] = "mask"
+			} else {
+				names[base.AccountId] = base.Name + " " + base.AccountId
+				suffixed[base.AccountId] = "account id"
+			}
+		}
+	}
+
+	for _, group := range findCollisions(cfg, names, owners) {
+		for _, base := range group.bases {
+			if suffixed[base.AccountId] == "mask" {
+				names[base.AccountId] = base.Name + " " + base.AccountId
+				suffixed[base.AccountId] = "account id"
+			}
+		}
+	}
+
+	if remaining := findCollisions(cfg, names, owners); len(remaining) > 0 {
+		return nil, fmt.Errorf("several accounts are named %s; set dump.aliases to tell them apart", remaining[0].name)
+	}
+
+	ids := make([]string, 0, len(suffixed))
+	for id := range suffixed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		logrus.Warnf("account %s shares its name with an earlier account; naming it %q by its %s, set dump.aliases to choose a name", id, names[id], suffixed[id])
+	}
+	return names, nil
+}
+
+type collision struct {
+	name  string
+	bases []plaid.AccountBase
+}
+
+// findCollisions returns the Beancount names shared by more than one Plaid
+// account, in name order, with the accounts in the order they are stored.
+func findCollisions(cfg types.Config, names accountNames, owners []types.Owner) []collision {
+	byName := map[string][]plaid.AccountBase{}
+	add := func(account Account, base plaid.AccountBase) {
+		name := account.ToString()
+		byName[name] = append(byName[name], base)
+	}
+	for _, owner := range owners {
+		for _, inst := range owner.TransactionInstitutions {
+			for _, account := range inst.TransactionAccounts {
+				override := accountConfig(cfg.Accounts, owner, inst.InstitutionBase, account.AccoutBase)
+				add(txnAccountToBeanCountBalanceAccount(cfg.Dump, names, override, owner, inst.InstitutionBase, account), account.AccoutBase)
+			}
+		}
+		for _, inst := range owner.InvestmentInstitutions {
+			for _, account := range inst.InvestmentAccounts {
+				override := accountConfig(cfg.Accounts, owner, inst.InstitutionBase, account.AccoutBase)
+				add(investAccountToBeanCountBalanceAccount(cfg.Dump, names, override, owner, inst.InstitutionBase, account), account.AccoutBase)
+			}
+		}
+	}
+
+	var collisions []collision
+	for name, bases := range byName {
+		if len(bases) < 2 {
+			continue
+		}
+		collisions = append(collisions, collision{name: name, bases: bases})
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].name < collisions[j].name })
+	return collisions
+}
@@ -0,0 +1,139 @@
+package dump
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func collidingOwners() []types.Owner {
+	card := func(id, name, mask string) types.TransactionAccount {
+		base := testAccountBase(id, name, plaid.ACCOUNTTYPE_CREDIT, 10)
+		if mask != "" {
+			base.Mask = newNullableString(mask)
+		}
+		return types.TransactionAccount{
+			AccoutBase: base,
+			Transactions: map[string]plaid.Transaction{
+				id + "-t": testTransaction(id+"-t", id, "2024-01-02", "Coffee", 4.5),
+			},
+		}
+	}
+
+	return []types.Owner{{
+		Name: "dave",
+		TransactionInstitutions: []types.TransactionInstitution{{
+			InstitutionBase: types.InstitutionBase{Name: "bank"},
+			TransactionAccounts: []types.TransactionAccount{
+				card("c1", "Credit Card", "1111"),
+				card("c2", "Credit Card", "2222"),
+				card("c3", "Credit.Card", ""),
+				card("c4", "Savings Card", "3333"),
+			},
+		}},
+	}}
+}
+
+func TestResolveAccountNames(t *testing.T) {
+	owners := collidingOwners()
+	inst := &owners[0].TransactionInstitutions[0]
+	sameMask := testAccountBase("c5", "Credit Card", plaid.ACCOUNTTYPE_CREDIT, 10)
+	sameMask.Mask = newNullableString("1111")
+	inst.TransactionAccounts = append(inst.TransactionAccounts, types.TransactionAccount{AccoutBase: sameMask})
+
+	names, err := resolveAccountNames(types.Config{}, owners)
+	if err != nil {
+		t.Fatalf("resolveAccountNames: %v", err)
+	}
+
+	// c1 was seen first and keeps its name; c3 has no mask and falls back
+	// to its id.
+	want := accountNames{
+		"c2": "Credit Card 2222",
+		"c3": "Credit.Card c3",
+		"c5": "Credit Card 1111",
+	}
+	if len(names) != len(want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+	for id, name := range want {
+		if names[id] != name {
+			t.Errorf("names[%s] = %q, want %q", id, names[id], name)
+		}
+	}
+
+	// An account named like a mask-suffixed one pushes that one to its id.
+	clash := testAccountBase("c6", "Credit Card 2222", plaid.ACCOUNTTYPE_CREDIT, 10)
+	inst.TransactionAccounts = append(inst.TransactionAccounts, types.TransactionAccount{AccoutBase: clash})
+	if names, err = resolveAccountNames(types.Config{}, owners); err != nil {
+		t.Fatalf("resolveAccountNames: %v", err)
+	}
+	if names["c2"] != "Credit Card c2" {
+		t.Errorf("names[c2] = %q, want %q", names["c2"], "Credit Card c2")
+	}
+}
+
+func TestResolveAccountNamesKeepsFirstAccountName(t *testing.T) {
+	owners := collidingOwners()
+	inst := &owners[0].TransactionInstitutions[0]
+	before, err := resolveAccountNames(types.Config{}, owners)
+	if err != nil {
+		t.Fatalf("resolveAccountNames: %v", err)
+	}
+
+	// Linking another "Credit Card" later must not rename the ones already
+	// in the ledger.
+	later := testAccountBase("a0", "Credit Card", plaid.ACCOUNTTYPE_CREDIT, 10)
+	later.Mask = newNullableString("4444")
+	inst.TransactionAccounts = append(inst.TransactionAccounts, types.TransactionAccount{AccoutBase: later})
+	after, err := resolveAccountNames(types.Config{}, owners)
+	if err != nil {
+		t.Fatalf("resolveAccountNames: %v", err)
+	}
+
+	for _, id := range []string{"c1", "c2", "c3"} {
+		if before[id] != after[id] {
+			t.Errorf("account %s renamed from %q to %q", id, before[id], after[id])
+		}
+	}
+	if after["a0"] != "Credit Card 4444" {
+		t.Errorf("names[a0] = %q, want %q", after["a0"], "Credit Card 4444")
+	}
+}
+
+func TestDumpSeparatesCollidingAccounts(t *testing.T) {
+	cfg := types.Config{Dump: types.DumpConfig{Aliases: map[string]string{"c3": "Travel Card"}}}
+
+	var buf bytes.Buffer
+	if err := dumpTransactions(cfg, collidingOwners(), &buf); err != nil {
+		t.Fatalf("dumpTransactions: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"open Liabilities:Dave:USD:Bank:Credit:CreditCard USD",
+		"open Liabilities:Dave:USD:Bank:Credit:CreditCard2222 USD",
+		"open Liabilities:Dave:USD:Bank:Credit:TravelCard USD",
+		"open Liabilities:Dave:USD:Bank:Credit:SavingsCard USD",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "CreditCard1111") {
+		t.Errorf("output renamed the first account:\n%s", out)
+	}
+}
+
+func TestDumpRejectsCollidingAliases(t *testing.T) {
+	cfg := types.Config{Dump: types.DumpConfig{Aliases: map[string]string{"c1": "Card", "c4": "Card"}}}
+
+	var buf bytes.Buffer
+	err := dumpTransactions(cfg, collidingOwners(), &buf)
+	if err == nil || !strings.Contains(err.Error(), "Liabilities:Dave:USD:Bank:Credit:Card") {
+		t.Fatalf("dumpTransactions error = %v, want colliding aliases", err)
+	}
+}
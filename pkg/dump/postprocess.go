@@ -4,6 +4,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
@@ -112,16 +113,16 @@ func mergeSelfTransfers(transactions []BeancountTransaction, processed map[int]b
 	result := make([]BeancountTransaction, 0)
 
 	for i, fromTxn := range transactions {
-		if processed[i] || fromTxn.FromAccount.Type != "Assets" {
+		if processed[i] || fromTxn.FromAccount.Type != "Assets" || len(fromTxn.Postings) > 0 {
 			continue
 		}
 
 		for j, toTxn := range transactions {
-			if processed[j] || j == i {
+			if processed[j] || j == i || len(toTxn.Postings) > 0 {
 				continue
 			}
 
-			if !unitsMatch(fromTxn, toTxn) || fromTxn.Amount != toTxn.Amount {
+			if !unitsMatch(fromTxn, toTxn) || !fromTxn.Amount.Equal(toTxn.Amount) {
 				continue
 			}
 
@@ -155,16 +156,16 @@ func mergeCrossOwnerTransfers(transactions []BeancountTransaction, processed map
 	result := make([]BeancountTransaction, 0)
 
 	for i, fromTxn := range transactions {
-		if processed[i] || fromTxn.FromAccount.Type != "Assets" {
+		if processed[i] || fromTxn.FromAccount.Type != "Assets" || len(fromTxn.Postings) > 0 {
 			continue
 		}
 
 		for j, toTxn := range transactions {
-			if processed[j] || j == i {
+			if processed[j] || j == i || len(toTxn.Postings) > 0 {
 				continue
 			}
 
-			if !unitsMatch(fromTxn, toTxn) || fromTxn.Amount != toTxn.Amount {
+			if !unitsMatch(fromTxn, toTxn) || !fromTxn.Amount.Equal(toTxn.Amount) {
 				continue
 			}
 
@@ -257,6 +258,24 @@ func matchesRule(txn BeancountTransaction, crit types.MatchCriteria) bool {
 	if !matchesText(txn.Payee, crit.Payee) {
 		return false
 	}
+	if !matchesText(txn.FromAccount.ToString(), crit.FromAccount) {
+		return false
+	}
+	if !matchesText(txn.ToAccount.ToString(), crit.ToAccount) {
+		return false
+	}
+	if crit.Owner != "" && txn.homeAccount().Owner != crit.Owner {
+		return false
+	}
+	if !matchesAmount(txn.Amount, crit.Amount) {
+		return false
+	}
+	if crit.Date.From != "" && txn.Date < crit.Date.From {
+		return false
+	}
+	if crit.Date.To != "" && txn.Date > crit.Date.To {
+		return false
+	}
 
 	if len(crit.Metadata) > 0 {
 		for key, tc := range crit.Metadata {
@@ -270,18 +289,60 @@ func matchesRule(txn BeancountTransaction, crit types.MatchCriteria) bool {
 		}
 	}
 
+	if len(crit.Any) > 0 {
+		matched := false
+		for _, c := range crit.Any {
+			if matchesRule(txn, c) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, c := range crit.All {
+		if !matchesRule(txn, c) {
+			return false
+		}
+	}
+	if crit.Not != nil && matchesRule(txn, *crit.Not) {
+		return false
+	}
+
+	return true
+}
+
+func matchesAmount(amount decimal.Decimal, crit types.AmountCriteria) bool {
+	if crit.Min != nil && amount.LessThan(decimal.NewFromFloat(*crit.Min)) {
+		return false
+	}
+	if crit.Max != nil && amount.GreaterThan(decimal.NewFromFloat(*crit.Max)) {
+		return false
+	}
 	return true
 }
 
 func matchesText(value string, crit types.TextCriteria) bool {
-	if crit.Equals != "" && value != crit.Equals {
+	if crit.Regex != "" {
+		if re := crit.Regexp(); re == nil || !re.MatchString(value) {
+			return false
+		}
+	}
+
+	fold := func(s string) string { return s }
+	if crit.IgnoreCase {
+		fold = strings.ToLower
+	}
+
+	if crit.Equals != "" && fold(value) != fold(crit.Equals) {
 		return false
 	}
 
 	if len(crit.Contains) > 0 {
 		found := false
 		for _, needle := range crit.Contains {
-			if needle != "" && strings.Contains(value, needle) {
+			if needle != "" && strings.Contains(fold(value), fold(needle)) {
 				found = true
 				break
 			}
@@ -0,0 +1,105 @@
+package dump
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func compileRule(t *testing.T, crit types.MatchCriteria) types.MatchCriteria {
+	t.Helper()
+	cfg := types.PostprocessConfig{Categorise: &types.CategoriseConfig{KeywordRules: []types.KeywordRule{{Match: crit}}}}
+	if err := cfg.Compile(); err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	return cfg.Categorise.KeywordRules[0].Match
+}
+
+func TestMatchesRule(t *testing.T) {
+	checking := Account{Type: "Assets", Owner: "alice", Region: "USD", Institution: "bank", PlaidAccountType: "Depository", Name: "Checking"}
+	groceries := Account{Type: "Expenses", Region: "USD", Category: []string{"Shops", "Groceries"}}
+	txn := BeancountTransaction{
+		Date:        "2024-03-15",
+		Payee:       "Trader Joe's",
+		Desc:        "TRADER JOE'S #552 SEATTLE",
+		FromAccount: checking,
+		ToAccount:   groceries,
+		Amount:      decimal.RequireFromString("42.10"),
+		Unit:        "USD",
+		Metadata:    map[string]string{"id": "t1"},
+	}
+
+	lo, hi := 40.0, 42.1
+	tests := []struct {
+		name string
+		crit types.MatchCriteria
+		want bool
+	}{
+		{name: "empty", want: true},
+		{name: "regex", crit: types.MatchCriteria{Description: types.TextCriteria{Regex: `^TRADER JOE'S #\d+`}}, want: true},
+		{name: "regex miss", crit: types.MatchCriteria{Description: types.TextCriteria{Regex: `^WHOLE FOODS`}}, want: false},
+		{name: "case-insensitive regex", crit: types.MatchCriteria{Description: types.TextCriteria{Regex: `trader joe`, IgnoreCase: true}}, want: true},
+		{name: "case-sensitive contains", crit: types.MatchCriteria{Payee: types.TextCriteria{Contains: []string{"trader"}}}, want: false},
+		{name: "case-insensitive contains", crit: types.MatchCriteria{Payee: types.TextCriteria{Contains: []string{"trader"}, IgnoreCase: true}}, want: true},
+		{name: "case-insensitive equals", crit: types.MatchCriteria{Payee: types.TextCriteria{Equals: "TRADER JOE'S", IgnoreCase: true}}, want: true},
+		{name: "amount in range", crit: types.MatchCriteria{Amount: types.AmountCriteria{Min: &lo, Max: &hi}}, want: true},
+		{name: "amount at min", crit: types.MatchCriteria{Amount: types.AmountCriteria{Min: &hi}}, want: true},
+		{name: "amount above max", crit: types.MatchCriteria{Amount: types.AmountCriteria{Max: &lo}}, want: false},
+		{name: "date window", crit: types.MatchCriteria{Date: types.DateCriteria{From: "2024-03-01", To: "2024-03-15"}}, want: true},
+		{name: "date before window", crit: types.MatchCriteria{Date: types.DateCriteria{From: "2024-03-16"}}, want: false},
+		{name: "from account", crit: types.MatchCriteria{FromAccount: types.TextCriteria{Regex: `^Assets:Alice:.*:Checking$`}}, want: true},
+		{name: "to account", crit: types.MatchCriteria{ToAccount: types.TextCriteria{Equals: "Expenses:USD:Shops:Groceries"}}, want: true},
+		{name: "owner", crit: types.MatchCriteria{Owner: "alice"}, want: true},
+		{name: "other owner", crit: types.MatchCriteria{Owner: "bob"}, want: false},
+		{name: "any", crit: types.MatchCriteria{Any: []types.MatchCriteria{{Owner: "bob"}, {Payee: types.TextCriteria{Equals: "Trader Joe's"}}}}, want: true},
+		{name: "any none", crit: types.MatchCriteria{Any: []types.MatchCriteria{{Owner: "bob"}, {Owner: "carol"}}}, want: false},
+		{name: "all", crit: types.MatchCriteria{All: []types.MatchCriteria{{Owner: "alice"}, {Owner: "bob"}}}, want: false},
+		{name: "not", crit: types.MatchCriteria{Not: &types.MatchCriteria{Description: types.TextCriteria{Regex: `SEATTLE$`}}}, want: false},
+		{name: "nested", crit: types.MatchCriteria{
+			Owner: "alice",
+			Not:   &types.MatchCriteria{Any: []types.MatchCriteria{{Amount: types.AmountCriteria{Min: &hi}}, {Owner: "bob"}}},
+		}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesRule(txn, compileRule(t, tt.crit)); got != tt.want {
+				t.Errorf("matchesRule = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRulesPointsAtRule(t *testing.T) {
+	lo, hi := 10.0, 5.0
+	tests := []struct {
+		name    string
+		crit    types.MatchCriteria
+		wantErr string
+	}{
+		{name: "regex", crit: types.MatchCriteria{Payee: types.TextCriteria{Regex: `(`}}, wantErr: "postprocess.categorise.keyword_rules[1].match.payee.regex"},
+		{name: "nested regex", crit: types.MatchCriteria{Any: []types.MatchCriteria{{}, {Not: &types.MatchCriteria{Description: types.TextCriteria{Regex: `[`}}}}}, wantErr: "keyword_rules[1].match.any[1].not.description.regex"},
+		{name: "metadata regex", crit: types.MatchCriteria{Metadata: map[string]types.TextCriteria{"id": {Regex: `*`}}}, wantErr: "keyword_rules[1].match.metadata.id.regex"},
+		{name: "amount", crit: types.MatchCriteria{Amount: types.AmountCriteria{Min: &lo, Max: &hi}}, wantErr: "keyword_rules[1].match.amount: min 10 is above max 5"},
+		{name: "date", crit: types.MatchCriteria{Date: types.DateCriteria{From: "2024-13-01"}}, wantErr: `keyword_rules[1].match.date.from "2024-13-01"`},
+		{name: "date order", crit: types.MatchCriteria{Date: types.DateCriteria{From: "2024-02-01", To: "2024-01-01"}}, wantErr: "keyword_rules[1].match.date: from 2024-02-01 is after to 2024-01-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := types.Config{Postprocess: types.PostprocessConfig{Categorise: &types.CategoriseConfig{
+				KeywordRules: []types.KeywordRule{{}, {Match: tt.crit}},
+			}}}
+			err := cfg.Postprocess.Compile()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Compile error = %v, want %q", err, tt.wantErr)
+			}
+
+			if _, err := buildLedger(cfg, nil); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("buildLedger error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,31 +1,156 @@
 package dump
 
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/shopspring/decimal"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// templateFuncs are available to every template.
+var templateFuncs = template.FuncMap{
+	"amount":  formatAmount,
+	"escape":  escapeString,
+	"join":    strings.Join,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+}
+
+// templateSet holds the templates a dump renders with.
+type templateSet struct {
+	transaction *template.Template
+	openAccount *template.Template
+	commodity   *template.Template
+	holding     *template.Template
+	price       *template.Template
+}
+
+// loadTemplates parses the built-in templates, replaced by the files cfg
+// names, and dry-runs each on sample data so a broken template fails before
+// anything is written.
+func loadTemplates(cfg types.TemplatesConfig) (templateSet, error) {
+	var set templateSet
+	for _, t := range []struct {
+		name   string
+		path   string
+		text   string
+		dst    **template.Template
+		sample []interface{}
+	}{
+		{"transaction", cfg.Transaction, transactionTemplate, &set.transaction, []interface{}{sampleTransaction(false), sampleTransaction(true)}},
+		{"openAccount", cfg.OpenAccount, openAccountTemplate, &set.openAccount, []interface{}{map[string]Account{sampleAccount().ToString(): sampleAccount()}}},
+		{"commodity", cfg.Commodity, commodityTemplate, &set.commodity, []interface{}{map[string]Commodity{"VTI": {Name: "VTI", Desc: "Vanguard Total Stock Market ETF"}}}},
+		{"holding", cfg.Holding, holdingTemplate, &set.holding, []interface{}{samplePosition()}},
+		{"price", cfg.Price, priceTemplate, &set.price, []interface{}{map[string]Price{"VTI": {Date: "2024-01-31", Commodity: "VTI", Amount: decimal.NewFromInt(250), Unit: "USD"}}}},
+	} {
+		text := t.text
+		source := "built-in"
+		if t.path != "" {
+			data, err := os.ReadFile(t.path)
+			if err != nil {
+				return templateSet{}, fmt.Errorf("failed to read %s template: %w", t.name, err)
+			}
+			text, source = string(data), t.path
+		}
+
+		tpl, err := template.New(t.name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return templateSet{}, fmt.Errorf("invalid %s template %s: %w", t.name, source, err)
+		}
+		for _, data := range t.sample {
+			if err := tpl.Execute(io.Discard, data); err != nil {
+				return templateSet{}, fmt.Errorf("invalid %s template %s: %w", t.name, source, err)
+			}
+		}
+		*t.dst = tpl
+	}
+	return set, nil
+}
+
+func sampleAccount() Account {
+	return Account{
+		Type:                 "Assets",
+		Owner:                "alice",
+		Region:               "USD",
+		Institution:          "bank",
+		PlaidAccountType:     "Depository",
+		Name:                 "Checking",
+		FirstTransactionDate: "2024-01-03",
+		Assertions:           []BalanceAssertion{{Date: "2024-02-01", Amount: decimal.NewFromInt(100)}},
+		PadDate:              "2024-01-03",
+		Currency:             "USD",
+	}
+}
+
+func sampleTransaction(withPostings bool) BeancountTransaction {
+	txn := BeancountTransaction{
+		Date:        "2024-01-03",
+		Payee:       "Grocer",
+		Desc:        "Grocer",
+		Tags:        []string{"sample"},
+		Metadata:    map[string]string{"id": "txn-1", "payer": "alice"},
+		ToAccount:   Account{Type: "Expenses", Region: "USD", Category: []string{"Shops", "Groceries"}},
+		FromAccount: sampleAccount(),
+		Amount:      decimal.NewFromInt(42),
+		Unit:        "USD",
+	}
+	if withPostings {
+		txn.Postings = []Posting{
+			{Account: sampleAccount(), Amount: decimal.NewFromInt(2), Unit: "VTI", Cost: "{240 USD}", Price: "240 USD"},
+			{Account: sampleAccount(), Elided: true},
+		}
+	}
+	return txn
+}
+
+func samplePosition() Position {
+	return Position{
+		Date:      "2024-01-31",
+		Account:   sampleAccount(),
+		Quantity:  decimal.NewFromInt(4),
+		Commodity: "VTI",
+		Cost:      decimal.NewFromInt(200),
+		HasCost:   true,
+		Unit:      "USD",
+	}
+}
+
 const transactionTemplate = `
-{{ .Date }} * "{{ .Payee }}" "{{ .Desc }}" {{ range $tag := .Tags }}#{{ $tag }}{{ end }}
+{{ .Date }} * "{{ escape .Payee }}" "{{ escape .Desc }}" {{ range $tag := .Tags }}#{{ $tag }}{{ end }}
     {{ range $k, $v := .Metadata -}}
-    {{ $k }}:"{{ $v }}"
+    {{ $k }}:"{{ escape $v }}"
     {{ end -}}
-    {{ .ToAccount.ToString }} {{ .Amount }} {{ .Unit }}
-    {{ .FromAccount.ToString }}
+    {{ if .Postings }}{{ range $i, $p := .Postings }}{{ if $i }}
+    {{ end }}{{ $p.Account.ToString }}{{ if not $p.Elided }} {{ amount $p.Amount $p.Unit }} {{ $p.Unit }}{{ if $p.Cost }} {{ $p.Cost }}{{ end }}{{ if $p.Price }} @ {{ $p.Price }}{{ end }}{{ end }}{{ end }}{{ else }}{{ .ToAccount.ToString }} {{ amount .Amount .Unit }} {{ .Unit }}
+    {{ .FromAccount.ToString }}{{ end }}
 `
 
 const openAccountTemplate = `
 2000-01-01 open Equity:OpenBalance
-{{ range $name, $account := . }}2000-01-01 open {{ $name }}
-{{ if eq $account.Type "Assets"}}
-{{ if $account.FirstTransactionDate }}{{ $account.FirstTransactionDate }}{{ else }}2022-01-01{{ end }} pad {{ $name }} Equity:OpenBalance
-2999-01-01 balance {{ $name }} {{ $account.Balance }} USD
-{{ end }}
+{{ range $name, $account := . }}2000-01-01 open {{ $name }}{{ if $account.Commodity }} {{ $account.Commodity }} "FIFO"{{ else if $account.Currency }} {{ $account.Currency }}{{ end }}
+{{ if and $account.Assertions (not $account.Commodity) $account.Currency }}
+{{ $account.PadDate }} pad {{ $name }} Equity:OpenBalance
+{{ range $account.Assertions }}{{ .Date }} balance {{ $name }} {{ amount .Amount $account.Currency }} {{ $account.Currency }}
+{{ end }}{{ end }}
 {{ end }}
 `
 
-//{{ $account := Assets:{{ .Owner }}:{{ Deref .Holding.IsoCurrencyCode.Get }}:{{ .Institution }}:{{ Replace (Deref .Security.Name.Get) }} -}}
-//{{ Deref .Holding.InstitutionPriceAsOf.Get }} *
+const commodityTemplate = `
+{{ range $name, $commodity := . }}2000-01-01 commodity {{ $name }}
+{{ if $commodity.Desc }}    name: "{{ escape $commodity.Desc }}"
+{{ end }}{{ end }}`
 
 const holdingTemplate = `
-2000-01-01 open Assets:{{ .Owner }}:{{ Deref .Holding.IsoCurrencyCode.Get }}:{{ .Institution }}:{{ Replace (Deref .Security.Name.Get) }}
-
-2000-01-01 *
-    Assets:{{ .Owner }}:{{ Deref .Holding.IsoCurrencyCode.Get }}:{{ .Institution }}:{{ Replace (Deref .Security.Name.Get) }} {{ .Holding.InstitutionValue }} {{ Deref .Holding.IsoCurrencyCode.Get }}
+{{ .Date }} * "Opening position"
+    {{ .Account.ToString }} {{ amount .Quantity .Commodity }} {{ .Commodity }}{{ if .HasCost }} {{ printf "{%s %s}" (amount .Cost .Unit) .Unit }}{{ end }}
     Equity:OpenBalance
 `
+
+const priceTemplate = `
+{{ range $key, $price := . }}{{ $price.Date }} price {{ $price.Commodity }} {{ amount $price.Amount $price.Unit }} {{ $price.Unit }}
+{{ end }}`
@@ -0,0 +1,85 @@
+package dump
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func mustLoadTemplates(t *testing.T) templateSet {
+	t.Helper()
+	tpls, err := loadTemplates(types.TemplatesConfig{})
+	if err != nil {
+		t.Fatalf("loadTemplates: %v", err)
+	}
+	return tpls
+}
+
+func writeTemplate(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "custom.tpl")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+	return path
+}
+
+func TestCustomTransactionTemplate(t *testing.T) {
+	path := writeTemplate(t, `
+{{ .Date }} * "{{ .Payee }}" "Plaid: {{ .Desc }}"
+    {{ if .Metadata.id }}plaid_id: "{{ .Metadata.id }}"
+    {{ end }}{{ if .Postings }}{{ range .Postings }}{{ .Account.ToString }}{{ if not .Elided }} {{ amount .Amount .Unit }} {{ .Unit }}{{ end }}
+    {{ end }}{{ else }}{{ .ToAccount.ToString }} {{ amount .Amount .Unit }} {{ .Unit }}
+    {{ .FromAccount.ToString }}{{ end }}
+`)
+
+	var buf bytes.Buffer
+	cfg := types.Config{Dump: types.DumpConfig{Templates: types.TemplatesConfig{Transaction: path}}}
+	if err := dumpTransactions(cfg, newTestOwners(), &buf); err != nil {
+		t.Fatalf("dumpTransactions: %v", err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, `2024-01-03 * "Grocer" "Plaid: Grocer"`+"\n    plaid_id: \"a1\"\n    Expenses:USD:Shops:Groceries 42.10 USD") {
+		t.Errorf("custom template not applied:\n%s", out)
+	}
+	if strings.Contains(out, "payer:") {
+		t.Errorf("custom template should drop payer metadata:\n%s", out)
+	}
+	if !strings.Contains(out, "2000-01-01 open Assets:Alice:USD:Bank:Depository:Checking USD") {
+		t.Errorf("built-in open template should still apply:\n%s", out)
+	}
+}
+
+func TestLoadTemplatesReportsTemplateAndLine(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "parse error", text: "{{ .Date }}\n{{ if .Payee }}\n", want: "transaction:"},
+		{name: "unknown field", text: "{{ .Date }}\n{{ .Narration }}\n", want: "transaction:2:"},
+		{name: "unknown func", text: "{{ .Date | shout }}\n", want: `function "shout" not defined`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTemplate(t, tt.text)
+			_, err := loadTemplates(types.TemplatesConfig{Transaction: path})
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), path) {
+				t.Fatalf("error %q should name %s and %q", err, path, tt.want)
+			}
+		})
+	}
+
+	if _, err := loadTemplates(types.TemplatesConfig{Holding: filepath.Join(t.TempDir(), "missing.tpl")}); err == nil || !strings.Contains(err.Error(), "holding template") {
+		t.Fatalf("expected missing holding template error, got %v", err)
+	}
+}
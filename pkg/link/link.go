@@ -5,24 +5,25 @@ import (
 	"fmt"
 
 	"github.com/plaid/plaid-go/plaid"
-	"github.com/xiaomi388/beancount-automation/pkg/persistence"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/plaidclient"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
 var (
 	getAccessTokenFn = getAccessToken
+	launchLinkFlowFn = launchLinkFlow
 )
 
-func Link(ownerName string, instName string, instType types.InstitutionType) error {
-	config, err := persistence.LoadConfig(persistence.DefaultConfigPath)
+func Link(appCtx *app.Context, ownerName string, instName string, instType types.InstitutionType) error {
+	config, err := appCtx.PlaidConfig()
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return err
 	}
 
-	store, err := persistence.NewStore(config.Storage)
+	store, err := appCtx.OpenStore()
 	if err != nil {
-		return fmt.Errorf("failed to create store: %w", err)
+		return err
 	}
 	defer store.Close()
 
@@ -31,30 +32,14 @@ func Link(ownerName string, instName string, instType types.InstitutionType) err
 		return fmt.Errorf("failed to load owners: %w", err)
 	}
 
-	owner, ok := types.GetOwner(owners, ownerName)
-	if !ok {
-		owner = types.Owner{
-			Name: ownerName,
-		}
-	}
-
-	switch instType {
-	case types.InstitutionTypeTransaction:
-		owner, err = linkTransactionInstitution(owner, instName, config)
-	case types.InstitutionTypeInvestment:
-		owner, err = linkInvestmentInstitution(owner, instName, config)
-	default:
-		panic(fmt.Sprintf("unsupported institution type: %s", instType))
-	}
-
+	owner, _ := types.GetOwner(owners, ownerName)
+	base, err := linkInstitution(owner, instName, instType, config)
 	if err != nil {
 		return fmt.Errorf("failed to link institution: %w", err)
 	}
 
-	owners = types.CreateOrUpdateOwner(owners, owner)
-
-	if err := store.DumpOwners(owners); err != nil {
-		return fmt.Errorf("failed to dump owners: %w", err)
+	if err := store.AddInstitution(ownerName, instType, base); err != nil {
+		return fmt.Errorf("failed to save institution: %w", err)
 	}
 
 	return nil
@@ -81,44 +66,29 @@ func getAccessToken(clientID string, secret string, env string, product *plaid.P
 	return accessToken, nil
 }
 
-func linkTransactionInstitution(owner types.Owner, instName string, config types.Config) (types.Owner, error) {
-	if _, ok := owner.TransactionInstitution(instName); ok {
-		return types.Owner{}, fmt.Errorf("transaction institution %s:%s already existed", owner.Name, instName)
-	}
-
-	accessToken, err := getAccessTokenFn(config.ClientID, config.Secret, config.Environment, instTypeToPlaidProduct(types.InstitutionTypeTransaction))
-	if err != nil {
-		return types.Owner{}, fmt.Errorf("failed to get access token: %w", err)
+func linkInstitution(owner types.Owner, instName string, instType types.InstitutionType, config types.Config) (types.InstitutionBase, error) {
+	existed := false
+	switch instType {
+	case types.InstitutionTypeTransaction:
+		_, existed = owner.TransactionInstitution(instName)
+	case types.InstitutionTypeInvestment:
+		_, existed = owner.InvestmentInstitution(instName)
+	default:
+		panic(fmt.Sprintf("unsupported institution type: %s", instType))
 	}
-
-	owner.TransactionInstitutions = append(owner.TransactionInstitutions, types.TransactionInstitution{
-		InstitutionBase: types.InstitutionBase{
-			Name:        instName,
-			AccessToken: accessToken,
-		},
-	})
-
-	return owner, nil
-}
-
-func linkInvestmentInstitution(owner types.Owner, instName string, config types.Config) (types.Owner, error) {
-	if _, ok := owner.InvestmentInstitution(instName); ok {
-		return types.Owner{}, fmt.Errorf("investment institution %s:%s already existed", owner.Name, instName)
+	if existed {
+		return types.InstitutionBase{}, fmt.Errorf("%s institution %s:%s already existed", instType, owner.Name, instName)
 	}
 
-	accessToken, err := getAccessTokenFn(config.ClientID, config.Secret, config.Environment, instTypeToPlaidProduct(types.InstitutionTypeInvestment))
+	accessToken, err := getAccessTokenFn(config.ClientID, config.Secret, config.Environment, instTypeToPlaidProduct(instType))
 	if err != nil {
-		return types.Owner{}, fmt.Errorf("failed to get access token: %w", err)
+		return types.InstitutionBase{}, fmt.Errorf("failed to get access token: %w", err)
 	}
 
-	owner.InvestmentInstitutions = append(owner.InvestmentInstitutions, types.InvestmentInstitution{
-		InstitutionBase: types.InstitutionBase{
-			Name:        instName,
-			AccessToken: accessToken,
-		},
-	})
-
-	return owner, nil
+	return types.InstitutionBase{
+		Name:        instName,
+		AccessToken: accessToken,
+	}, nil
 }
 
 func instTypeToPlaidProduct(instType types.InstitutionType) *plaid.Products {
@@ -1,12 +1,21 @@
 package link
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
+	"github.com/xiaomi388/beancount-automation/pkg/persistence"
+	"github.com/xiaomi388/beancount-automation/pkg/plaidclient"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
@@ -37,18 +46,13 @@ func TestLinkAddsTransactionInstitutionIntegration(t *testing.T) {
 	copyTestFile(t, filepath.Join(cwd, "testdata", "config.yaml"), filepath.Join(tempDir, "config.yaml"))
 	copyTestFile(t, filepath.Join(cwd, "testdata", "owners.yaml"), filepath.Join(tempDir, "owners.yaml"))
 
-	if err := Link("alice", "chase", types.InstitutionTypeTransaction); err != nil {
+	if err := Link(newLinkTestApp(t), "alice", "chase", types.InstitutionTypeTransaction); err != nil {
 		t.Fatalf("Link returned error: %v", err)
 	}
 
-	ownersData, err := os.ReadFile(filepath.Join(tempDir, "owners.yaml"))
+	owners, err := persistence.LoadOwners(filepath.Join(tempDir, "owners.yaml"))
 	if err != nil {
-		t.Fatalf("failed to read owners: %v", err)
-	}
-
-	var owners []types.Owner
-	if err := json.Unmarshal(ownersData, &owners); err != nil {
-		t.Fatalf("failed to unmarshal owners: %v", err)
+		t.Fatalf("failed to load owners: %v", err)
 	}
 
 	if len(owners) != 1 {
@@ -74,3 +78,110 @@ func copyTestFile(t *testing.T, src, dst string) {
 		t.Fatalf("failed to write %s: %v", dst, err)
 	}
 }
+
+func TestPendingRelinks(t *testing.T) {
+	owners := []types.Owner{
+		{
+			Name: "alice",
+			TransactionInstitutions: []types.TransactionInstitution{
+				{InstitutionBase: types.InstitutionBase{Name: "chase", NeedsUpdate: true}},
+				{InstitutionBase: types.InstitutionBase{Name: "amex"}},
+			},
+			InvestmentInstitutions: []types.InvestmentInstitution{
+				{InstitutionBase: types.InstitutionBase{Name: "vanguard", NeedsUpdate: true}},
+			},
+		},
+	}
+
+	got := PendingRelinks(owners)
+	want := []PendingRelink{
+		{Owner: "alice", Institution: "chase", Type: types.InstitutionTypeTransaction},
+		{Owner: "alice", Institution: "vanguard", Type: types.InstitutionTypeInvestment},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("PendingRelinks() = %+v, want %+v", got, want)
+	}
+}
+
+// newLinkTestApp loads the app context for the config.yaml in the working
+// directory, the way the root command does.
+func TestRelinkPendingResolvesSecretsOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"link_token": "link-token", "expiration": "2024-01-01T00:00:00Z", "request_id": "r"}`)
+	}))
+	defer server.Close()
+
+	origEnv, ok := plaidclient.Environment("Sandbox")
+	plaidclient.SetEnvironment("Sandbox", plaid.Environment(server.URL))
+	origLaunch := launchLinkFlowFn
+	var relinked int
+	launchLinkFlowFn = func(ctx context.Context, linkToken string) (string, error) {
+		relinked++
+		return "", nil
+	}
+	t.Cleanup(func() {
+		if ok {
+			plaidclient.SetEnvironment("Sandbox", origEnv)
+		}
+		launchLinkFlowFn = origLaunch
+	})
+
+	tempDir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get wd: %v", err)
+	}
+	if err := os.Chdir(tempDir); err != nil {
+		t.Fatalf("failed to chdir: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(cwd)
+	})
+
+	// The secret command logs every run, as a password manager prompt would
+	// show up once per run.
+	runs := filepath.Join(tempDir, "runs")
+	config := fmt.Sprintf("clientID: test-client-id\nsecret: \"cmd:echo run >> %s; echo test-secret\"\nenvironment: Sandbox\n", runs)
+	if err := os.WriteFile(filepath.Join(tempDir, "config.yaml"), []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	owners := []types.Owner{{
+		Name: "alice",
+		TransactionInstitutions: []types.TransactionInstitution{
+			{InstitutionBase: types.InstitutionBase{Name: "bank-a", AccessToken: "token-a", NeedsUpdate: true}},
+			{InstitutionBase: types.InstitutionBase{Name: "bank-b", AccessToken: "token-b", NeedsUpdate: true}},
+		},
+	}}
+	data, err := json.Marshal(owners)
+	if err != nil {
+		t.Fatalf("failed to marshal owners: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "owners.yaml"), data, 0644); err != nil {
+		t.Fatalf("failed to write owners: %v", err)
+	}
+
+	if err := RelinkPending(newLinkTestApp(t)); err != nil {
+		t.Fatalf("RelinkPending returned error: %v", err)
+	}
+
+	if relinked != 2 {
+		t.Fatalf("expected 2 institutions relinked, got %d", relinked)
+	}
+	log, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatalf("failed to read secret command log: %v", err)
+	}
+	if n := strings.Count(string(log), "run"); n != 1 {
+		t.Fatalf("expected the secret command to run once, ran %d times", n)
+	}
+}
+
+func newLinkTestApp(t *testing.T) *app.Context {
+	t.Helper()
+	appCtx, err := app.Load(app.Options{ConfigPath: "config.yaml"})
+	if err != nil {
+		t.Fatalf("failed to load app context: %v", err)
+	}
+	return appCtx
+}
@@ -4,20 +4,25 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/xiaomi388/beancount-automation/pkg/persistence"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/plaidclient"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
-func Relink(ownerName string, instName string, instType types.InstitutionType) error {
-	config, err := persistence.LoadConfig(persistence.DefaultConfigPath)
+func Relink(appCtx *app.Context, ownerName string, instName string, instType types.InstitutionType) error {
+	config, err := appCtx.PlaidConfig()
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return err
 	}
+	return relink(appCtx, config, ownerName, instName, instType)
+}
 
-	store, err := persistence.NewStore(config.Storage)
+// relink runs Plaid Link update mode for one institution with the already
+// resolved config.
+func relink(appCtx *app.Context, config types.Config, ownerName string, instName string, instType types.InstitutionType) error {
+	store, err := appCtx.OpenStore()
 	if err != nil {
-		return fmt.Errorf("failed to create store: %w", err)
+		return err
 	}
 	defer store.Close()
 
@@ -31,20 +36,20 @@ func Relink(ownerName string, instName string, instType types.InstitutionType) e
 		return fmt.Errorf("owner %s not existed", ownerName)
 	}
 
-	var accessToken string
+	var base types.InstitutionBase
 	switch instType {
 	case types.InstitutionTypeTransaction:
 		inst, ok := owner.TransactionInstitution(instName)
 		if !ok {
 			return fmt.Errorf("inst %s not existed", instName)
 		}
-		accessToken = inst.InstitutionBase.AccessToken
+		base = inst.InstitutionBase
 	case types.InstitutionTypeInvestment:
 		inst, ok := owner.InvestmentInstitution(instName)
 		if !ok {
 			return fmt.Errorf("inst %s not existed", instName)
 		}
-		accessToken = inst.InstitutionBase.AccessToken
+		base = inst.InstitutionBase
 	default:
 		panic(fmt.Sprintf("unsupported institution type: %s", instType))
 	}
@@ -52,14 +57,81 @@ func Relink(ownerName string, instName string, instType types.InstitutionType) e
 	ctx := context.Background()
 
 	c := plaidclient.New(config.ClientID, config.Secret, config.Environment)
-	linkToken, err := createLinkToken(ctx, c, nil, &accessToken)
+	linkToken, err := createLinkToken(ctx, c, nil, &base.AccessToken)
 	if err != nil {
 		return fmt.Errorf("failed to create link token: %w", err)
 	}
 
-	if _, err := launchLinkFlow(ctx, linkToken); err != nil {
+	if _, err := launchLinkFlowFn(ctx, linkToken); err != nil {
 		return fmt.Errorf("failed to launch link flow: %w", err)
 	}
 
+	base.NeedsUpdate = false
+	if err := store.UpdateInstitutionBase(ownerName, instType, base); err != nil {
+		return fmt.Errorf("failed to save institution: %w", err)
+	}
+
+	return nil
+}
+
+// PendingRelink identifies an institution flagged by sync as needing
+// Plaid Link update mode.
+type PendingRelink struct {
+	Owner       string
+	Institution string
+	Type        types.InstitutionType
+}
+
+// PendingRelinks lists every institution flagged as needing update mode.
+func PendingRelinks(owners []types.Owner) []PendingRelink {
+	var pending []PendingRelink
+	for _, owner := range owners {
+		for _, inst := range owner.TransactionInstitutions {
+			if inst.InstitutionBase.NeedsUpdate {
+				pending = append(pending, PendingRelink{owner.Name, inst.InstitutionBase.Name, types.InstitutionTypeTransaction})
+			}
+		}
+		for _, inst := range owner.InvestmentInstitutions {
+			if inst.InstitutionBase.NeedsUpdate {
+				pending = append(pending, PendingRelink{owner.Name, inst.InstitutionBase.Name, types.InstitutionTypeInvestment})
+			}
+		}
+	}
+
+	return pending
+}
+
+// RelinkPending walks every flagged institution through Relink in turn,
+// resolving the Plaid credentials once for all of them.
+func RelinkPending(appCtx *app.Context) error {
+	store, err := appCtx.OpenStore()
+	if err != nil {
+		return err
+	}
+
+	owners, err := store.LoadOwners()
+	store.Close()
+	if err != nil {
+		return fmt.Errorf("failed to load owners: %w", err)
+	}
+
+	pending := PendingRelinks(owners)
+	if len(pending) == 0 {
+		fmt.Println("No institutions need relinking.")
+		return nil
+	}
+
+	config, err := appCtx.PlaidConfig()
+	if err != nil {
+		return err
+	}
+
+	for i, p := range pending {
+		fmt.Printf("[%d/%d] relinking %s:%s (%s)\n", i+1, len(pending), p.Owner, p.Institution, p.Type)
+		if err := relink(appCtx, config, p.Owner, p.Institution, p.Type); err != nil {
+			return fmt.Errorf("failed to relink %s:%s: %w", p.Owner, p.Institution, err)
+		}
+	}
+
 	return nil
 }
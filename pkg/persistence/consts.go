@@ -1,9 +1,15 @@
 package persistence
 
-// DefaultPath is the default path for storing the persistence json owner data
+// Default file names of the owner data, used when storage.path is unset.
 const (
-	DefaultOwnerPath     = "./owners.yaml"
-	DefaultSQLitePath    = "./owners.db"
-	DefaultConfigPath    = "./config.yaml"
-	DefaultBeancountPath = "./plaid_gen.beancount"
+	DefaultOwnerFile  = "owners.yaml"
+	DefaultSQLiteFile = "owners.db"
 )
+
+// DefaultStoreFile returns the default owner data file name for backend.
+func DefaultStoreFile(backend string) string {
+	if backend == "sqlite" {
+		return DefaultSQLiteFile
+	}
+	return DefaultOwnerFile
+}
@@ -0,0 +1,235 @@
+package persistence
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+const (
+	// sealedTokenPrefix marks an access token sealed by TokenSealer. The
+	// rest is salt:wrappedKey:ciphertext, each base64 encoded; salt is
+	// empty unless the key encryption key comes from a passphrase.
+	sealedTokenPrefix = "enc:v1:"
+
+	keySize          = 32
+	saltSize         = 16
+	pbkdf2Iterations = 600000
+)
+
+// TokenSealer envelope-encrypts access tokens: every token gets a fresh data
+// key, and the data key is stored wrapped by the configured key.
+type TokenSealer struct {
+	key        []byte
+	passphrase string
+	salt       []byte
+	derived    map[string][]byte
+	// opened remembers the sealed form of every token opened, so writing
+	// an unchanged token back does not churn its ciphertext.
+	opened map[string]string
+}
+
+// NewTokenSealer resolves the key configured in cfg. It returns nil when no
+// key source is configured.
+func NewTokenSealer(cfg types.EncryptionConfig) (*TokenSealer, error) {
+	sources := 0
+	for _, s := range []string{cfg.KeyFile, cfg.KeyEnv, cfg.PassphraseEnv} {
+		if s != "" {
+			sources++
+		}
+	}
+	switch {
+	case sources == 0:
+		return nil, nil
+	case sources > 1:
+		return nil, fmt.Errorf("only one of keyFile, keyEnv and passphraseEnv may be set")
+	}
+
+	switch {
+	case cfg.KeyFile != "":
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token key file: %w", err)
+		}
+		key, err := decodeKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid token key in %s: %w", cfg.KeyFile, err)
+		}
+		return &TokenSealer{key: key, opened: map[string]string{}}, nil
+	case cfg.KeyEnv != "":
+		value, ok := os.LookupEnv(cfg.KeyEnv)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("token key environment variable %s is not set", cfg.KeyEnv)
+		}
+		key, err := decodeKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token key in %s: %w", cfg.KeyEnv, err)
+		}
+		return &TokenSealer{key: key, opened: map[string]string{}}, nil
+	default:
+		passphrase, ok := os.LookupEnv(cfg.PassphraseEnv)
+		if !ok || passphrase == "" {
+			return nil, fmt.Errorf("token passphrase environment variable %s is not set", cfg.PassphraseEnv)
+		}
+		return &TokenSealer{passphrase: passphrase, derived: map[string][]byte{}, opened: map[string]string{}}, nil
+	}
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", keySize, len(key))
+	}
+	return key, nil
+}
+
+// IsSealedToken reports whether token was written by a TokenSealer.
+func IsSealedToken(token string) bool {
+	return strings.HasPrefix(token, sealedTokenPrefix)
+}
+
+// Seal encrypts token. Empty and already sealed tokens are returned as is.
+func (s *TokenSealer) Seal(token string) (string, error) {
+	if token == "" || IsSealedToken(token) {
+		return token, nil
+	}
+	if sealed, ok := s.opened[token]; ok {
+		return sealed, nil
+	}
+
+	var salt []byte
+	if s.passphrase != "" {
+		// One salt per process keeps the KDF cost to a single derivation.
+		if s.salt == nil {
+			s.salt = make([]byte, saltSize)
+			if _, err := rand.Read(s.salt); err != nil {
+				return "", fmt.Errorf("failed to generate salt: %w", err)
+			}
+		}
+		salt = s.salt
+	}
+	kek, err := s.keyEncryptionKey(salt)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := sealBytes(kek, dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealBytes(dataKey, []byte(token))
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.StdEncoding
+	return sealedTokenPrefix + enc.EncodeToString(salt) + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(ciphertext), nil
+}
+
+// Open decrypts a token sealed by Seal. Plaintext tokens are returned as is,
+// so stores written before encryption was enabled keep loading.
+func (s *TokenSealer) Open(token string) (string, error) {
+	if !IsSealedToken(token) {
+		return token, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, sealedTokenPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed sealed token")
+	}
+	var fields [3][]byte
+	for i, part := range parts {
+		b, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return "", fmt.Errorf("malformed sealed token: %w", err)
+		}
+		fields[i] = b
+	}
+
+	kek, err := s.keyEncryptionKey(fields[0])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := openBytes(kek, fields[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key, is the token key correct?: %w", err)
+	}
+	plaintext, err := openBytes(dataKey, fields[2])
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt token: %w", err)
+	}
+
+	s.opened[string(plaintext)] = token
+	return string(plaintext), nil
+}
+
+func (s *TokenSealer) keyEncryptionKey(salt []byte) ([]byte, error) {
+	if s.passphrase == "" {
+		if len(salt) != 0 {
+			return nil, fmt.Errorf("token was sealed with a passphrase but a key is configured")
+		}
+		return s.key, nil
+	}
+	if len(salt) == 0 {
+		return nil, fmt.Errorf("token was sealed with a key but a passphrase is configured")
+	}
+
+	if key, ok := s.derived[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, s.passphrase, salt, pbkdf2Iterations, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive token key: %w", err)
+	}
+	s.derived[string(salt)] = key
+	return key, nil
+}
+
+func sealBytes(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openBytes(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
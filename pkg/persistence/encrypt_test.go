@@ -0,0 +1,137 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func newTestKeyEnv(t *testing.T) types.EncryptionConfig {
+	t.Helper()
+	t.Setenv("TEST_TOKEN_KEY", base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", keySize))))
+	return types.EncryptionConfig{KeyEnv: "TEST_TOKEN_KEY"}
+}
+
+func TestTokenSealerRoundTrip(t *testing.T) {
+	t.Setenv("TEST_TOKEN_PASSPHRASE", "correct horse battery staple")
+	keyFile := filepath.Join(t.TempDir(), "token.key")
+	if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(make([]byte, keySize))+"\n"), 0600); err != nil {
+		t.Fatalf("write key file: %v", err)
+	}
+
+	for name, cfg := range map[string]types.EncryptionConfig{
+		"keyEnv":        newTestKeyEnv(t),
+		"keyFile":       {KeyFile: keyFile},
+		"passphraseEnv": {PassphraseEnv: "TEST_TOKEN_PASSPHRASE"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sealer, err := NewTokenSealer(cfg)
+			if err != nil {
+				t.Fatalf("NewTokenSealer: %v", err)
+			}
+
+			sealed, err := sealer.Seal("access-sandbox-123")
+			if err != nil {
+				t.Fatalf("Seal: %v", err)
+			}
+			if !IsSealedToken(sealed) || strings.Contains(sealed, "access-sandbox-123") {
+				t.Fatalf("expected sealed token, got %q", sealed)
+			}
+
+			opened, err := sealer.Open(sealed)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if opened != "access-sandbox-123" {
+				t.Errorf("expected round trip, got %q", opened)
+			}
+		})
+	}
+}
+
+func TestTokenSealerWrongKey(t *testing.T) {
+	sealer, err := NewTokenSealer(newTestKeyEnv(t))
+	if err != nil {
+		t.Fatalf("NewTokenSealer: %v", err)
+	}
+	sealed, err := sealer.Seal("access-sandbox-123")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	t.Setenv("TEST_TOKEN_KEY", base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", keySize))))
+	other, err := NewTokenSealer(types.EncryptionConfig{KeyEnv: "TEST_TOKEN_KEY"})
+	if err != nil {
+		t.Fatalf("NewTokenSealer: %v", err)
+	}
+	if _, err := other.Open(sealed); err == nil {
+		t.Errorf("expected error opening with the wrong key")
+	}
+}
+
+func TestNewTokenSealerMissingKey(t *testing.T) {
+	if _, err := NewTokenSealer(types.EncryptionConfig{KeyEnv: "TEST_TOKEN_KEY_UNSET"}); err == nil {
+		t.Errorf("expected error for unset key variable")
+	}
+	if sealer, err := NewTokenSealer(types.EncryptionConfig{}); sealer != nil || err != nil {
+		t.Errorf("expected no sealer without configuration, got %v, %v", sealer, err)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners.yaml")
+	cfg := types.StorageConfig{Backend: "json", Path: path, Encryption: newTestKeyEnv(t)}
+
+	store, err := NewStore(cfg)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if err := store.DumpOwners(newTestOwners()); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read owners: %v", err)
+	}
+	if strings.Contains(string(data), "tok-a") || strings.Contains(string(data), "tok-inv-a") {
+		t.Errorf("expected no plaintext tokens on disk, got %s", data)
+	}
+
+	loaded, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	if token := loaded[0].TransactionInstitutions[0].InstitutionBase.AccessToken; token != "tok-a" {
+		t.Errorf("expected decrypted token tok-a, got %q", token)
+	}
+
+	// Writing unchanged tokens back keeps their ciphertext.
+	raw := NewJSONStore(path)
+	before, err := raw.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners (raw): %v", err)
+	}
+	if err := store.DumpOwners(loaded); err != nil {
+		t.Fatalf("DumpOwners (second): %v", err)
+	}
+	after, err := raw.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners (raw): %v", err)
+	}
+	if b, a := before[0].TransactionInstitutions[0].InstitutionBase.AccessToken, after[0].TransactionInstitutions[0].InstitutionBase.AccessToken; b != a {
+		t.Errorf("expected sealed token unchanged, got %q then %q", b, a)
+	}
+
+	plain, err := NewStore(types.StorageConfig{Backend: "json", Path: path})
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	if _, err := plain.LoadOwners(); err == nil || !strings.Contains(err.Error(), "no key is configured") {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
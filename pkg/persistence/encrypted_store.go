@@ -0,0 +1,128 @@
+package persistence
+
+import (
+	"fmt"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// encryptedStore seals access tokens on their way into a Store and opens
+// them on the way out; every other field passes through unchanged.
+type encryptedStore struct {
+	Store
+	sealer *TokenSealer
+}
+
+func (s *encryptedStore) LoadOwners() ([]types.Owner, error) {
+	owners, err := s.Store.LoadOwners()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mapAccessTokens(owners, s.sealer.Open); err != nil {
+		return nil, fmt.Errorf("failed to decrypt access tokens: %w", err)
+	}
+	return owners, nil
+}
+
+func (s *encryptedStore) DumpOwners(owners []types.Owner) error {
+	sealed := copyOwnerInstitutions(owners)
+	if err := mapAccessTokens(sealed, s.sealer.Seal); err != nil {
+		return fmt.Errorf("failed to encrypt access tokens: %w", err)
+	}
+	return s.Store.DumpOwners(sealed)
+}
+
+func (s *encryptedStore) AddInstitution(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error {
+	token, err := s.sealer.Seal(base.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt access token: %w", err)
+	}
+	base.AccessToken = token
+	return s.Store.AddInstitution(ownerName, instType, base)
+}
+
+func (s *encryptedStore) SaveInvestmentInstitution(ownerName string, inst types.InvestmentInstitution) error {
+	token, err := s.sealer.Seal(inst.InstitutionBase.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt access token: %w", err)
+	}
+	inst.InstitutionBase.AccessToken = token
+	return s.Store.SaveInvestmentInstitution(ownerName, inst)
+}
+
+func (s *encryptedStore) UpdateInstitutionBase(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error {
+	token, err := s.sealer.Seal(base.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt access token: %w", err)
+	}
+	base.AccessToken = token
+	return s.Store.UpdateInstitutionBase(ownerName, instType, base)
+}
+
+// plaintextStore refuses to load sealed tokens, so a missing key fails on
+// load instead of sending ciphertext to Plaid.
+type plaintextStore struct {
+	Store
+}
+
+func (s *plaintextStore) LoadOwners() ([]types.Owner, error) {
+	owners, err := s.Store.LoadOwners()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPlaintextTokens(owners); err != nil {
+		return nil, err
+	}
+	return owners, nil
+}
+
+func checkPlaintextTokens(owners []types.Owner) error {
+	return mapAccessTokensOf(owners, func(ownerName string, base *types.InstitutionBase) error {
+		if IsSealedToken(base.AccessToken) {
+			return fmt.Errorf("access token of %s:%s is encrypted but no key is configured under storage.encryption", ownerName, base.Name)
+		}
+		return nil
+	})
+}
+
+// copyOwnerInstitutions copies owners deeply enough that institution bases
+// can be rewritten without touching the caller's slices.
+func copyOwnerInstitutions(owners []types.Owner) []types.Owner {
+	copied := make([]types.Owner, len(owners))
+	for i, owner := range owners {
+		owner.TransactionInstitutions = append([]types.TransactionInstitution(nil), owner.TransactionInstitutions...)
+		owner.InvestmentInstitutions = append([]types.InvestmentInstitution(nil), owner.InvestmentInstitutions...)
+		copied[i] = owner
+	}
+	return copied
+}
+
+func mapAccessTokens(owners []types.Owner, fn func(string) (string, error)) error {
+	return mapAccessTokensOf(owners, func(ownerName string, base *types.InstitutionBase) error {
+		token, err := fn(base.AccessToken)
+		if err != nil {
+			return fmt.Errorf("%s:%s: %w", ownerName, base.Name, err)
+		}
+		base.AccessToken = token
+		return nil
+	})
+}
+
+func mapAccessTokensOf(owners []types.Owner, fn func(ownerName string, base *types.InstitutionBase) error) error {
+	for i := range owners {
+		owner := &owners[i]
+		for j := range owner.TransactionInstitutions {
+			if err := fn(owner.Name, &owner.TransactionInstitutions[j].InstitutionBase); err != nil {
+				return err
+			}
+		}
+		for j := range owner.InvestmentInstitutions {
+			if err := fn(owner.Name, &owner.InvestmentInstitutions[j].InstitutionBase); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package persistence
 
-import "github.com/xiaomi388/beancount-automation/pkg/types"
+import (
+	"fmt"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
 
 // JSONStore implements Store using a JSON file (the original owners.yaml format).
 type JSONStore struct {
@@ -12,13 +16,104 @@ func NewJSONStore(path string) *JSONStore {
 }
 
 func (s *JSONStore) LoadOwners() ([]types.Owner, error) {
-	return LoadOwners(s.path)
+	owners, version, err := loadOwnersFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files from before the version was recorded are repaired once and
+	// written back with it, so later loads leave the accounts as stored.
+	if version < ownersFileVersion {
+		RepairInvestmentAccounts(owners)
+		if err := DumpOwners(s.path, owners); err != nil {
+			return nil, fmt.Errorf("failed to upgrade owners file: %w", err)
+		}
+	}
+	return owners, nil
 }
 
 func (s *JSONStore) DumpOwners(owners []types.Owner) error {
 	return DumpOwners(s.path, owners)
 }
 
+// updateOwner applies fn to one owner and rewrites the whole file;
+// DumpOwners replaces it atomically, so an interrupted write never loses
+// earlier changes. Every write therefore costs the size of the file, which
+// during sync means once per /transactions/sync page; the sqlite backend
+// writes only the rows that changed.
+func (s *JSONStore) updateOwner(ownerName string, create bool, fn func(types.Owner) (types.Owner, error)) error {
+	owners, err := s.LoadOwners()
+	if err != nil {
+		return err
+	}
+
+	owner, ok := types.GetOwner(owners, ownerName)
+	if !ok {
+		if !create {
+			return fmt.Errorf("owner %s not existed", ownerName)
+		}
+		owner = types.Owner{Name: ownerName}
+	}
+
+	owner, err = fn(owner)
+	if err != nil {
+		return err
+	}
+	return s.DumpOwners(types.CreateOrUpdateOwner(owners, owner))
+}
+
+func (s *JSONStore) AddInstitution(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error {
+	return s.updateOwner(ownerName, true, func(owner types.Owner) (types.Owner, error) {
+		switch instType {
+		case types.InstitutionTypeTransaction:
+			if _, ok := owner.TransactionInstitution(base.Name); !ok {
+				return owner.CreateOrUpdateTransactionInstitution(types.TransactionInstitution{InstitutionBase: base}), nil
+			}
+		case types.InstitutionTypeInvestment:
+			if _, ok := owner.InvestmentInstitution(base.Name); !ok {
+				return owner.CreateOrUpdateInvestmentInstitution(types.InvestmentInstitution{InstitutionBase: base}), nil
+			}
+		default:
+			return owner, fmt.Errorf("unsupported institution type: %s", instType)
+		}
+		return owner, fmt.Errorf("%s institution %s:%s already existed", instType, ownerName, base.Name)
+	})
+}
+
+func (s *JSONStore) ApplyTransactionSyncPage(ownerName, instName string, page types.TransactionSyncPage) error {
+	return s.updateOwner(ownerName, false, func(owner types.Owner) (types.Owner, error) {
+		inst, ok := owner.TransactionInstitution(instName)
+		if !ok {
+			return owner, fmt.Errorf("transaction institution %s:%s not existed", ownerName, instName)
+		}
+		return owner.CreateOrUpdateTransactionInstitution(inst.ApplyTransactionSyncPage(page)), nil
+	})
+}
+
+func (s *JSONStore) SaveInvestmentInstitution(ownerName string, inst types.InvestmentInstitution) error {
+	return s.updateOwner(ownerName, true, func(owner types.Owner) (types.Owner, error) {
+		return owner.CreateOrUpdateInvestmentInstitution(inst), nil
+	})
+}
+
+func (s *JSONStore) UpdateInstitutionBase(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error {
+	return s.updateOwner(ownerName, false, func(owner types.Owner) (types.Owner, error) {
+		switch instType {
+		case types.InstitutionTypeTransaction:
+			if inst, ok := owner.TransactionInstitution(base.Name); ok {
+				inst.InstitutionBase = base
+				return owner.CreateOrUpdateTransactionInstitution(inst), nil
+			}
+		case types.InstitutionTypeInvestment:
+			if inst, ok := owner.InvestmentInstitution(base.Name); ok {
+				inst.InstitutionBase = base
+				return owner.CreateOrUpdateInvestmentInstitution(inst), nil
+			}
+		}
+		return owner, fmt.Errorf("%s institution %s:%s not existed", instType, ownerName, base.Name)
+	})
+}
+
 func (s *JSONStore) Close() error {
 	return nil
 }
@@ -0,0 +1,80 @@
+package persistence
+
+import (
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/sirupsen/logrus"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// RepairInvestmentAccounts undoes the layout written by older syncs, which
+// copied every investment transaction and security of an institution into
+// each of its accounts. Transactions are moved to the account they posted
+// against and securities are narrowed to the ones an account references.
+// Owners are repaired in place; the number of misplaced transactions
+// removed is returned.
+func RepairInvestmentAccounts(owners []types.Owner) int {
+	removed := 0
+	for _, owner := range owners {
+		for _, inst := range owner.InvestmentInstitutions {
+			removed += repairInvestmentInstitution(inst)
+		}
+	}
+
+	return removed
+}
+
+func repairInvestmentInstitution(inst types.InvestmentInstitution) int {
+	accountIdx := map[string]int{}
+	for i, account := range inst.InvestmentAccounts {
+		accountIdx[account.AccoutBase.AccountId] = i
+	}
+
+	securities := map[string]plaid.Security{}
+	transactions := make([]map[string]plaid.InvestmentTransaction, len(inst.InvestmentAccounts))
+	for i := range transactions {
+		transactions[i] = map[string]plaid.InvestmentTransaction{}
+	}
+
+	total := 0
+	for i, account := range inst.InvestmentAccounts {
+		for id, s := range account.Securities {
+			securities[id] = s
+		}
+		for id, txn := range account.Transactions {
+			total++
+			target, ok := accountIdx[txn.AccountId]
+			if !ok {
+				// Keep transactions of accounts Plaid no longer reports
+				// where they are.
+				target = i
+			}
+			transactions[target][id] = txn
+		}
+	}
+
+	kept := 0
+	for i := range inst.InvestmentAccounts {
+		account := &inst.InvestmentAccounts[i]
+		account.Transactions = transactions[i]
+		kept += len(account.Transactions)
+
+		referenced := map[string]plaid.Security{}
+		for _, h := range account.Holdings {
+			if s, ok := securities[h.SecurityId]; ok {
+				referenced[h.SecurityId] = s
+			}
+		}
+		for _, txn := range account.Transactions {
+			if s, ok := securities[txn.GetSecurityId()]; ok {
+				referenced[s.SecurityId] = s
+			}
+		}
+		account.Securities = referenced
+	}
+
+	if removed := total - kept; removed > 0 {
+		logrus.Infof("repaired %d duplicated investment transactions in %s", removed, inst.InstitutionBase.Name)
+		return removed
+	}
+	return 0
+}
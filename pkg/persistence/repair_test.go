@@ -0,0 +1,147 @@
+package persistence
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func newDuplicatedInvestmentOwners() []types.Owner {
+	transactions := map[string]plaid.InvestmentTransaction{
+		"ira-txn": {
+			InvestmentTransactionId: "ira-txn",
+			AccountId:               "ira",
+			SecurityId:              *plaid.NewNullableString(strPtr("sec-ira")),
+		},
+		"taxable-txn": {
+			InvestmentTransactionId: "taxable-txn",
+			AccountId:               "taxable",
+			SecurityId:              *plaid.NewNullableString(strPtr("sec-taxable")),
+		},
+	}
+	securities := map[string]plaid.Security{
+		"sec-ira":     {SecurityId: "sec-ira"},
+		"sec-taxable": {SecurityId: "sec-taxable"},
+	}
+
+	return []types.Owner{
+		{
+			Name: "alice",
+			InvestmentInstitutions: []types.InvestmentInstitution{
+				{
+					InstitutionBase: types.InstitutionBase{Name: "broker"},
+					InvestmentAccounts: []types.InvestmentAccount{
+						{
+							AccoutBase:   plaid.AccountBase{AccountId: "ira", Type: plaid.ACCOUNTTYPE_INVESTMENT},
+							Holdings:     []plaid.Holding{},
+							Securities:   securities,
+							Transactions: transactions,
+						},
+						{
+							AccoutBase:   plaid.AccountBase{AccountId: "taxable", Type: plaid.ACCOUNTTYPE_INVESTMENT},
+							Holdings:     []plaid.Holding{},
+							Securities:   securities,
+							Transactions: transactions,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func assertRepaired(t *testing.T, owners []types.Owner) {
+	t.Helper()
+	inst := owners[0].InvestmentInstitutions[0]
+	for _, id := range []string{"ira", "taxable"} {
+		account, ok := inst.InvestmentAccount(id)
+		if !ok {
+			t.Fatalf("expected account %s", id)
+		}
+		if len(account.Transactions) != 1 || account.Transactions[id+"-txn"].AccountId != id {
+			t.Errorf("account %s: expected only %s-txn, got %v", id, id, account.Transactions)
+		}
+		if len(account.Securities) != 1 {
+			t.Errorf("account %s: expected only sec-%s, got %v", id, id, account.Securities)
+		}
+		if _, ok := account.Securities["sec-"+id]; !ok {
+			t.Errorf("account %s: missing sec-%s", id, id)
+		}
+	}
+}
+
+func TestRepairInvestmentAccounts(t *testing.T) {
+	owners := newDuplicatedInvestmentOwners()
+
+	if removed := RepairInvestmentAccounts(owners); removed != 2 {
+		t.Errorf("expected 2 duplicates removed, got %d", removed)
+	}
+	assertRepaired(t, owners)
+
+	if removed := RepairInvestmentAccounts(owners); removed != 0 {
+		t.Errorf("expected repair to be idempotent, removed %d", removed)
+	}
+}
+
+func TestJSONStoreRepairsOnLoad(t *testing.T) {
+	// Files from before the version was recorded hold a bare list.
+	path := filepath.Join(t.TempDir(), "owners.yaml")
+	data, err := json.Marshal(newDuplicatedInvestmentOwners())
+	if err != nil {
+		t.Fatalf("failed to marshal owners: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write owners: %v", err)
+	}
+
+	loaded, err := NewJSONStore(path).LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	assertRepaired(t, loaded)
+
+	if _, version, err := loadOwnersFile(path); err != nil || version != ownersFileVersion {
+		t.Fatalf("expected the repaired file at version %d, got %d (%v)", ownersFileVersion, version, err)
+	}
+	assertRepaired(t, mustLoadOwners(t, path))
+}
+
+func TestJSONStoreRepairsOnlyUnversionedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners.yaml")
+	if err := DumpOwners(path, newDuplicatedInvestmentOwners()); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+
+	loaded, err := NewJSONStore(path).LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	account, _ := loaded[0].InvestmentInstitutions[0].InvestmentAccount("ira")
+	if len(account.Transactions) != 2 {
+		t.Fatalf("expected a versioned file to load as stored, got %v", account.Transactions)
+	}
+}
+
+func TestLoadOwnersRejectsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "owners.yaml")
+	if err := os.WriteFile(path, []byte(`{"version": 99, "owners": []}`), 0644); err != nil {
+		t.Fatalf("failed to write owners: %v", err)
+	}
+	if _, err := NewJSONStore(path).LoadOwners(); err == nil || !strings.Contains(err.Error(), "upgrade bean-auto") {
+		t.Fatalf("expected a newer version to be refused, got %v", err)
+	}
+}
+
+func mustLoadOwners(t *testing.T, path string) []types.Owner {
+	t.Helper()
+	owners, err := LoadOwners(path)
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	return owners
+}
@@ -0,0 +1,98 @@
+package persistence
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// SecretResolver returns the secret a reference points at. The reference is
+// what follows the "<scheme>:" prefix in config.yaml.
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretResolvers maps reference schemes to their resolvers. A config value
+// without a registered scheme is used literally.
+var SecretResolvers = map[string]SecretResolver{
+	"env":  envSecretResolver{},
+	"file": fileSecretResolver{},
+	"cmd":  cmdSecretResolver{},
+}
+
+// ResolveSecret resolves value if it is a secret reference such as
+// "env:PLAID_SECRET", "file:/run/secrets/plaid" or "cmd:pass show plaid".
+func ResolveSecret(value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return value, nil
+	}
+	resolver, ok := SecretResolvers[scheme]
+	if !ok {
+		return value, nil
+	}
+
+	secret, err := resolver.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s secret reference: %w", scheme, err)
+	}
+	return secret, nil
+}
+
+// ResolveConfigSecrets returns cfg with its Plaid credentials resolved.
+// Only commands that talk to Plaid need to call it.
+func ResolveConfigSecrets(cfg types.Config) (types.Config, error) {
+	clientID, err := ResolveSecret(cfg.ClientID)
+	if err != nil {
+		return cfg, fmt.Errorf("clientID: %w", err)
+	}
+	secret, err := ResolveSecret(cfg.Secret)
+	if err != nil {
+		return cfg, fmt.Errorf("secret: %w", err)
+	}
+
+	cfg.ClientID = clientID
+	cfg.Secret = secret
+	return cfg, nil
+}
+
+type envSecretResolver struct{}
+
+func (envSecretResolver) Resolve(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+type fileSecretResolver struct{}
+
+func (fileSecretResolver) Resolve(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// cmdSecretResolver runs the reference through the shell and uses its
+// standard output. Stdin and stderr stay attached so password managers can
+// prompt.
+type cmdSecretResolver struct{}
+
+func (cmdSecretResolver) Resolve(command string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to run %q: %w", command, err)
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
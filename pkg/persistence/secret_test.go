@@ -0,0 +1,51 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("TEST_PLAID_SECRET", "from-env")
+	secretFile := filepath.Join(t.TempDir(), "plaid")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("write secret file: %v", err)
+	}
+
+	for value, want := range map[string]string{
+		"plain-secret":           "plain-secret",
+		"env:TEST_PLAID_SECRET":  "from-env",
+		"file:" + secretFile:     "from-file",
+		"cmd:echo from-cmd":      "from-cmd",
+		"unknown:scheme-is-kept": "unknown:scheme-is-kept",
+	} {
+		got, err := ResolveSecret(value)
+		if err != nil {
+			t.Errorf("ResolveSecret(%q): %v", value, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ResolveSecret(%q) = %q, want %q", value, got, want)
+		}
+	}
+
+	for _, value := range []string{"env:TEST_PLAID_SECRET_UNSET", "file:/nonexistent/plaid", "cmd:exit 1"} {
+		if _, err := ResolveSecret(value); err == nil {
+			t.Errorf("ResolveSecret(%q): expected error", value)
+		}
+	}
+}
+
+func TestResolveConfigSecrets(t *testing.T) {
+	t.Setenv("TEST_PLAID_CLIENT_ID", "client")
+	cfg, err := ResolveConfigSecrets(types.Config{ClientID: "env:TEST_PLAID_CLIENT_ID", Secret: "cmd:printf secret"})
+	if err != nil {
+		t.Fatalf("ResolveConfigSecrets: %v", err)
+	}
+	if cfg.ClientID != "client" || cfg.Secret != "secret" {
+		t.Errorf("unexpected resolved config %+v", cfg)
+	}
+}
@@ -0,0 +1,280 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// initialSchema is the layout of the first released owners.db. Later
+// changes are separate migrations so existing databases can catch up.
+const initialSchema = `
+CREATE TABLE IF NOT EXISTS owners (
+    name TEXT PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS institutions (
+    owner_name   TEXT NOT NULL REFERENCES owners(name),
+    name         TEXT NOT NULL,
+    type         TEXT NOT NULL CHECK(type IN ('transactions', 'investments')),
+    access_token TEXT NOT NULL DEFAULT '',
+    cursor       TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (owner_name, name, type)
+);
+
+CREATE TABLE IF NOT EXISTS accounts (
+    id           TEXT PRIMARY KEY,
+    owner_name   TEXT NOT NULL,
+    inst_name    TEXT NOT NULL,
+    inst_type    TEXT NOT NULL,
+    account_base TEXT NOT NULL,
+    FOREIGN KEY (owner_name, inst_name, inst_type) REFERENCES institutions(owner_name, name, type)
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+    transaction_id TEXT PRIMARY KEY,
+    account_id     TEXT NOT NULL REFERENCES accounts(id),
+    data           TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS holdings (
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id TEXT NOT NULL REFERENCES accounts(id),
+    data       TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS securities (
+    security_id TEXT NOT NULL,
+    account_id  TEXT NOT NULL REFERENCES accounts(id),
+    data        TEXT NOT NULL,
+    PRIMARY KEY (security_id, account_id)
+);
+
+CREATE TABLE IF NOT EXISTS investment_transactions (
+    transaction_id TEXT PRIMARY KEY,
+    account_id     TEXT NOT NULL REFERENCES accounts(id),
+    data           TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_institutions_owner ON institutions(owner_name);
+CREATE INDEX IF NOT EXISTS idx_accounts_inst ON accounts(owner_name, inst_name, inst_type);
+CREATE INDEX IF NOT EXISTS idx_transactions_account ON transactions(account_id);
+CREATE INDEX IF NOT EXISTS idx_holdings_account ON holdings(account_id);
+CREATE INDEX IF NOT EXISTS idx_securities_account ON securities(account_id);
+CREATE INDEX IF NOT EXISTS idx_inv_transactions_account ON investment_transactions(account_id);
+`
+
+// migration is one step of the SQLite schema. Steps are applied in order
+// and each is recorded in schema_version once it succeeds.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations must only ever be appended to: a released version number
+// always means the same change.
+var migrations = []migration{
+	{1, "create initial tables", execMigration(initialSchema)},
+	{2, "add institutions.last_synced_date", addColumnMigration("institutions", "last_synced_date", "TEXT NOT NULL DEFAULT ''")},
+	{3, "add institutions.needs_update", addColumnMigration("institutions", "needs_update", "INTEGER NOT NULL DEFAULT 0")},
+	{4, "move investment transactions and securities to their own accounts", execMigration(repairInvestmentAccountsSchema)},
+	{5, "create balance_snapshots", execMigration(balanceSnapshotsSchema)},
+}
+
+const balanceSnapshotsSchema = `
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+    account_id TEXT NOT NULL REFERENCES accounts(id),
+    fetched_at TEXT NOT NULL,
+    data       TEXT NOT NULL,
+    PRIMARY KEY (account_id, fetched_at)
+);`
+
+// LatestSchemaVersion is the schema version this binary writes.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+const schemaVersionTable = `
+CREATE TABLE IF NOT EXISTS schema_version (
+    version     INTEGER PRIMARY KEY,
+    description TEXT NOT NULL,
+    applied_at  TEXT NOT NULL
+);`
+
+// migrate brings db up to LatestSchemaVersion in a single transaction. A
+// database written by a newer binary is refused rather than guessed at.
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(schemaVersionTable); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if latest := LatestSchemaVersion(); current > latest {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d; upgrade bean-auto", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.apply(tx); err != nil {
+			return fmt.Errorf("failed to apply schema migration %d (%s): %w", m.version, m.description, err)
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+			m.version, m.description, time.Now().UTC().Format(time.RFC3339),
+		); err != nil {
+			return fmt.Errorf("failed to record schema migration %d: %w", m.version, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func schemaVersion(tx *sql.Tx) (int, error) {
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+func execMigration(stmt string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// addColumnMigration adds a column unless it is already there; databases
+// from before schema_version existed may have gained it ad hoc.
+func addColumnMigration(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(
+			"SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?", table, column,
+		).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %w", table, err)
+		}
+		if exists {
+			return nil
+		}
+
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
+
+// repairInvestmentAccountsSchema does what RepairInvestmentAccounts does,
+// in SQL against the version 3 tables, so it does not depend on the tables
+// later migrations add. investment_transactions holds each transaction
+// once, so it only has to point it at the account it posted against;
+// securities are then narrowed to the ones each investment account
+// references, copied from its institution's other accounts where missing.
+const repairInvestmentAccountsSchema = `
+UPDATE investment_transactions
+SET account_id = json_extract(data, '$.account_id')
+WHERE account_id != json_extract(data, '$.account_id')
+  AND EXISTS (
+    SELECT 1 FROM accounts src
+    JOIN accounts dst ON dst.owner_name = src.owner_name AND dst.inst_name = src.inst_name AND dst.inst_type = src.inst_type
+    WHERE src.id = investment_transactions.account_id
+      AND dst.id = json_extract(investment_transactions.data, '$.account_id')
+  );
+
+CREATE TEMP TABLE referenced_securities AS
+SELECT account_id, json_extract(data, '$.security_id') AS security_id FROM holdings
+UNION
+SELECT account_id, json_extract(data, '$.security_id') FROM investment_transactions
+WHERE json_extract(data, '$.security_id') IS NOT NULL;
+
+INSERT OR IGNORE INTO securities (security_id, account_id, data)
+SELECT s.security_id, a.id, s.data
+FROM accounts a
+JOIN accounts other ON other.owner_name = a.owner_name AND other.inst_name = a.inst_name AND other.inst_type = a.inst_type
+JOIN securities s ON s.account_id = other.id
+JOIN referenced_securities r ON r.account_id = a.id AND r.security_id = s.security_id
+WHERE a.inst_type = 'investments';
+
+DELETE FROM securities
+WHERE account_id IN (SELECT id FROM accounts WHERE inst_type = 'investments')
+  AND NOT EXISTS (
+    SELECT 1 FROM referenced_securities r
+    WHERE r.account_id = securities.account_id AND r.security_id = securities.security_id
+  );
+
+DROP TABLE referenced_securities;
+`
+
+// MigrationStatus reports whether one schema migration has been applied.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   string
+}
+
+// SQLiteSchemaStatus reports the migrations of the database at path without
+// applying any. A database with no schema_version table reports version 0.
+func SQLiteSchemaStatus(path string) (int, []MigrationStatus, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, nil, fmt.Errorf("failed to open sqlite db: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open sqlite db: %w", err)
+	}
+	defer db.Close()
+
+	var tables int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'",
+	).Scan(&tables); err != nil {
+		return 0, nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	applied := map[int]string{}
+	current := 0
+	if tables > 0 {
+		rows, err := db.Query("SELECT version, applied_at FROM schema_version ORDER BY version")
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to query schema versions: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int
+			var appliedAt string
+			if err := rows.Scan(&version, &appliedAt); err != nil {
+				return 0, nil, fmt.Errorf("failed to scan schema version: %w", err)
+			}
+			applied[version] = appliedAt
+			current = version
+		}
+		if err := rows.Err(); err != nil {
+			return 0, nil, fmt.Errorf("schema version rows error: %w", err)
+		}
+	}
+
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		statuses = append(statuses, MigrationStatus{
+			Version:     m.version,
+			Description: m.description,
+			AppliedAt:   applied[m.version],
+		})
+	}
+
+	return current, statuses, nil
+}
@@ -0,0 +1,172 @@
+package persistence
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+func TestSQLiteStoreMigratesNewDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	store.Close()
+
+	// Reopening must not reapply anything.
+	store, err = NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore (reopen): %v", err)
+	}
+	store.Close()
+
+	current, statuses, err := SQLiteSchemaStatus(dbPath)
+	if err != nil {
+		t.Fatalf("SQLiteSchemaStatus: %v", err)
+	}
+	if current != LatestSchemaVersion() {
+		t.Errorf("expected version %d, got %d", LatestSchemaVersion(), current)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == "" {
+			t.Errorf("migration %d not applied", status.Version)
+		}
+	}
+}
+
+func TestSQLiteStoreMigratesLegacyDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	// A database from before schema_version: initial tables only.
+	if _, err := db.Exec(initialSchema); err != nil {
+		t.Fatalf("create legacy schema: %v", err)
+	}
+	if _, err := db.Exec(
+		"INSERT INTO owners (name) VALUES ('alice'); INSERT INTO institutions (owner_name, name, type, access_token, cursor) VALUES ('alice', 'bank-a', 'transactions', 'tok-a', 'cur-1')",
+	); err != nil {
+		t.Fatalf("insert legacy rows: %v", err)
+	}
+	db.Close()
+
+	current, _, err := SQLiteSchemaStatus(dbPath)
+	if err != nil {
+		t.Fatalf("SQLiteSchemaStatus: %v", err)
+	}
+	if current != 0 {
+		t.Errorf("expected legacy version 0, got %d", current)
+	}
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	owners, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	inst, ok := owners[0].TransactionInstitution("bank-a")
+	if !ok || inst.InstitutionBase.Cursor != "cur-1" || inst.InstitutionBase.LastSyncedDate != "" {
+		t.Errorf("expected legacy institution preserved, got %+v", owners)
+	}
+}
+
+func TestSQLiteStoreRefusesNewerSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	if _, err := store.db.Exec(
+		"INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'from the future', '')",
+		LatestSchemaVersion()+1,
+	); err != nil {
+		t.Fatalf("insert schema version: %v", err)
+	}
+	store.Close()
+
+	if _, err := NewSQLiteStore(dbPath); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("expected newer schema error, got %v", err)
+	}
+}
+
+func TestSQLiteStoreRepairsInvestmentAccounts(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "v3.db")
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	// A version 3 database written by a sync that stored every investment
+	// transaction and security under the institution's first account.
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := db.Exec(`
+DROP TABLE balance_snapshots;
+DELETE FROM schema_version WHERE version > 3;
+INSERT INTO owners (name) VALUES ('alice');
+INSERT INTO institutions (owner_name, name, type) VALUES ('alice', 'broker', 'investments');
+INSERT INTO accounts (id, owner_name, inst_name, inst_type, account_base) VALUES
+  ('inv-1', 'alice', 'broker', 'investments', '{"account_id":"inv-1","balances":{},"name":"Brokerage","type":"investment"}'),
+  ('inv-2', 'alice', 'broker', 'investments', '{"account_id":"inv-2","balances":{},"name":"IRA","type":"investment"}');
+INSERT INTO holdings (account_id, data) VALUES ('inv-2', '{"account_id":"inv-2","security_id":"s1","quantity":1}');
+INSERT INTO securities (security_id, account_id, data) VALUES
+  ('s1', 'inv-1', '{"security_id":"s1"}'),
+  ('s2', 'inv-1', '{"security_id":"s2"}');
+INSERT INTO investment_transactions (transaction_id, account_id, data) VALUES
+  ('t1', 'inv-1', '{"investment_transaction_id":"t1","account_id":"inv-2","security_id":"s2"}');
+`); err != nil {
+		t.Fatalf("insert v3 rows: %v", err)
+	}
+
+	// Migration 4 must work against the version 3 tables alone.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if err := migrations[3].apply(tx); err != nil {
+		t.Fatalf("apply migration 4: %v", err)
+	}
+	var snapshots int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'balance_snapshots'").Scan(&snapshots); err != nil {
+		t.Fatalf("inspect tables: %v", err)
+	}
+	if snapshots != 0 {
+		t.Errorf("migration 4 created balance_snapshots")
+	}
+	tx.Rollback()
+	db.Close()
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	owners, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	accounts := map[string]types.InvestmentAccount{}
+	for _, account := range owners[0].InvestmentInstitutions[0].InvestmentAccounts {
+		accounts[account.AccoutBase.AccountId] = account
+	}
+	if got := accounts["inv-1"]; len(got.Transactions) != 0 || len(got.Securities) != 0 {
+		t.Errorf("expected inv-1 emptied, got %d transactions and %d securities", len(got.Transactions), len(got.Securities))
+	}
+	got := accounts["inv-2"]
+	if _, ok := got.Transactions["t1"]; !ok || len(got.Transactions) != 1 {
+		t.Errorf("expected t1 moved to inv-2, got %v", got.Transactions)
+	}
+	if _, ok := got.Securities["s1"]; !ok || len(got.Securities) != 2 {
+		t.Errorf("expected inv-2 to hold s1 and s2, got %v", got.Securities)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	_ "modernc.org/sqlite"
 
@@ -11,62 +12,6 @@ import (
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
-const schema = `
-CREATE TABLE IF NOT EXISTS owners (
-    name TEXT PRIMARY KEY
-);
-
-CREATE TABLE IF NOT EXISTS institutions (
-    owner_name   TEXT NOT NULL REFERENCES owners(name),
-    name         TEXT NOT NULL,
-    type         TEXT NOT NULL CHECK(type IN ('transactions', 'investments')),
-    access_token TEXT NOT NULL DEFAULT '',
-    cursor       TEXT NOT NULL DEFAULT '',
-    PRIMARY KEY (owner_name, name, type)
-);
-
-CREATE TABLE IF NOT EXISTS accounts (
-    id           TEXT PRIMARY KEY,
-    owner_name   TEXT NOT NULL,
-    inst_name    TEXT NOT NULL,
-    inst_type    TEXT NOT NULL,
-    account_base TEXT NOT NULL,
-    FOREIGN KEY (owner_name, inst_name, inst_type) REFERENCES institutions(owner_name, name, type)
-);
-
-CREATE TABLE IF NOT EXISTS transactions (
-    transaction_id TEXT PRIMARY KEY,
-    account_id     TEXT NOT NULL REFERENCES accounts(id),
-    data           TEXT NOT NULL
-);
-
-CREATE TABLE IF NOT EXISTS holdings (
-    id         INTEGER PRIMARY KEY AUTOINCREMENT,
-    account_id TEXT NOT NULL REFERENCES accounts(id),
-    data       TEXT NOT NULL
-);
-
-CREATE TABLE IF NOT EXISTS securities (
-    security_id TEXT NOT NULL,
-    account_id  TEXT NOT NULL REFERENCES accounts(id),
-    data        TEXT NOT NULL,
-    PRIMARY KEY (security_id, account_id)
-);
-
-CREATE TABLE IF NOT EXISTS investment_transactions (
-    transaction_id TEXT PRIMARY KEY,
-    account_id     TEXT NOT NULL REFERENCES accounts(id),
-    data           TEXT NOT NULL
-);
-
-CREATE INDEX IF NOT EXISTS idx_institutions_owner ON institutions(owner_name);
-CREATE INDEX IF NOT EXISTS idx_accounts_inst ON accounts(owner_name, inst_name, inst_type);
-CREATE INDEX IF NOT EXISTS idx_transactions_account ON transactions(account_id);
-CREATE INDEX IF NOT EXISTS idx_holdings_account ON holdings(account_id);
-CREATE INDEX IF NOT EXISTS idx_securities_account ON securities(account_id);
-CREATE INDEX IF NOT EXISTS idx_inv_transactions_account ON investment_transactions(account_id);
-`
-
 // Type aliases bypass plaid's custom UnmarshalJSON which silently drops data
 // when enum fields (e.g. AccountType) are empty. The aliases use Go's default
 // JSON decoder, which populates all fields regardless of enum validation.
@@ -76,6 +21,7 @@ type (
 	rawHolding       plaid.Holding
 	rawSecurity      plaid.Security
 	rawInvestmentTxn plaid.InvestmentTransaction
+	rawBalance       plaid.AccountBalance
 )
 
 func unmarshalAccountBase(data []byte) (plaid.AccountBase, error) {
@@ -108,6 +54,12 @@ func unmarshalInvestmentTxn(data []byte) (plaid.InvestmentTransaction, error) {
 	return plaid.InvestmentTransaction(r), nil
 }
 
+func unmarshalBalance(data []byte) (plaid.AccountBalance, error) {
+	var r rawBalance
+	_ = json.Unmarshal(data, &r)
+	return plaid.AccountBalance(r), nil
+}
+
 // SQLiteStore implements Store using a SQLite database.
 type SQLiteStore struct {
 	db   *sql.DB
@@ -129,9 +81,9 @@ func NewSQLiteStore(path string) (*SQLiteStore, error) {
 		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
 	}
 
-	if _, err := db.Exec(schema); err != nil {
+	if err := migrate(db); err != nil {
 		db.Close()
-		return nil, fmt.Errorf("failed to create tables: %w", err)
+		return nil, err
 	}
 
 	return &SQLiteStore{db: db, path: path}, nil
@@ -148,6 +100,10 @@ func (s *SQLiteStore) LoadOwners() ([]types.Owner, error) {
 	}
 	defer tx.Rollback()
 
+	return loadOwners(tx)
+}
+
+func loadOwners(tx *sql.Tx) ([]types.Owner, error) {
 	// Load all owners
 	ownerRows, err := tx.Query("SELECT name FROM owners ORDER BY name")
 	if err != nil {
@@ -173,7 +129,7 @@ func (s *SQLiteStore) LoadOwners() ([]types.Owner, error) {
 
 	// For each owner, load institutions
 	for i := range owners {
-		if err := s.loadOwnerData(tx, &owners[i]); err != nil {
+		if err := loadOwnerData(tx, &owners[i]); err != nil {
 			return nil, fmt.Errorf("failed to load data for owner %s: %w", owners[i].Name, err)
 		}
 	}
@@ -181,10 +137,10 @@ func (s *SQLiteStore) LoadOwners() ([]types.Owner, error) {
 	return owners, nil
 }
 
-func (s *SQLiteStore) loadOwnerData(tx *sql.Tx, owner *types.Owner) error {
+func loadOwnerData(tx *sql.Tx, owner *types.Owner) error {
 	// Load transaction institutions
 	instRows, err := tx.Query(
-		"SELECT name, access_token, cursor FROM institutions WHERE owner_name = ? AND type = 'transactions' ORDER BY name",
+		"SELECT name, access_token, cursor, last_synced_date, needs_update FROM institutions WHERE owner_name = ? AND type = 'transactions' ORDER BY name",
 		owner.Name,
 	)
 	if err != nil {
@@ -194,13 +150,13 @@ func (s *SQLiteStore) loadOwnerData(tx *sql.Tx, owner *types.Owner) error {
 
 	for instRows.Next() {
 		var inst types.TransactionInstitution
-		if err := instRows.Scan(&inst.InstitutionBase.Name, &inst.InstitutionBase.AccessToken, &inst.InstitutionBase.Cursor); err != nil {
+		if err := instRows.Scan(&inst.InstitutionBase.Name, &inst.InstitutionBase.AccessToken, &inst.InstitutionBase.Cursor, &inst.InstitutionBase.LastSyncedDate, &inst.InstitutionBase.NeedsUpdate); err != nil {
 			return fmt.Errorf("failed to scan institution: %w", err)
 		}
 		inst.TransactionAccounts = []types.TransactionAccount{}
 
 		// Load accounts for this institution
-		if err := s.loadTransactionAccounts(tx, owner.Name, inst.InstitutionBase.Name, &inst); err != nil {
+		if err := loadTransactionAccounts(tx, owner.Name, inst.InstitutionBase.Name, &inst); err != nil {
 			return err
 		}
 
@@ -212,7 +168,7 @@ func (s *SQLiteStore) loadOwnerData(tx *sql.Tx, owner *types.Owner) error {
 
 	// Load investment institutions
 	invInstRows, err := tx.Query(
-		"SELECT name, access_token, cursor FROM institutions WHERE owner_name = ? AND type = 'investments' ORDER BY name",
+		"SELECT name, access_token, cursor, last_synced_date, needs_update FROM institutions WHERE owner_name = ? AND type = 'investments' ORDER BY name",
 		owner.Name,
 	)
 	if err != nil {
@@ -223,11 +179,11 @@ func (s *SQLiteStore) loadOwnerData(tx *sql.Tx, owner *types.Owner) error {
 	for invInstRows.Next() {
 		var inst types.InvestmentInstitution
 		inst.InvestmentAccounts = []types.InvestmentAccount{}
-		if err := invInstRows.Scan(&inst.InstitutionBase.Name, &inst.InstitutionBase.AccessToken, &inst.InstitutionBase.Cursor); err != nil {
+		if err := invInstRows.Scan(&inst.InstitutionBase.Name, &inst.InstitutionBase.AccessToken, &inst.InstitutionBase.Cursor, &inst.InstitutionBase.LastSyncedDate, &inst.InstitutionBase.NeedsUpdate); err != nil {
 			return fmt.Errorf("failed to scan investment institution: %w", err)
 		}
 
-		if err := s.loadInvestmentAccounts(tx, owner.Name, inst.InstitutionBase.Name, &inst); err != nil {
+		if err := loadInvestmentAccounts(tx, owner.Name, inst.InstitutionBase.Name, &inst); err != nil {
 			return err
 		}
 
@@ -240,9 +196,9 @@ func (s *SQLiteStore) loadOwnerData(tx *sql.Tx, owner *types.Owner) error {
 	return nil
 }
 
-func (s *SQLiteStore) loadTransactionAccounts(tx *sql.Tx, ownerName, instName string, inst *types.TransactionInstitution) error {
+func loadTransactionAccounts(tx *sql.Tx, ownerName, instName string, inst *types.TransactionInstitution) error {
 	acctRows, err := tx.Query(
-		"SELECT id, account_base FROM accounts WHERE owner_name = ? AND inst_name = ? AND inst_type = 'transactions' ORDER BY id",
+		"SELECT id, account_base FROM accounts WHERE owner_name = ? AND inst_name = ? AND inst_type = 'transactions' ORDER BY rowid",
 		ownerName, instName,
 	)
 	if err != nil {
@@ -290,14 +246,18 @@ func (s *SQLiteStore) loadTransactionAccounts(tx *sql.Tx, ownerName, instName st
 			return fmt.Errorf("transaction rows error: %w", err)
 		}
 
+		if acct.BalanceHistory, err = loadBalanceHistory(tx, acctID); err != nil {
+			return err
+		}
+
 		inst.TransactionAccounts = append(inst.TransactionAccounts, acct)
 	}
 	return acctRows.Err()
 }
 
-func (s *SQLiteStore) loadInvestmentAccounts(tx *sql.Tx, ownerName, instName string, inst *types.InvestmentInstitution) error {
+func loadInvestmentAccounts(tx *sql.Tx, ownerName, instName string, inst *types.InvestmentInstitution) error {
 	acctRows, err := tx.Query(
-		"SELECT id, account_base FROM accounts WHERE owner_name = ? AND inst_name = ? AND inst_type = 'investments' ORDER BY id",
+		"SELECT id, account_base FROM accounts WHERE owner_name = ? AND inst_name = ? AND inst_type = 'investments' ORDER BY rowid",
 		ownerName, instName,
 	)
 	if err != nil {
@@ -383,11 +343,44 @@ func (s *SQLiteStore) loadInvestmentAccounts(tx *sql.Tx, ownerName, instName str
 		}
 		invTxnRows.Close()
 
+		if acct.BalanceHistory, err = loadBalanceHistory(tx, acctID); err != nil {
+			return err
+		}
+
 		inst.InvestmentAccounts = append(inst.InvestmentAccounts, acct)
 	}
 	return acctRows.Err()
 }
 
+func loadBalanceHistory(tx *sql.Tx, accountID string) ([]types.BalanceSnapshot, error) {
+	rows, err := tx.Query("SELECT fetched_at, data FROM balance_snapshots WHERE account_id = ? ORDER BY fetched_at", accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query balance snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	var history []types.BalanceSnapshot
+	for rows.Next() {
+		var fetchedAt, data string
+		if err := rows.Scan(&fetchedAt, &data); err != nil {
+			return nil, fmt.Errorf("failed to scan balance snapshot: %w", err)
+		}
+		snapshot := types.BalanceSnapshot{AccountID: accountID}
+		if snapshot.FetchedAt, err = time.Parse(time.RFC3339, fetchedAt); err != nil {
+			return nil, fmt.Errorf("failed to parse balance snapshot time %q: %w", fetchedAt, err)
+		}
+		if snapshot.Balances, err = unmarshalBalance([]byte(data)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal balance snapshot: %w", err)
+		}
+		history = append(history, snapshot)
+	}
+	return history, rows.Err()
+}
+
+// DumpOwners makes the database match owners. Rows are upserted by key and
+// only rows absent from owners are deleted, so unchanged history is not
+// rewritten, but every row is still compared; link and sync use the
+// narrower methods below instead.
 func (s *SQLiteStore) DumpOwners(owners []types.Owner) error {
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -395,118 +388,444 @@ func (s *SQLiteStore) DumpOwners(owners []types.Owner) error {
 	}
 	defer tx.Rollback()
 
-	// Clear all data in reverse dependency order
-	for _, table := range []string{"investment_transactions", "securities", "holdings", "transactions", "accounts", "institutions", "owners"} {
-		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
-			return fmt.Errorf("failed to clear table %s: %w", table, err)
-		}
+	if err := dumpOwners(tx, owners); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func dumpOwners(tx *sql.Tx, owners []types.Owner) error {
+	keep := map[string]map[string]bool{}
+	for _, table := range []string{"owners", "institutions", "accounts", "transactions", "securities", "investment_transactions", "balance_snapshots"} {
+		keep[table] = map[string]bool{}
 	}
 
 	for _, owner := range owners {
-		if _, err := tx.Exec("INSERT INTO owners (name) VALUES (?)", owner.Name); err != nil {
-			return fmt.Errorf("failed to insert owner %s: %w", owner.Name, err)
+		if err := upsertOwner(tx, owner.Name); err != nil {
+			return err
 		}
+		keep["owners"][owner.Name] = true
 
-		// Insert transaction institutions
 		for _, inst := range owner.TransactionInstitutions {
-			if _, err := tx.Exec(
-				"INSERT INTO institutions (owner_name, name, type, access_token, cursor) VALUES (?, ?, 'transactions', ?, ?)",
-				owner.Name, inst.InstitutionBase.Name, inst.InstitutionBase.AccessToken, inst.InstitutionBase.Cursor,
-			); err != nil {
-				return fmt.Errorf("failed to insert transaction institution: %w", err)
+			if err := saveTransactionInstitution(tx, owner.Name, inst); err != nil {
+				return err
 			}
-
+			keep["institutions"][institutionKey(owner.Name, inst.InstitutionBase.Name, types.InstitutionTypeTransaction)] = true
 			for _, acct := range inst.TransactionAccounts {
-				acctBaseJSON, err := json.Marshal(acct.AccoutBase)
-				if err != nil {
-					return fmt.Errorf("failed to marshal account base: %w", err)
+				keep["accounts"][acct.AccoutBase.AccountId] = true
+				for txnID := range acct.Transactions {
+					keep["transactions"][txnID] = true
 				}
-
-				if _, err := tx.Exec(
-					"INSERT INTO accounts (id, owner_name, inst_name, inst_type, account_base) VALUES (?, ?, ?, 'transactions', ?)",
-					acct.AccoutBase.AccountId, owner.Name, inst.InstitutionBase.Name, string(acctBaseJSON),
-				); err != nil {
-					return fmt.Errorf("failed to insert account: %w", err)
+				for _, snapshot := range acct.BalanceHistory {
+					keep["balance_snapshots"][balanceSnapshotKey(snapshot)] = true
 				}
+			}
+		}
 
-				for txnID, txn := range acct.Transactions {
-					txnData, err := json.Marshal(txn)
-					if err != nil {
-						return fmt.Errorf("failed to marshal transaction: %w", err)
-					}
-					if _, err := tx.Exec(
-						"INSERT INTO transactions (transaction_id, account_id, data) VALUES (?, ?, ?)",
-						txnID, acct.AccoutBase.AccountId, string(txnData),
-					); err != nil {
-						return fmt.Errorf("failed to insert transaction: %w", err)
-					}
+		for _, inst := range owner.InvestmentInstitutions {
+			if err := saveInvestmentInstitution(tx, owner.Name, inst); err != nil {
+				return err
+			}
+			keep["institutions"][institutionKey(owner.Name, inst.InstitutionBase.Name, types.InstitutionTypeInvestment)] = true
+			for _, acct := range inst.InvestmentAccounts {
+				keep["accounts"][acct.AccoutBase.AccountId] = true
+				for secID := range acct.Securities {
+					keep["securities"][securityKey(secID, acct.AccoutBase.AccountId)] = true
+				}
+				for txnID := range acct.Transactions {
+					keep["investment_transactions"][txnID] = true
+				}
+				for _, snapshot := range acct.BalanceHistory {
+					keep["balance_snapshots"][balanceSnapshotKey(snapshot)] = true
 				}
 			}
 		}
+	}
 
-		// Insert investment institutions
-		for _, inst := range owner.InvestmentInstitutions {
+	// Delete stale rows children first. Holdings of kept accounts were
+	// already replaced by saveInvestmentInstitution.
+	for _, st := range []struct{ table, key string }{
+		{"balance_snapshots", "account_id || char(31) || fetched_at"},
+		{"investment_transactions", "transaction_id"},
+		{"securities", "security_id || char(31) || account_id"},
+		{"transactions", "transaction_id"},
+		{"accounts", "id"},
+		{"institutions", "owner_name || char(31) || name || char(31) || type"},
+		{"owners", "name"},
+	} {
+		if st.table == "accounts" {
+			if err := deleteStale(tx, "holdings", "account_id", keep["accounts"]); err != nil {
+				return err
+			}
+		}
+		if err := deleteStale(tx, st.table, st.key, keep[st.table]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func institutionKey(ownerName, instName string, instType types.InstitutionType) string {
+	return ownerName + "\x1f" + instName + "\x1f" + string(instType)
+}
+
+func securityKey(secID, accountID string) string {
+	return secID + "\x1f" + accountID
+}
+
+func balanceSnapshotKey(snapshot types.BalanceSnapshot) string {
+	return snapshot.AccountID + "\x1f" + snapshot.FetchedAt.UTC().Format(time.RFC3339)
+}
+
+// deleteStale deletes the rows of table whose key expression is not in keep.
+func deleteStale(tx *sql.Tx, table, key string, keep map[string]bool) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT DISTINCT %s FROM %s", key, table))
+	if err != nil {
+		return fmt.Errorf("failed to query %s keys: %w", table, err)
+	}
+
+	var stale []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan %s key: %w", table, err)
+		}
+		if !keep[k] {
+			stale = append(stale, k)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s key rows error: %w", table, err)
+	}
+
+	for _, k := range stale {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, key), k); err != nil {
+			return fmt.Errorf("failed to delete stale row from %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func upsertOwner(tx *sql.Tx, name string) error {
+	if _, err := tx.Exec("INSERT INTO owners (name) VALUES (?) ON CONFLICT(name) DO NOTHING", name); err != nil {
+		return fmt.Errorf("failed to upsert owner %s: %w", name, err)
+	}
+	return nil
+}
+
+func upsertInstitution(tx *sql.Tx, ownerName string, instType types.InstitutionType, base types.InstitutionBase) error {
+	if _, err := tx.Exec(
+		`INSERT INTO institutions (owner_name, name, type, access_token, cursor, last_synced_date, needs_update) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(owner_name, name, type) DO UPDATE SET
+			access_token = excluded.access_token,
+			cursor = excluded.cursor,
+			last_synced_date = excluded.last_synced_date,
+			needs_update = excluded.needs_update`,
+		ownerName, base.Name, string(instType), base.AccessToken, base.Cursor, base.LastSyncedDate, base.NeedsUpdate,
+	); err != nil {
+		return fmt.Errorf("failed to upsert %s institution %s: %w", instType, base.Name, err)
+	}
+	return nil
+}
+
+func upsertAccount(tx *sql.Tx, ownerName, instName string, instType types.InstitutionType, acctBase plaid.AccountBase) error {
+	acctBaseJSON, err := json.Marshal(acctBase)
+	if err != nil {
+		return fmt.Errorf("failed to marshal account base: %w", err)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO accounts (id, owner_name, inst_name, inst_type, account_base) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			owner_name = excluded.owner_name,
+			inst_name = excluded.inst_name,
+			inst_type = excluded.inst_type,
+			account_base = excluded.account_base
+		WHERE accounts.account_base != excluded.account_base
+			OR accounts.owner_name != excluded.owner_name
+			OR accounts.inst_name != excluded.inst_name
+			OR accounts.inst_type != excluded.inst_type`,
+		acctBase.AccountId, ownerName, instName, string(instType), string(acctBaseJSON),
+	); err != nil {
+		return fmt.Errorf("failed to upsert account: %w", err)
+	}
+	return nil
+}
+
+func upsertTransaction(tx *sql.Tx, txnID, accountID string, txn plaid.Transaction) error {
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transaction: %w", err)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO transactions (transaction_id, account_id, data) VALUES (?, ?, ?)
+		ON CONFLICT(transaction_id) DO UPDATE SET account_id = excluded.account_id, data = excluded.data
+		WHERE transactions.data != excluded.data OR transactions.account_id != excluded.account_id`,
+		txnID, accountID, string(data),
+	); err != nil {
+		return fmt.Errorf("failed to upsert transaction: %w", err)
+	}
+	return nil
+}
+
+// upsertBalanceSnapshot records a snapshot. Snapshots are keyed by account
+// and fetch time, so applying the same one twice is a no-op.
+func upsertBalanceSnapshot(tx *sql.Tx, snapshot types.BalanceSnapshot) error {
+	data, err := json.Marshal(snapshot.Balances)
+	if err != nil {
+		return fmt.Errorf("failed to marshal balance snapshot: %w", err)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO balance_snapshots (account_id, fetched_at, data) VALUES (?, ?, ?)
+		ON CONFLICT(account_id, fetched_at) DO UPDATE SET data = excluded.data
+		WHERE balance_snapshots.data != excluded.data`,
+		snapshot.AccountID, snapshot.FetchedAt.UTC().Format(time.RFC3339), string(data),
+	); err != nil {
+		return fmt.Errorf("failed to upsert balance snapshot: %w", err)
+	}
+	return nil
+}
+
+func saveBalanceHistory(tx *sql.Tx, accountID string, history []types.BalanceSnapshot) error {
+	for _, snapshot := range history {
+		snapshot.AccountID = accountID
+		if err := upsertBalanceSnapshot(tx, snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveTransactionInstitution(tx *sql.Tx, ownerName string, inst types.TransactionInstitution) error {
+	if err := upsertInstitution(tx, ownerName, types.InstitutionTypeTransaction, inst.InstitutionBase); err != nil {
+		return err
+	}
+
+	for _, acct := range inst.TransactionAccounts {
+		if err := upsertAccount(tx, ownerName, inst.InstitutionBase.Name, types.InstitutionTypeTransaction, acct.AccoutBase); err != nil {
+			return err
+		}
+
+		for txnID, txn := range acct.Transactions {
+			if err := upsertTransaction(tx, txnID, acct.AccoutBase.AccountId, txn); err != nil {
+				return err
+			}
+		}
+
+		if err := saveBalanceHistory(tx, acct.AccoutBase.AccountId, acct.BalanceHistory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveInvestmentInstitution(tx *sql.Tx, ownerName string, inst types.InvestmentInstitution) error {
+	if err := upsertInstitution(tx, ownerName, types.InstitutionTypeInvestment, inst.InstitutionBase); err != nil {
+		return err
+	}
+
+	for _, acct := range inst.InvestmentAccounts {
+		accountID := acct.AccoutBase.AccountId
+		if err := upsertAccount(tx, ownerName, inst.InstitutionBase.Name, types.InstitutionTypeInvestment, acct.AccoutBase); err != nil {
+			return err
+		}
+
+		// Holdings are a snapshot, so they are replaced wholesale.
+		if _, err := tx.Exec("DELETE FROM holdings WHERE account_id = ?", accountID); err != nil {
+			return fmt.Errorf("failed to clear holdings: %w", err)
+		}
+		for _, h := range acct.Holdings {
+			data, err := json.Marshal(h)
+			if err != nil {
+				return fmt.Errorf("failed to marshal holding: %w", err)
+			}
 			if _, err := tx.Exec(
-				"INSERT INTO institutions (owner_name, name, type, access_token, cursor) VALUES (?, ?, 'investments', ?, ?)",
-				owner.Name, inst.InstitutionBase.Name, inst.InstitutionBase.AccessToken, inst.InstitutionBase.Cursor,
+				"INSERT INTO holdings (account_id, data) VALUES (?, ?)",
+				accountID, string(data),
 			); err != nil {
-				return fmt.Errorf("failed to insert investment institution: %w", err)
+				return fmt.Errorf("failed to insert holding: %w", err)
 			}
+		}
 
-			for _, acct := range inst.InvestmentAccounts {
-				acctBaseJSON, err := json.Marshal(acct.AccoutBase)
-				if err != nil {
-					return fmt.Errorf("failed to marshal account base: %w", err)
-				}
+		for secID, sec := range acct.Securities {
+			data, err := json.Marshal(sec)
+			if err != nil {
+				return fmt.Errorf("failed to marshal security: %w", err)
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO securities (security_id, account_id, data) VALUES (?, ?, ?)
+				ON CONFLICT(security_id, account_id) DO UPDATE SET data = excluded.data
+				WHERE securities.data != excluded.data`,
+				secID, accountID, string(data),
+			); err != nil {
+				return fmt.Errorf("failed to upsert security: %w", err)
+			}
+		}
 
-				if _, err := tx.Exec(
-					"INSERT INTO accounts (id, owner_name, inst_name, inst_type, account_base) VALUES (?, ?, ?, 'investments', ?)",
-					acct.AccoutBase.AccountId, owner.Name, inst.InstitutionBase.Name, string(acctBaseJSON),
-				); err != nil {
-					return fmt.Errorf("failed to insert investment account: %w", err)
-				}
+		for txnID, txn := range acct.Transactions {
+			data, err := json.Marshal(txn)
+			if err != nil {
+				return fmt.Errorf("failed to marshal investment transaction: %w", err)
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO investment_transactions (transaction_id, account_id, data) VALUES (?, ?, ?)
+				ON CONFLICT(transaction_id) DO UPDATE SET account_id = excluded.account_id, data = excluded.data
+				WHERE investment_transactions.data != excluded.data OR investment_transactions.account_id != excluded.account_id`,
+				txnID, accountID, string(data),
+			); err != nil {
+				return fmt.Errorf("failed to upsert investment transaction: %w", err)
+			}
+		}
+		if err := deleteRemovedInvestmentTransactions(tx, accountID, acct.Transactions); err != nil {
+			return err
+		}
 
-				for _, h := range acct.Holdings {
-					data, err := json.Marshal(h)
-					if err != nil {
-						return fmt.Errorf("failed to marshal holding: %w", err)
-					}
-					if _, err := tx.Exec(
-						"INSERT INTO holdings (account_id, data) VALUES (?, ?)",
-						acct.AccoutBase.AccountId, string(data),
-					); err != nil {
-						return fmt.Errorf("failed to insert holding: %w", err)
-					}
-				}
+		if err := saveBalanceHistory(tx, accountID, acct.BalanceHistory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-				for secID, sec := range acct.Securities {
-					data, err := json.Marshal(sec)
-					if err != nil {
-						return fmt.Errorf("failed to marshal security: %w", err)
-					}
-					if _, err := tx.Exec(
-						"INSERT INTO securities (security_id, account_id, data) VALUES (?, ?, ?)",
-						secID, acct.AccoutBase.AccountId, string(data),
-					); err != nil {
-						return fmt.Errorf("failed to insert security: %w", err)
-					}
-				}
+// deleteRemovedInvestmentTransactions drops the stored investment
+// transactions of an account that are no longer in txns.
+func deleteRemovedInvestmentTransactions(tx *sql.Tx, accountID string, txns map[string]plaid.InvestmentTransaction) error {
+	rows, err := tx.Query("SELECT transaction_id FROM investment_transactions WHERE account_id = ?", accountID)
+	if err != nil {
+		return fmt.Errorf("failed to query investment transactions: %w", err)
+	}
 
-				for txnID, txn := range acct.Transactions {
-					data, err := json.Marshal(txn)
-					if err != nil {
-						return fmt.Errorf("failed to marshal investment transaction: %w", err)
-					}
-					if _, err := tx.Exec(
-						"INSERT INTO investment_transactions (transaction_id, account_id, data) VALUES (?, ?, ?)",
-						txnID, acct.AccoutBase.AccountId, string(data),
-					); err != nil {
-						return fmt.Errorf("failed to insert investment transaction: %w", err)
-					}
-				}
+	var removed []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan investment transaction id: %w", err)
+		}
+		if _, ok := txns[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("investment transaction rows error: %w", err)
+	}
+
+	for _, id := range removed {
+		if _, err := tx.Exec("DELETE FROM investment_transactions WHERE transaction_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete investment transaction: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) AddInstitution(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := upsertOwner(tx, ownerName); err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		"INSERT INTO institutions (owner_name, name, type, access_token, cursor, last_synced_date, needs_update) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(owner_name, name, type) DO NOTHING",
+		ownerName, base.Name, string(instType), base.AccessToken, base.Cursor, base.LastSyncedDate, base.NeedsUpdate,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert %s institution %s: %w", instType, base.Name, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to check institution insert: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%s institution %s:%s already existed", instType, ownerName, base.Name)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ApplyTransactionSyncPage(ownerName, instName string, page types.TransactionSyncPage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE institutions SET cursor = ? WHERE owner_name = ? AND name = ? AND type = 'transactions'",
+		page.NextCursor, ownerName, instName,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update cursor: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to check cursor update: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("transaction institution %s:%s not existed", ownerName, instName)
+	}
+
+	for _, acctBase := range page.AccountBases {
+		if err := upsertAccount(tx, ownerName, instName, types.InstitutionTypeTransaction, acctBase); err != nil {
+			return err
+		}
+	}
+
+	for _, snapshot := range page.BalanceSnapshots {
+		if err := upsertBalanceSnapshot(tx, snapshot); err != nil {
+			return err
+		}
+	}
+
+	for _, txns := range [][]plaid.Transaction{page.Added, page.Modified} {
+		for _, txn := range txns {
+			if err := upsertTransaction(tx, txn.TransactionId, txn.AccountId, txn); err != nil {
+				return err
 			}
 		}
 	}
 
+	for _, id := range page.Removed {
+		if _, err := tx.Exec("DELETE FROM transactions WHERE transaction_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete transaction: %w", err)
+		}
+	}
+
 	return tx.Commit()
 }
+
+func (s *SQLiteStore) SaveInvestmentInstitution(ownerName string, inst types.InvestmentInstitution) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := upsertOwner(tx, ownerName); err != nil {
+		return err
+	}
+	if err := saveInvestmentInstitution(tx, ownerName, inst); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateInstitutionBase(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error {
+	res, err := s.db.Exec(
+		"UPDATE institutions SET access_token = ?, cursor = ?, last_synced_date = ?, needs_update = ? WHERE owner_name = ? AND name = ? AND type = ?",
+		base.AccessToken, base.Cursor, base.LastSyncedDate, base.NeedsUpdate, ownerName, base.Name, string(instType),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update institution: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to check institution update: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%s institution %s:%s not existed", instType, ownerName, base.Name)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+const benchTransactions = 100000
+
+// newBenchOwners builds a single owner whose checking account holds n
+// transactions, roughly the history of a long-lived household ledger.
+func newBenchOwners(n int) []types.Owner {
+	txns := make(map[string]plaid.Transaction, n)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("txn-%06d", i)
+		txns[id] = plaid.Transaction{
+			TransactionId: id,
+			AccountId:     "acct-1",
+			Amount:        float32(i%500) + 0.25,
+			Name:          fmt.Sprintf("Merchant %d", i%1000),
+			Date:          fmt.Sprintf("2020-%02d-%02d", i%12+1, i%28+1),
+		}
+	}
+
+	return []types.Owner{
+		{
+			Name: "alice",
+			TransactionInstitutions: []types.TransactionInstitution{
+				{
+					InstitutionBase: types.InstitutionBase{Name: "bank-a", AccessToken: "tok-a", Cursor: "cur-0"},
+					TransactionAccounts: []types.TransactionAccount{
+						{
+							AccoutBase:   plaid.AccountBase{AccountId: "acct-1", Name: "Checking", Type: plaid.ACCOUNTTYPE_DEPOSITORY},
+							Transactions: txns,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newBenchStore(b *testing.B, owners []types.Owner) *SQLiteStore {
+	b.Helper()
+	store, err := NewSQLiteStore(filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatalf("NewSQLiteStore: %v", err)
+	}
+	b.Cleanup(func() { store.Close() })
+
+	if err := store.DumpOwners(owners); err != nil {
+		b.Fatalf("DumpOwners: %v", err)
+	}
+	return store
+}
+
+// BenchmarkSQLiteStoreDumpOwners rewrites the full fixture with a handful of
+// changed transactions. Only migrate and encrypt-tokens pay this cost now.
+func BenchmarkSQLiteStoreDumpOwners(b *testing.B) {
+	owners := newBenchOwners(benchTransactions)
+	store := newBenchStore(b, owners)
+	txns := owners[0].TransactionInstitutions[0].TransactionAccounts[0].Transactions
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := fmt.Sprintf("txn-%06d", i%benchTransactions)
+		txn := txns[id]
+		txn.Amount++
+		txns[id] = txn
+		if err := store.DumpOwners(owners); err != nil {
+			b.Fatalf("DumpOwners: %v", err)
+		}
+	}
+}
+
+// BenchmarkSQLiteStoreApplyTransactionSyncPage applies a typical sync page
+// against the same fixture.
+func BenchmarkSQLiteStoreApplyTransactionSyncPage(b *testing.B) {
+	store := newBenchStore(b, newBenchOwners(benchTransactions))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		page := types.TransactionSyncPage{
+			AccountBases: []plaid.AccountBase{{AccountId: "acct-1", Name: "Checking", Type: plaid.ACCOUNTTYPE_DEPOSITORY}},
+			NextCursor:   fmt.Sprintf("cur-%d", i+1),
+		}
+		for j := 0; j < 10; j++ {
+			id := fmt.Sprintf("new-%d-%d", i, j)
+			page.Added = append(page.Added, plaid.Transaction{TransactionId: id, AccountId: "acct-1", Amount: 1, Name: "Added"})
+		}
+		page.Modified = []plaid.Transaction{{TransactionId: fmt.Sprintf("txn-%06d", i%benchTransactions), AccountId: "acct-1", Amount: 2, Name: "Modified"}}
+		page.Removed = []string{fmt.Sprintf("new-%d-0", i)}
+
+		if err := store.ApplyTransactionSyncPage("alice", "bank-a", page); err != nil {
+			b.Fatalf("ApplyTransactionSyncPage: %v", err)
+		}
+	}
+}
+
+// BenchmarkSQLiteStoreSave performs the writes of one sync run and one link
+// against the fixture: a sync page, the institution's final base update, and
+// a newly linked institution.
+func BenchmarkSQLiteStoreSave(b *testing.B) {
+	store := newBenchStore(b, newBenchOwners(benchTransactions))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cursor := fmt.Sprintf("cur-%d", i+1)
+		page := types.TransactionSyncPage{
+			AccountBases: []plaid.AccountBase{{AccountId: "acct-1", Name: "Checking", Type: plaid.ACCOUNTTYPE_DEPOSITORY}},
+			Added:        []plaid.Transaction{{TransactionId: fmt.Sprintf("new-%d", i), AccountId: "acct-1", Amount: 1, Name: "Added"}},
+			NextCursor:   cursor,
+		}
+		if err := store.ApplyTransactionSyncPage("alice", "bank-a", page); err != nil {
+			b.Fatalf("ApplyTransactionSyncPage: %v", err)
+		}
+
+		base := types.InstitutionBase{Name: "bank-a", AccessToken: "tok-a", Cursor: cursor}
+		if err := store.UpdateInstitutionBase("alice", types.InstitutionTypeTransaction, base); err != nil {
+			b.Fatalf("UpdateInstitutionBase: %v", err)
+		}
+
+		if err := store.AddInstitution("alice", types.InstitutionTypeTransaction, types.InstitutionBase{Name: fmt.Sprintf("bank-%d", i), AccessToken: "tok"}); err != nil {
+			b.Fatalf("AddInstitution: %v", err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/plaid/plaid-go/plaid"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
@@ -19,6 +20,7 @@ func newTestOwners() []types.Owner {
 						Name:        "bank-a",
 						AccessToken: "tok-a",
 						Cursor:      "cur-1",
+						NeedsUpdate: true,
 					},
 					TransactionAccounts: []types.TransactionAccount{
 						{
@@ -170,3 +172,314 @@ func TestSQLiteStoreOverwrite(t *testing.T) {
 		t.Errorf("expected single owner 'bob', got %+v", loaded)
 	}
 }
+
+func TestSQLiteStoreApplyTransactionSyncPage(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.DumpOwners(newTestOwners()); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+
+	page := types.TransactionSyncPage{
+		AccountBases: []plaid.AccountBase{
+			{AccountId: "acct-1", Name: "Checking"},
+			{AccountId: "acct-2", Name: "Savings"},
+		},
+		Added: []plaid.Transaction{
+			{TransactionId: "txn-3", AccountId: "acct-2", Amount: 7, Name: "Interest"},
+		},
+		Modified: []plaid.Transaction{
+			{TransactionId: "txn-1", AccountId: "acct-1", Amount: 43, Name: "Coffee Shop"},
+		},
+		Removed:    []string{"txn-2"},
+		NextCursor: "cur-2",
+	}
+	if err := store.ApplyTransactionSyncPage("alice", "bank-a", page); err != nil {
+		t.Fatalf("ApplyTransactionSyncPage: %v", err)
+	}
+
+	loaded, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+
+	inst, _ := loaded[0].TransactionInstitution("bank-a")
+	if inst.InstitutionBase.Cursor != "cur-2" {
+		t.Errorf("expected cursor cur-2, got %q", inst.InstitutionBase.Cursor)
+	}
+	checking, _ := inst.TransactionAccount("acct-1")
+	if len(checking.Transactions) != 1 || checking.Transactions["txn-1"].Amount != 43 {
+		t.Errorf("expected only modified txn-1 in acct-1, got %+v", checking.Transactions)
+	}
+	savings, ok := inst.TransactionAccount("acct-2")
+	if !ok || len(savings.Transactions) != 1 {
+		t.Errorf("expected acct-2 with txn-3, got %+v", savings)
+	}
+
+	if err := store.ApplyTransactionSyncPage("alice", "missing", page); err == nil {
+		t.Errorf("expected error for unknown institution")
+	}
+}
+
+func TestSQLiteStoreDumpOwnersKeepsUnchangedRows(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	owners := newTestOwners()
+	if err := store.DumpOwners(owners); err != nil {
+		t.Fatalf("DumpOwners (first): %v", err)
+	}
+
+	var rowid int64
+	if err := store.db.QueryRow("SELECT rowid FROM transactions WHERE transaction_id = 'txn-1'").Scan(&rowid); err != nil {
+		t.Fatalf("query rowid: %v", err)
+	}
+
+	delete(owners[0].TransactionInstitutions[0].TransactionAccounts[0].Transactions, "txn-2")
+	owners[0].InvestmentInstitutions[0].InvestmentAccounts[0].Holdings[0].Quantity = 12
+	if err := store.DumpOwners(owners); err != nil {
+		t.Fatalf("DumpOwners (second): %v", err)
+	}
+
+	var after int64
+	if err := store.db.QueryRow("SELECT rowid FROM transactions WHERE transaction_id = 'txn-1'").Scan(&after); err != nil {
+		t.Fatalf("query rowid: %v", err)
+	}
+	if after != rowid {
+		t.Errorf("expected unchanged txn-1 to keep rowid %d, got %d", rowid, after)
+	}
+
+	loaded, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+
+	acct := loaded[0].TransactionInstitutions[0].TransactionAccounts[0]
+	if _, ok := acct.Transactions["txn-2"]; ok || len(acct.Transactions) != 1 {
+		t.Errorf("expected only txn-1 left, got %+v", acct.Transactions)
+	}
+	holdings := loaded[0].InvestmentInstitutions[0].InvestmentAccounts[0].Holdings
+	if len(holdings) != 1 || holdings[0].Quantity != 12 {
+		t.Errorf("expected holdings replaced with quantity 12, got %+v", holdings)
+	}
+}
+
+func TestSQLiteStoreSaveInvestmentInstitution(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	owners := newTestOwners()
+	if err := store.DumpOwners(owners); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+
+	inst := owners[0].InvestmentInstitutions[0]
+	inst.InstitutionBase.LastSyncedDate = "2024-06-01"
+	acct := inst.InvestmentAccounts[0]
+	acct.Holdings = []plaid.Holding{{AccountId: "inv-acct-1", SecurityId: "sec-1", Quantity: 3}}
+	acct.Transactions = map[string]plaid.InvestmentTransaction{
+		"inv-txn-1": acct.Transactions["inv-txn-1"],
+		"inv-txn-2": {InvestmentTransactionId: "inv-txn-2", AccountId: "inv-acct-1", Amount: 20},
+	}
+	inst = inst.CreateOrUpdateInvestmentAccount(acct)
+
+	if err := store.SaveInvestmentInstitution("alice", inst); err != nil {
+		t.Fatalf("SaveInvestmentInstitution: %v", err)
+	}
+
+	loaded, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+
+	if txns := loaded[0].TransactionInstitutions[0].TransactionAccounts[0].Transactions; len(txns) != 2 {
+		t.Errorf("expected transaction institution untouched, got %+v", txns)
+	}
+	got, _ := loaded[0].InvestmentInstitution("broker-a")
+	if got.InstitutionBase.LastSyncedDate != "2024-06-01" {
+		t.Errorf("expected lastSyncedDate 2024-06-01, got %q", got.InstitutionBase.LastSyncedDate)
+	}
+	gotAcct, _ := got.InvestmentAccount("inv-acct-1")
+	if len(gotAcct.Holdings) != 1 || gotAcct.Holdings[0].Quantity != 3 {
+		t.Errorf("expected holdings replaced, got %+v", gotAcct.Holdings)
+	}
+	if len(gotAcct.Transactions) != 2 {
+		t.Errorf("expected 2 investment transactions, got %+v", gotAcct.Transactions)
+	}
+
+	// A transaction sync removed is deleted from the store too.
+	delete(acct.Transactions, "inv-txn-1")
+	if err := store.SaveInvestmentInstitution("alice", inst.CreateOrUpdateInvestmentAccount(acct)); err != nil {
+		t.Fatalf("SaveInvestmentInstitution: %v", err)
+	}
+	if loaded, err = store.LoadOwners(); err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	got, _ = loaded[0].InvestmentInstitution("broker-a")
+	gotAcct, _ = got.InvestmentAccount("inv-acct-1")
+	if _, ok := gotAcct.Transactions["inv-txn-2"]; !ok || len(gotAcct.Transactions) != 1 {
+		t.Errorf("expected only inv-txn-2 left, got %+v", gotAcct.Transactions)
+	}
+}
+
+func TestSQLiteStoreUpdateInstitutionBase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.DumpOwners(newTestOwners()); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+
+	base := types.InstitutionBase{Name: "bank-a", AccessToken: "tok-a", Cursor: "cur-9"}
+	if err := store.UpdateInstitutionBase("alice", types.InstitutionTypeTransaction, base); err != nil {
+		t.Fatalf("UpdateInstitutionBase: %v", err)
+	}
+
+	loaded, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+
+	inst, _ := loaded[0].TransactionInstitution("bank-a")
+	if inst.InstitutionBase.Cursor != "cur-9" || inst.InstitutionBase.NeedsUpdate {
+		t.Errorf("expected cursor cur-9 and needsUpdate cleared, got %+v", inst.InstitutionBase)
+	}
+	if len(inst.TransactionAccounts) != 1 || len(inst.TransactionAccounts[0].Transactions) != 2 {
+		t.Errorf("expected accounts untouched, got %+v", inst.TransactionAccounts)
+	}
+
+	base.Name = "missing"
+	if err := store.UpdateInstitutionBase("alice", types.InstitutionTypeTransaction, base); err == nil {
+		t.Errorf("expected error for unknown institution")
+	}
+}
+
+func TestSQLiteStoreAddInstitution(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.DumpOwners(newTestOwners()); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+
+	if err := store.AddInstitution("alice", types.InstitutionTypeTransaction, types.InstitutionBase{Name: "bank-b", AccessToken: "tok-b"}); err != nil {
+		t.Fatalf("AddInstitution: %v", err)
+	}
+	if err := store.AddInstitution("bob", types.InstitutionTypeInvestment, types.InstitutionBase{Name: "broker-b", AccessToken: "tok-inv-b"}); err != nil {
+		t.Fatalf("AddInstitution (new owner): %v", err)
+	}
+
+	loaded, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	alice, _ := types.GetOwner(loaded, "alice")
+	if inst, ok := alice.TransactionInstitution("bank-b"); !ok || inst.InstitutionBase.AccessToken != "tok-b" {
+		t.Errorf("expected bank-b with tok-b, got %+v", inst)
+	}
+	if inst, _ := alice.TransactionInstitution("bank-a"); len(inst.TransactionAccounts) != 1 {
+		t.Errorf("expected bank-a untouched, got %+v", inst)
+	}
+	bob, _ := types.GetOwner(loaded, "bob")
+	if inst, ok := bob.InvestmentInstitution("broker-b"); !ok || inst.InstitutionBase.AccessToken != "tok-inv-b" {
+		t.Errorf("expected broker-b for new owner bob, got %+v", bob)
+	}
+
+	if err := store.AddInstitution("alice", types.InstitutionTypeTransaction, types.InstitutionBase{Name: "bank-a", AccessToken: "tok-x"}); err == nil {
+		t.Errorf("expected error for existing institution")
+	}
+	loaded, err = store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	alice, _ = types.GetOwner(loaded, "alice")
+	if inst, _ := alice.TransactionInstitution("bank-a"); inst.InstitutionBase.AccessToken != "tok-a" {
+		t.Errorf("expected bank-a token kept, got %q", inst.InstitutionBase.AccessToken)
+	}
+}
+
+func TestSQLiteStoreBalanceSnapshots(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.DumpOwners(newTestOwners()); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+
+	current := float32(250)
+	bases := []plaid.AccountBase{{
+		AccountId: "acct-1",
+		Name:      "Checking",
+		Balances:  plaid.AccountBalance{Current: *plaid.NewNullableFloat32(&current)},
+	}}
+	first := types.NewBalanceSnapshots(bases, time.Date(2024, 3, 1, 9, 30, 0, 500, time.UTC))
+	second := types.NewBalanceSnapshots(bases, time.Date(2024, 3, 2, 9, 30, 0, 0, time.UTC))
+
+	// The same snapshot applied with every page is recorded once.
+	for _, page := range []types.TransactionSyncPage{
+		{AccountBases: bases, BalanceSnapshots: second, NextCursor: "cur-2"},
+		{AccountBases: bases, BalanceSnapshots: first, NextCursor: "cur-3"},
+		{AccountBases: bases, BalanceSnapshots: first, NextCursor: "cur-4"},
+	} {
+		if err := store.ApplyTransactionSyncPage("alice", "bank-a", page); err != nil {
+			t.Fatalf("ApplyTransactionSyncPage: %v", err)
+		}
+	}
+
+	loaded, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("LoadOwners: %v", err)
+	}
+	history := loaded[0].TransactionInstitutions[0].TransactionAccounts[0].BalanceHistory
+	if len(history) != 2 {
+		t.Fatalf("expected 2 snapshots, got %+v", history)
+	}
+	if !history[0].FetchedAt.Equal(first[0].FetchedAt) || !history[1].FetchedAt.Equal(second[0].FetchedAt) {
+		t.Errorf("expected snapshots oldest first, got %v and %v", history[0].FetchedAt, history[1].FetchedAt)
+	}
+	if history[0].AccountID != "acct-1" || history[0].Balances.GetCurrent() != 250 {
+		t.Errorf("unexpected snapshot %+v", history[0])
+	}
+
+	// Dumping what was loaded keeps the history; dropping the account
+	// drops its snapshots with it.
+	if err := store.DumpOwners(loaded); err != nil {
+		t.Fatalf("DumpOwners: %v", err)
+	}
+	loaded[0].TransactionInstitutions[0].TransactionAccounts = nil
+	if err := store.DumpOwners(loaded); err != nil {
+		t.Fatalf("DumpOwners without account: %v", err)
+	}
+	var count int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM balance_snapshots").Scan(&count); err != nil {
+		t.Fatalf("count snapshots: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("expected snapshots of the dropped account to be deleted, got %d", count)
+	}
+}
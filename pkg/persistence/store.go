@@ -9,34 +9,67 @@ import (
 // Store abstracts owner data persistence.
 type Store interface {
 	LoadOwners() ([]types.Owner, error)
+	// DumpOwners rewrites the store to match owners. It touches every row,
+	// so it is meant for whole-store copies such as migrate and
+	// encrypt-tokens; link and sync write through the narrower methods.
 	DumpOwners(owners []types.Owner) error
+	// AddInstitution creates an institution with no accounts yet, and its
+	// owner if needed. It fails if the institution already exists.
+	AddInstitution(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error
+	// ApplyTransactionSyncPage atomically records one /transactions/sync
+	// page and its next cursor for an existing transaction institution.
+	// JSONStore rewrites its whole file for every page.
+	ApplyTransactionSyncPage(ownerName, instName string, page types.TransactionSyncPage) error
+	// SaveInvestmentInstitution creates or updates one investment
+	// institution of an owner, leaving every other institution untouched.
+	SaveInvestmentInstitution(ownerName string, inst types.InvestmentInstitution) error
+	// UpdateInstitutionBase records the cursor, sync date and status of an
+	// existing institution without touching its accounts.
+	UpdateInstitutionBase(ownerName string, instType types.InstitutionType, base types.InstitutionBase) error
 	Close() error
 }
 
 // NewStoreWithBackend creates a Store for the given backend and optional path.
+// Access tokens are read and written verbatim, sealed or not, so stores can
+// be copied without the token key.
 func NewStoreWithBackend(backend, path string) (Store, error) {
-	return NewStore(types.StorageConfig{Backend: backend, Path: path})
+	return newBackendStore(types.StorageConfig{Backend: backend, Path: path})
 }
 
-// NewStore creates a Store based on the storage configuration.
+// NewStore creates a Store based on the storage configuration. Access tokens
+// are sealed at rest when cfg.Encryption names a key.
 func NewStore(cfg types.StorageConfig) (Store, error) {
+	sealer, err := NewTokenSealer(cfg.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token encryption key: %w", err)
+	}
+
+	store, err := newBackendStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if sealer == nil {
+		return &plaintextStore{Store: store}, nil
+	}
+	return &encryptedStore{Store: store, sealer: sealer}, nil
+}
+
+func newBackendStore(cfg types.StorageConfig) (Store, error) {
 	backend := cfg.Backend
 	if backend == "" {
 		backend = "json" // default to json for backward compatibility
 	}
 
+	path := cfg.Path
+	if path == "" {
+		path = DefaultStoreFile(backend)
+	}
+
 	switch backend {
 	case "json":
-		path := cfg.Path
-		if path == "" {
-			path = DefaultOwnerPath
-		}
 		return NewJSONStore(path), nil
 	case "sqlite":
-		path := cfg.Path
-		if path == "" {
-			path = DefaultSQLitePath
-		}
 		return NewSQLiteStore(path)
 	default:
 		return nil, fmt.Errorf("unknown storage backend: %s", backend)
@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -9,35 +10,71 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// ownersFileVersion is the layout of the owners file DumpOwners writes.
+// Files from before it was recorded hold a bare list of owners and count as
+// version 1; their investment accounts may still share every transaction
+// and security of their institution.
+const ownersFileVersion = 2
+
+type ownersFile struct {
+	Version int           `json:"version"`
+	Owners  []types.Owner `json:"owners"`
+}
+
 func DumpOwners(path string, owners []types.Owner) error {
-	data, err := json.MarshalIndent(owners, "", "  ")
+	data, err := json.MarshalIndent(ownersFile{Version: ownersFileVersion, Owners: owners}, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal txns: %w", err)
 	}
 
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	// Write to a sibling file and rename it over path, so readers never see
+	// a partially written file.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
 	}
 
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
 	return nil
 }
 
 func LoadOwners(path string) ([]types.Owner, error) {
+	owners, _, err := loadOwnersFile(path)
+	return owners, err
+}
+
+// loadOwnersFile reads the owners file at path along with the version of
+// its layout. A missing file reads as no owners in the current layout.
+func loadOwnersFile(path string) ([]types.Owner, int, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return []types.Owner{}, nil
+		return []types.Owner{}, ownersFileVersion, nil
 	}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read txn db file: %w", err)
+		return nil, 0, fmt.Errorf("failed to read txn db file: %w", err)
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		owners := []types.Owner{}
+		if err := json.Unmarshal(data, &owners); err != nil {
+			return nil, 0, fmt.Errorf("failed to unmarshal data: %w", err)
+		}
+		return owners, 1, nil
 	}
 
-	owners := []types.Owner{}
-	if err := json.Unmarshal(data, &owners); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal data: %w", err)
+	file := ownersFile{Owners: []types.Owner{}}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal data: %w", err)
+	}
+	if file.Version > ownersFileVersion {
+		return nil, 0, fmt.Errorf("owners file version %d is newer than the supported version %d; upgrade bean-auto", file.Version, ownersFileVersion)
 	}
 
-	return owners, nil
+	return file.Owners, file.Version, nil
 }
 
 func DumpConfig(path string, config types.Config) error {
@@ -63,6 +100,9 @@ func LoadConfig(path string) (types.Config, error) {
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return config, fmt.Errorf("failed to load config: %w", err)
 	}
+	if err := config.Postprocess.Compile(); err != nil {
+		return config, err
+	}
 
 	return config, nil
 }
@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/plaid/plaid-go/plaid"
+)
+
+// errorCodeItemLoginRequired is returned by Plaid when an item must go
+// through Link update mode before it can be used again.
+const errorCodeItemLoginRequired = "ITEM_LOGIN_REQUIRED"
+
+// errorCodeMutationDuringPagination is returned by /transactions/sync when
+// the item changed mid-pagination; the loop must restart from its first
+// cursor.
+const errorCodeMutationDuringPagination = "TRANSACTIONS_SYNC_MUTATION_DURING_PAGINATION"
+
+// PlaidError is the structured form of an error response from the Plaid API.
+type PlaidError struct {
+	Type      string `json:"error_type"`
+	Code      string `json:"error_code"`
+	Message   string `json:"error_message"`
+	RequestID string `json:"request_id"`
+
+	err error
+}
+
+func (e *PlaidError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Code, e.Message, e.err)
+}
+
+func (e *PlaidError) Unwrap() error {
+	return e.err
+}
+
+// decodePlaidError turns the body of a plaid.GenericOpenAPIError into a
+// *PlaidError. Other errors, and bodies that are not Plaid errors, are
+// returned unchanged.
+func decodePlaidError(err error) error {
+	var apiErr plaid.GenericOpenAPIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	plaidErr := &PlaidError{err: err}
+	if json.Unmarshal(apiErr.Body(), plaidErr) != nil || plaidErr.Code == "" {
+		return err
+	}
+	return plaidErr
+}
+
+// needsUpdateMode reports whether err means the institution has to be
+// relinked before it can sync again.
+func needsUpdateMode(err error) bool {
+	var plaidErr *PlaidError
+	return errors.As(err, &plaidErr) && plaidErr.Code == errorCodeItemLoginRequired
+}
+
+func isMutationDuringPagination(err error) bool {
+	var plaidErr *PlaidError
+	return errors.As(err, &plaidErr) && plaidErr.Code == errorCodeMutationDuringPagination
+}
@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+// pageBuffer keeps the pages of one /transactions/sync pagination loop and
+// the state every transaction they touched had before the loop started, so
+// the loop can be undone.
+type pageBuffer struct {
+	pages []types.TransactionSyncPage
+	// originals maps each touched transaction id to its version before the
+	// loop, or nil if it did not exist.
+	originals map[string]*plaid.Transaction
+}
+
+func newPageBuffer() *pageBuffer {
+	return &pageBuffer{originals: map[string]*plaid.Transaction{}}
+}
+
+// add records page, which is about to be applied to inst.
+func (b *pageBuffer) add(inst types.TransactionInstitution, page types.TransactionSyncPage) {
+	remember := func(id string) {
+		if _, ok := b.originals[id]; ok {
+			return
+		}
+		b.originals[id] = findTransaction(inst, id)
+	}
+
+	for _, txn := range page.Added {
+		remember(txn.TransactionId)
+	}
+	for _, txn := range page.Modified {
+		remember(txn.TransactionId)
+	}
+	for _, id := range page.Removed {
+		remember(id)
+	}
+
+	b.pages = append(b.pages, page)
+}
+
+func (b *pageBuffer) counts() syncCounts {
+	var counts syncCounts
+	for _, page := range b.pages {
+		counts.added += len(page.Added)
+		counts.modified += len(page.Modified)
+		counts.removed += len(page.Removed)
+	}
+	return counts
+}
+
+// rollbackPage returns a page that restores every buffered transaction to
+// its original state and resets the cursor to startCursor.
+func (b *pageBuffer) rollbackPage(accountBases []plaid.AccountBase, startCursor string) types.TransactionSyncPage {
+	page := types.TransactionSyncPage{
+		AccountBases: accountBases,
+		NextCursor:   startCursor,
+	}
+
+	for id, original := range b.originals {
+		if original == nil {
+			page.Removed = append(page.Removed, id)
+		} else {
+			page.Added = append(page.Added, *original)
+		}
+	}
+
+	return page
+}
+
+func findTransaction(inst types.TransactionInstitution, id string) *plaid.Transaction {
+	for _, account := range inst.TransactionAccounts {
+		if txn, ok := account.Transactions[id]; ok {
+			return &txn
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/xiaomi388/beancount-automation/pkg/types"
+)
+
+type syncCounts struct {
+	added    int
+	modified int
+	removed  int
+}
+
+// institutionResult records the outcome of syncing one institution.
+type institutionResult struct {
+	owner       string
+	institution string
+	instType    types.InstitutionType
+	counts      syncCounts
+	err         error
+}
+
+func (r institutionResult) status() string {
+	if needsUpdateMode(r.err) {
+		return "RELINK"
+	}
+	if r.err != nil {
+		return "FAILED"
+	}
+	return "OK"
+}
+
+func countFailed(results []institutionResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+func countNeedsUpdate(results []institutionResult) int {
+	n := 0
+	for _, r := range results {
+		if needsUpdateMode(r.err) {
+			n++
+		}
+	}
+	return n
+}
+
+func writeReport(w io.Writer, results []institutionResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OWNER\tINSTITUTION\tTYPE\tSTATUS\tADDED\tMODIFIED\tREMOVED\tERROR")
+	for _, r := range results {
+		errMsg := ""
+		if r.err != nil {
+			errMsg = r.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			r.owner, r.institution, r.instType, r.status(),
+			r.counts.added, r.counts.modified, r.counts.removed, errMsg)
+	}
+	return tw.Flush()
+}
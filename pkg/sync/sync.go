@@ -2,41 +2,74 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"reflect"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
 	"github.com/xiaomi388/beancount-automation/pkg/persistence"
 	"github.com/xiaomi388/beancount-automation/pkg/plaidclient"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
+const (
+	dateLayout = "2006-01-02"
+
+	// investmentHistoryStartDate is the earliest date requested when an
+	// institution has never been synced.
+	investmentHistoryStartDate = "2020-01-01"
+	// investmentSyncOverlapDays is how far before the last synced date each
+	// run re-pulls investment transactions.
+	investmentSyncOverlapDays = 30
+	// investmentTransactionsPageSize is the maximum count Plaid accepts.
+	investmentTransactionsPageSize = 500
+
+	// maxPaginationAttempts bounds how often a /transactions/sync loop is
+	// restarted after TRANSACTIONS_SYNC_MUTATION_DURING_PAGINATION.
+	maxPaginationAttempts = 3
+	// paginationRetryBackoff is multiplied by the attempt number between
+	// restarts.
+	paginationRetryBackoff = 2 * time.Second
+)
+
+var (
+	nowFn       = time.Now
+	sleepFn     = time.Sleep
+	openStoreFn = (*app.Context).OpenStore
+)
+
 func getTransactionAccounts(ctx context.Context, cli *plaid.APIClient, inst types.InstitutionBase) ([]plaid.AccountBase, error) {
 	accountsGetRequest := plaid.NewAccountsGetRequest(inst.AccessToken)
 	accountsGetResp, httpResp, err := cli.PlaidApi.AccountsGet(ctx).AccountsGetRequest(
 		*accountsGetRequest,
 	).Execute()
 	if err != nil {
-		logrus.Debug(httpResp.Body)
-		return nil, fmt.Errorf("failed to execute account request: %w", err)
+		if httpResp != nil {
+			logrus.Debug(httpResp.Body)
+		}
+		return nil, fmt.Errorf("failed to execute account request: %w", decodePlaidError(err))
 	}
 
 	return accountsGetResp.GetAccounts(), nil
 }
 
-func Sync() error {
+func Sync(appCtx *app.Context) error {
 	ctx := context.Background()
-	cfg, err := persistence.LoadConfig(persistence.DefaultConfigPath)
+	cfg, err := appCtx.PlaidConfig()
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return err
 	}
 
 	cli := plaidclient.New(cfg.ClientID, cfg.Secret, cfg.Environment)
 
-	store, err := persistence.NewStore(cfg.Storage)
+	store, err := openStoreFn(appCtx)
 	if err != nil {
-		return fmt.Errorf("failed to create store: %w", err)
+		return err
 	}
 	defer store.Close()
 
@@ -45,166 +78,347 @@ func Sync() error {
 		return fmt.Errorf("failed to load owners: %w", err)
 	}
 
+	var results []institutionResult
 	for _, owner := range owners {
 		for _, inst := range owner.TransactionInstitutions {
-			accountBases, err := getTransactionAccounts(ctx, cli, inst.InstitutionBase)
-			if err != nil {
-				return fmt.Errorf("failed to get accounts for %s:%s: %w", owner.Name, inst.InstitutionBase.Name, err)
+			// Pages committed before a failure are already in the store, and
+			// a loop restarted on mutation is undone there too, so synced
+			// matches what is stored either way.
+			synced, result := syncTransactionInstitution(ctx, cli, store, owner.Name, inst)
+
+			synced.InstitutionBase.NeedsUpdate = needsUpdateMode(result.err)
+			if err := store.UpdateInstitutionBase(owner.Name, types.InstitutionTypeTransaction, synced.InstitutionBase); err != nil {
+				result.err = errors.Join(result.err, fmt.Errorf("failed to save: %w", err))
 			}
-			inst = inst.CreateOrUpdateTransactionAccountBases(accountBases)
-			if inst, err = syncTransactions(ctx, cli, inst); err != nil {
-				return fmt.Errorf("failed to sync transactions: %w", err)
+			if result.err != nil {
+				logrus.Errorf("failed to sync %s:%s: %v", owner.Name, inst.InstitutionBase.Name, result.err)
 			}
-
-			owner = owner.CreateOrUpdateTransactionInstitution(inst)
+			results = append(results, result)
 		}
 
 		for _, inst := range owner.InvestmentInstitutions {
-			if inst, err = syncInvestmentHoldings(ctx, cli, inst); err != nil {
-				return fmt.Errorf("failed to sync holdings: %w", err)
-			}
+			synced, result := syncInvestmentInstitution(ctx, cli, owner.Name, inst)
 
-			if inst, err = syncInvestmentTransactions(ctx, cli, inst); err != nil {
-				return fmt.Errorf("failed to sync transactions: %w", err)
+			if result.err == nil {
+				synced.InstitutionBase.NeedsUpdate = false
+				if err := store.SaveInvestmentInstitution(owner.Name, synced); err != nil {
+					result.err = fmt.Errorf("failed to save: %w", err)
+				}
+			} else if needsUpdateMode(result.err) {
+				inst.InstitutionBase.NeedsUpdate = true
+				if err := store.UpdateInstitutionBase(owner.Name, types.InstitutionTypeInvestment, inst.InstitutionBase); err != nil {
+					result.err = errors.Join(result.err, fmt.Errorf("failed to save: %w", err))
+				}
 			}
-
-			owner = owner.CreateOrUpdateInvestmentInstitution(inst)
+			if result.err != nil {
+				logrus.Errorf("failed to sync %s:%s: %v", owner.Name, inst.InstitutionBase.Name, result.err)
+			}
+			results = append(results, result)
 		}
+	}
 
-		types.CreateOrUpdateOwner(owners, owner)
+	if err := writeReport(os.Stdout, results); err != nil {
+		return fmt.Errorf("failed to write sync report: %w", err)
 	}
 
-	if err := store.DumpOwners(owners); err != nil {
-		return fmt.Errorf("failed to dump owners: %w", err)
+	if failed := countFailed(results); failed > 0 {
+		if countNeedsUpdate(results) > 0 {
+			fmt.Println("Some institutions need to be relinked; run: bean-auto relink --pending")
+		}
+		return fmt.Errorf("failed to sync %d of %d institutions", failed, len(results))
 	}
 	fmt.Println("Successfully synced all data.")
 	return nil
 }
 
-func syncTransactions(ctx context.Context, cli *plaid.APIClient, inst types.TransactionInstitution) (types.TransactionInstitution, error) {
+func syncTransactionInstitution(ctx context.Context, cli *plaid.APIClient, store persistence.Store, ownerName string, inst types.TransactionInstitution) (types.TransactionInstitution, institutionResult) {
+	result := institutionResult{
+		owner:       ownerName,
+		institution: inst.InstitutionBase.Name,
+		instType:    types.InstitutionTypeTransaction,
+	}
+
+	fetchedAt := nowFn()
+	accountBases, err := getTransactionAccounts(ctx, cli, inst.InstitutionBase)
+	if err != nil {
+		result.err = fmt.Errorf("failed to get accounts: %w", err)
+		return inst, result
+	}
+	inst = inst.CreateOrUpdateTransactionAccountBases(accountBases)
+	snapshots := types.NewBalanceSnapshots(accountBases, fetchedAt)
+
+	if inst, result.counts, err = syncTransactions(ctx, cli, store, ownerName, inst, snapshots); err != nil {
+		result.err = fmt.Errorf("failed to sync transactions: %w", err)
+	}
+	return inst, result
+}
+
+func syncInvestmentInstitution(ctx context.Context, cli *plaid.APIClient, ownerName string, inst types.InvestmentInstitution) (types.InvestmentInstitution, institutionResult) {
+	result := institutionResult{
+		owner:       ownerName,
+		institution: inst.InstitutionBase.Name,
+		instType:    types.InstitutionTypeInvestment,
+	}
+
+	var err error
+	if inst, err = syncInvestmentHoldings(ctx, cli, inst); err != nil {
+		result.err = fmt.Errorf("failed to sync holdings: %w", err)
+		return inst, result
+	}
+
+	if inst, result.counts, err = syncInvestmentTransactions(ctx, cli, inst); err != nil {
+		result.err = fmt.Errorf("failed to sync transactions: %w", err)
+	}
+	return inst, result
+}
+
+// syncTransactions pages through /transactions/sync, committing every page
+// and its cursor to the store before requesting the next one.
+//
+// On TRANSACTIONS_SYNC_MUTATION_DURING_PAGINATION, Plaid requires the loop
+// to restart from the cursor it began with, so the pages committed since it
+// started are undone and it is retried a bounded number of times. On any
+// other error the committed pages and cursor are kept, so the next run
+// resumes from the last page that was stored.
+//
+// snapshots are the balances fetched along with the accounts; they are
+// committed with every page, so they are stored once any page is.
+func syncTransactions(ctx context.Context, cli *plaid.APIClient, store persistence.Store, ownerName string, inst types.TransactionInstitution, snapshots []types.BalanceSnapshot) (types.TransactionInstitution, syncCounts, error) {
+	accountBases := make([]plaid.AccountBase, 0, len(inst.TransactionAccounts))
+	for _, account := range inst.TransactionAccounts {
+		accountBases = append(accountBases, account.AccoutBase)
+	}
+
+	startCursor := inst.InstitutionBase.Cursor
+	for attempt := 1; ; attempt++ {
+		buf := newPageBuffer()
+		var err error
+		inst, err = syncTransactionPages(ctx, cli, store, ownerName, inst, accountBases, snapshots, buf)
+		if err == nil || !isMutationDuringPagination(err) {
+			return inst, buf.counts(), err
+		}
+
+		rollback := buf.rollbackPage(accountBases, startCursor)
+		if err := store.ApplyTransactionSyncPage(ownerName, inst.InstitutionBase.Name, rollback); err != nil {
+			return inst, buf.counts(), fmt.Errorf("failed to discard sync pages: %w", err)
+		}
+		inst = inst.ApplyTransactionSyncPage(rollback)
+
+		if attempt >= maxPaginationAttempts {
+			return inst, syncCounts{}, err
+		}
+
+		logrus.Warnf("transactions changed while paginating %s:%s, restarting (attempt %d/%d)",
+			ownerName, inst.InstitutionBase.Name, attempt+1, maxPaginationAttempts)
+		sleepFn(time.Duration(attempt) * paginationRetryBackoff)
+	}
+}
+
+func syncTransactionPages(ctx context.Context, cli *plaid.APIClient, store persistence.Store, ownerName string, inst types.TransactionInstitution, accountBases []plaid.AccountBase, snapshots []types.BalanceSnapshot, buf *pageBuffer) (types.TransactionInstitution, error) {
 	hasMore := true
-	cursor := inst.InstitutionBase.Cursor
 	for hasMore {
 		request := plaid.NewTransactionsSyncRequest(inst.InstitutionBase.AccessToken)
 		if inst.InstitutionBase.Cursor != "" {
-			request.SetCursor(cursor)
+			request.SetCursor(inst.InstitutionBase.Cursor)
 		}
 		resp, _, err := cli.PlaidApi.TransactionsSync(
 			ctx,
 		).TransactionsSyncRequest(*request).Execute()
 
 		if err != nil {
-			return types.TransactionInstitution{}, fmt.Errorf("failed to execute sync request: %w", err)
+			return inst, fmt.Errorf("failed to execute sync request: %w", decodePlaidError(err))
 		}
 
-		for _, txn := range resp.GetAdded() {
-			account, ok := inst.TransactionAccount(txn.AccountId)
-			if !ok {
-				continue
-			}
-
-			account.Transactions[txn.TransactionId] = txn
-			inst = inst.CreateOrUpdateTransactionAccount(account)
+		page := transactionSyncPage(inst, accountBases, resp)
+		page.BalanceSnapshots = snapshots
+		if err := store.ApplyTransactionSyncPage(ownerName, inst.InstitutionBase.Name, page); err != nil {
+			return inst, fmt.Errorf("failed to save sync page: %w", err)
 		}
 
-		for _, txn := range resp.GetModified() {
-			account, ok := inst.TransactionAccount(txn.AccountId)
-			if !ok {
-				continue
-			}
-
-			account.Transactions[txn.TransactionId] = txn
-			inst = inst.CreateOrUpdateTransactionAccount(account)
-		}
-
-		for _, txn := range resp.GetRemoved() {
-			for _, account := range inst.TransactionAccounts {
-				if _, ok := account.Transactions[*txn.TransactionId]; ok {
-					delete(account.Transactions, *txn.TransactionId)
-					inst = inst.CreateOrUpdateTransactionAccount(account)
-					break
-				}
-			}
-		}
+		buf.add(inst, page)
+		inst = inst.ApplyTransactionSyncPage(page)
 
 		hasMore = resp.GetHasMore()
-
-		// Update cursor to the next cursor and inst and dump the inst.
-		cursor = resp.GetNextCursor()
-		inst.InstitutionBase.Cursor = cursor
 	}
 
 	return inst, nil
 }
 
-func syncInvestmentTransactions(ctx context.Context, cli *plaid.APIClient, inst types.InvestmentInstitution) (types.InvestmentInstitution, error) {
-	// Create a request for investment transactions
-	req := plaid.NewInvestmentsTransactionsGetRequest(inst.InstitutionBase.AccessToken, "2020-01-01", "2999-01-01")
-
-	// Execute the request
-	resp, httpResp, err := cli.PlaidApi.InvestmentsTransactionsGet(ctx).InvestmentsTransactionsGetRequest(*req).Execute()
-	if err != nil {
-		return types.InvestmentInstitution{}, fmt.Errorf("failed to execute transaction get request: %w: %s", err, httpResp.Body)
+// transactionSyncPage keeps the parts of a sync response that apply to inst:
+// changes to accounts it knows and removals of transactions it holds.
+func transactionSyncPage(inst types.TransactionInstitution, accountBases []plaid.AccountBase, resp plaid.TransactionsSyncResponse) types.TransactionSyncPage {
+	page := types.TransactionSyncPage{
+		AccountBases: accountBases,
+		NextCursor:   resp.GetNextCursor(),
 	}
 
-	// Update the institution with account bases
-	accountBases := resp.GetAccounts()
-	inst = inst.CreateOrUpdateInvestmentAccountBases(accountBases)
-
-	// Map to store transactions
-	transactions := map[string]plaid.InvestmentTransaction{}
+	for _, txn := range resp.GetAdded() {
+		if _, ok := inst.TransactionAccount(txn.AccountId); ok {
+			page.Added = append(page.Added, txn)
+		}
+	}
 
-	// Iterate over the transactions and store them
-	for _, t := range resp.GetInvestmentTransactions() {
-		transactions[t.InvestmentTransactionId] = t
+	for _, txn := range resp.GetModified() {
+		if _, ok := inst.TransactionAccount(txn.AccountId); ok {
+			page.Modified = append(page.Modified, txn)
+		}
 	}
 
-	// Update each account with its transactions
-	for _, account := range inst.InvestmentAccounts {
-		account.Transactions = transactions
-		inst = inst.CreateOrUpdateInvestmentAccount(account)
+	for _, txn := range resp.GetRemoved() {
+		id := txn.GetTransactionId()
+		for _, account := range inst.TransactionAccounts {
+			if _, ok := account.Transactions[id]; ok {
+				page.Removed = append(page.Removed, id)
+				break
+			}
+		}
 	}
 
-	return inst, nil
+	return page
 }
 
-func syncInvestmentHoldings(ctx context.Context, cli *plaid.APIClient, inst types.InvestmentInstitution) (types.InvestmentInstitution, error) {
-	accountIDToHoldings := map[string][]plaid.Holding{}
-	securities := map[string]plaid.Security{}
-	transactions := map[string]plaid.InvestmentTransaction{}
+func syncInvestmentTransactions(ctx context.Context, cli *plaid.APIClient, inst types.InvestmentInstitution) (types.InvestmentInstitution, syncCounts, error) {
+	var counts syncCounts
+	endDate := nowFn().Format(dateLayout)
+	startDate := investmentSyncStartDate(inst.InstitutionBase)
 
-	{
-		req := plaid.NewInvestmentsHoldingsGetRequest(inst.InstitutionBase.AccessToken)
-		resp, httpResp, err := cli.PlaidApi.InvestmentsHoldingsGet(ctx).InvestmentsHoldingsGetRequest(*req).Execute()
+	securities := map[string]plaid.Security{}
+	covered := map[string]bool{}
+	fetched := map[string]bool{}
+
+	var offset, total int32
+	for {
+		req := plaid.NewInvestmentsTransactionsGetRequest(inst.InstitutionBase.AccessToken, startDate, endDate)
+		req.SetOptions(plaid.InvestmentsTransactionsGetRequestOptions{
+			Count:  plaid.PtrInt32(investmentTransactionsPageSize),
+			Offset: plaid.PtrInt32(offset),
+		})
+
+		resp, _, err := cli.PlaidApi.InvestmentsTransactionsGet(ctx).InvestmentsTransactionsGetRequest(*req).Execute()
 		if err != nil {
-			return types.InvestmentInstitution{}, fmt.Errorf("failed to execute get request: %w: %s", err, httpResp.Body)
+			return types.InvestmentInstitution{}, syncCounts{}, fmt.Errorf("failed to execute transaction get request: %w", decodePlaidError(err))
 		}
 
-		accountBases := resp.GetAccounts()
-		inst = inst.CreateOrUpdateInvestmentAccountBases(accountBases)
+		inst = inst.CreateOrUpdateInvestmentAccountBases(resp.GetAccounts())
+		for _, a := range resp.GetAccounts() {
+			covered[a.AccountId] = true
+		}
 
 		for _, s := range resp.GetSecurities() {
 			securities[s.SecurityId] = s
 		}
 
-		for _, h := range resp.GetHoldings() {
-			accountIDToHoldings[h.AccountId] = append(accountIDToHoldings[h.AccountId], h)
+		// Merge the fetched window into what is already stored, so history
+		// older than the overlap window is kept. Each transaction belongs
+		// to the account it posted against only.
+		page := resp.GetInvestmentTransactions()
+		for _, t := range page {
+			fetched[t.InvestmentTransactionId] = true
+			account, ok := inst.InvestmentAccount(t.AccountId)
+			if !ok {
+				continue
+			}
+
+			if account.Transactions == nil {
+				account.Transactions = map[string]plaid.InvestmentTransaction{}
+			}
+			// Transactions fetched again from the overlap window only
+			// count when Plaid changed them.
+			if stored, ok := account.Transactions[t.InvestmentTransactionId]; !ok {
+				counts.added++
+			} else if !sameInvestmentTransaction(stored, t) {
+				counts.modified++
+			}
+			account.Transactions[t.InvestmentTransactionId] = t
+			if s, ok := securities[t.GetSecurityId()]; ok {
+				if account.Securities == nil {
+					account.Securities = map[string]plaid.Security{}
+				}
+				account.Securities[s.SecurityId] = s
+			}
+			inst = inst.CreateOrUpdateInvestmentAccount(account)
+		}
+
+		offset += int32(len(page))
+		total = resp.GetTotalInvestmentTransactions()
+		if len(page) == 0 || offset >= total {
+			break
 		}
 	}
 
-	{
-		req := plaid.NewInvestmentsTransactionsGetRequest(inst.InstitutionBase.AccessToken, "2020-01-01", "2999-01-01")
-		resp, httpResp, err := cli.PlaidApi.InvestmentsTransactionsGet(ctx).InvestmentsTransactionsGetRequest(*req).Execute()
-		if err != nil {
-			return types.InvestmentInstitution{}, fmt.Errorf("failed to execute transaction get request: %w: %s", err, httpResp.Body)
+	// The response lists every transaction of the covered accounts in
+	// [startDate, endDate], so stored ones it no longer has were removed.
+	// A short read proves nothing and removes nothing.
+	for _, account := range inst.InvestmentAccounts {
+		if offset < total || !covered[account.AccoutBase.AccountId] {
+			continue
 		}
+		for id, t := range account.Transactions {
+			if !fetched[id] && t.Date >= startDate && t.Date <= endDate {
+				delete(account.Transactions, id)
+				counts.removed++
+			}
+		}
+	}
 
-		accountBases := resp.GetAccounts()
-		inst = inst.CreateOrUpdateInvestmentAccountBases(accountBases)
+	inst.InstitutionBase.LastSyncedDate = endDate
+	return inst, counts, nil
+}
 
-		for _, t := range resp.GetInvestmentTransactions() {
-			transactions[t.InvestmentTransactionId] = t
-		}
+// sameInvestmentTransaction reports whether a stored transaction is the one
+// Plaid returned again. Stores may load empty AdditionalProperties as nil.
+func sameInvestmentTransaction(a, b plaid.InvestmentTransaction) bool {
+	if len(a.AdditionalProperties) == 0 {
+		a.AdditionalProperties = nil
+	}
+	if len(b.AdditionalProperties) == 0 {
+		b.AdditionalProperties = nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// investmentSyncStartDate returns the first date to request investment
+// transactions from: the stored watermark minus an overlap window, so late
+// postings and corrections are picked up again.
+func investmentSyncStartDate(inst types.InstitutionBase) string {
+	if inst.LastSyncedDate == "" {
+		return investmentHistoryStartDate
+	}
+
+	last, err := time.Parse(dateLayout, inst.LastSyncedDate)
+	if err != nil {
+		logrus.Warnf("ignoring invalid last synced date %q for %s: %v", inst.LastSyncedDate, inst.Name, err)
+		return investmentHistoryStartDate
+	}
+
+	start := last.AddDate(0, 0, -investmentSyncOverlapDays).Format(dateLayout)
+	if start < investmentHistoryStartDate {
+		return investmentHistoryStartDate
+	}
+	return start
+}
+
+func syncInvestmentHoldings(ctx context.Context, cli *plaid.APIClient, inst types.InvestmentInstitution) (types.InvestmentInstitution, error) {
+	accountIDToHoldings := map[string][]plaid.Holding{}
+	securities := map[string]plaid.Security{}
+
+	fetchedAt := nowFn()
+	req := plaid.NewInvestmentsHoldingsGetRequest(inst.InstitutionBase.AccessToken)
+	resp, _, err := cli.PlaidApi.InvestmentsHoldingsGet(ctx).InvestmentsHoldingsGetRequest(*req).Execute()
+	if err != nil {
+		return types.InvestmentInstitution{}, fmt.Errorf("failed to execute get request: %w", decodePlaidError(err))
+	}
+
+	accountBases := resp.GetAccounts()
+	inst = inst.CreateOrUpdateInvestmentAccountBases(accountBases)
+	inst = inst.AddBalanceSnapshots(types.NewBalanceSnapshots(accountBases, fetchedAt))
+
+	for _, s := range resp.GetSecurities() {
+		securities[s.SecurityId] = s
+	}
+
+	for _, h := range resp.GetHoldings() {
+		accountIDToHoldings[h.AccountId] = append(accountIDToHoldings[h.AccountId], h)
 	}
 
 	for accountID, holdings := range accountIDToHoldings {
@@ -214,8 +428,14 @@ func syncInvestmentHoldings(ctx context.Context, cli *plaid.APIClient, inst type
 		}
 
 		account.Holdings = holdings
-		account.Securities = securities
-		account.Transactions = transactions
+		if account.Securities == nil {
+			account.Securities = map[string]plaid.Security{}
+		}
+		for _, h := range holdings {
+			if s, ok := securities[h.SecurityId]; ok {
+				account.Securities[s.SecurityId] = s
+			}
+		}
 		inst = inst.CreateOrUpdateInvestmentAccount(account)
 	}
 
@@ -1,49 +1,32 @@
 package sync
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/plaid/plaid-go/plaid"
+	"github.com/xiaomi388/beancount-automation/pkg/app"
+	"github.com/xiaomi388/beancount-automation/pkg/persistence"
 	"github.com/xiaomi388/beancount-automation/pkg/plaidclient"
 	"github.com/xiaomi388/beancount-automation/pkg/types"
 )
 
 func TestSyncUpdatesTransactionInstitutionIntegration(t *testing.T) {
-	origDir, err := os.Getwd()
-	if err != nil {
-		t.Fatalf("failed to get wd: %v", err)
-	}
+	tempDir := setupSyncTest(t, newPlaidTestMux(t))
+	copySyncTestFile(t, filepath.Join(testdataDir, "owners.yaml"), filepath.Join(tempDir, "owners.yaml"))
 
-	server := newPlaidTestServer(t, origDir)
-	defer server.Close()
-
-	origEnv, ok := plaidclient.Environment("Sandbox")
-	plaidclient.SetEnvironment("Sandbox", plaid.Environment(server.URL))
-	t.Cleanup(func() {
-		if ok {
-			plaidclient.SetEnvironment("Sandbox", origEnv)
-		}
-	})
-
-	tempDir := t.TempDir()
-	if err := os.Chdir(tempDir); err != nil {
-		t.Fatalf("failed to chdir: %v", err)
-	}
-	t.Cleanup(func() {
-		_ = os.Chdir(origDir)
-	})
-
-	copySyncTestFile(t, filepath.Join(origDir, "testdata", "config.yaml"), filepath.Join(tempDir, "config.yaml"))
-	copySyncTestFile(t, filepath.Join(origDir, "testdata", "owners.yaml"), filepath.Join(tempDir, "owners.yaml"))
-
-	if err := Sync(); err != nil {
+	if err := Sync(newSyncTestApp(t)); err != nil {
 		t.Fatalf("Sync returned error: %v", err)
 	}
 
@@ -52,7 +35,7 @@ func TestSyncUpdatesTransactionInstitutionIntegration(t *testing.T) {
 		t.Fatalf("failed to read owners: %v", err)
 	}
 
-	goldenPath := filepath.Join(origDir, "testdata", "owners_after_sync.json")
+	goldenPath := filepath.Join(testdataDir, "owners_after_sync.json")
 	if os.Getenv("UPDATE_SYNC_GOLDEN") == "1" {
 		if err := os.WriteFile(goldenPath, ownersData, 0644); err != nil {
 			t.Fatalf("failed to update golden file: %v", err)
@@ -66,11 +49,7 @@ func TestSyncUpdatesTransactionInstitutionIntegration(t *testing.T) {
 		t.Fatalf("owners.yaml mismatch golden file\n got: %s\nwant: %s", ownersData, goldenData)
 	}
 
-	var owners []types.Owner
-	if err := json.Unmarshal(ownersData, &owners); err != nil {
-		t.Fatalf("failed to unmarshal owners: %v", err)
-	}
-
+	owners := loadSyncTestOwners(t, tempDir)
 	if len(owners) != 1 {
 		t.Fatalf("expected 1 owner, got %d", len(owners))
 	}
@@ -98,6 +77,9 @@ func TestSyncUpdatesTransactionInstitutionIntegration(t *testing.T) {
 	if txn.Amount != 4.99 {
 		t.Fatalf("unexpected transaction amount: %v", txn.Amount)
 	}
+	if len(account.BalanceHistory) != 1 || !account.BalanceHistory[0].FetchedAt.Equal(nowFn()) {
+		t.Fatalf("expected one balance snapshot fetched at %v, got %+v", nowFn(), account.BalanceHistory)
+	}
 
 	invInst, ok := owners[0].InvestmentInstitution("mock-invest")
 	if !ok {
@@ -107,6 +89,9 @@ func TestSyncUpdatesTransactionInstitutionIntegration(t *testing.T) {
 	if !ok {
 		t.Fatalf("expected invest-account-1 to exist")
 	}
+	if len(invAccount.BalanceHistory) != 1 || invAccount.BalanceHistory[0].Balances.GetCurrent() != 1050.25 {
+		t.Fatalf("expected one investment balance snapshot, got %+v", invAccount.BalanceHistory)
+	}
 	if len(invAccount.Holdings) != 1 {
 		t.Fatalf("expected 1 holding, got %d", len(invAccount.Holdings))
 	}
@@ -134,6 +119,361 @@ func TestSyncUpdatesTransactionInstitutionIntegration(t *testing.T) {
 	if invTxn.Amount != -50.75 {
 		t.Fatalf("unexpected investment transaction amount: %v", invTxn.Amount)
 	}
+	if invInst.InstitutionBase.LastSyncedDate != "2024-06-01" {
+		t.Fatalf("expected last synced date 2024-06-01, got %q", invInst.InstitutionBase.LastSyncedDate)
+	}
+}
+
+func TestSyncInvestmentTransactionsPaginatesFromWatermark(t *testing.T) {
+	stubSyncNow(t)
+
+	var offsets []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			StartDate string `json:"start_date"`
+			EndDate   string `json:"end_date"`
+			Options   struct {
+				Offset int `json:"offset"`
+			} `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("failed to decode request: %v", err)
+		}
+		if req.StartDate != "2024-04-01" || req.EndDate != "2024-06-01" {
+			t.Fatalf("unexpected date range %s..%s", req.StartDate, req.EndDate)
+		}
+		offsets = append(offsets, req.Options.Offset)
+
+		id := fmt.Sprintf("inv-txn-page-%d", req.Options.Offset)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"accounts": [{"account_id": "invest-account-1", "name": "Brokerage", "type": "investment", "balances": {}}],
+			"investment_transactions": [{"investment_transaction_id": %q, "account_id": "invest-account-1", "date": "2024-05-01", "type": "cash", "subtype": "dividend"}],
+			"securities": [],
+			"total_investment_transactions": 2,
+			"request_id": "page"
+		}`, id)
+	}))
+	defer server.Close()
+
+	cli := plaidclient.New("client", "secret", server.URL)
+	inst := types.InvestmentInstitution{
+		InstitutionBase: types.InstitutionBase{
+			Name:           "mock-invest",
+			AccessToken:    "invest-token-456",
+			LastSyncedDate: "2024-05-01",
+		},
+		InvestmentAccounts: []types.InvestmentAccount{
+			{
+				AccoutBase: plaid.AccountBase{AccountId: "invest-account-1"},
+				Transactions: map[string]plaid.InvestmentTransaction{
+					"old-txn": {InvestmentTransactionId: "old-txn", AccountId: "invest-account-1", Date: "2023-01-01"},
+				},
+			},
+		},
+	}
+
+	inst, counts, err := syncInvestmentTransactions(context.Background(), cli, inst)
+	if err != nil {
+		t.Fatalf("syncInvestmentTransactions returned error: %v", err)
+	}
+
+	if counts.added != 2 || counts.modified != 0 {
+		t.Fatalf("expected 2 added and 0 modified, got %+v", counts)
+	}
+	if !reflect.DeepEqual(offsets, []int{0, 1}) {
+		t.Fatalf("expected offsets [0 1], got %v", offsets)
+	}
+	account, _ := inst.InvestmentAccount("invest-account-1")
+	for _, id := range []string{"old-txn", "inv-txn-page-0", "inv-txn-page-1"} {
+		if _, ok := account.Transactions[id]; !ok {
+			t.Fatalf("expected %s to be stored, got %v", id, account.Transactions)
+		}
+	}
+	if inst.InstitutionBase.LastSyncedDate != "2024-06-01" {
+		t.Fatalf("expected watermark 2024-06-01, got %q", inst.InstitutionBase.LastSyncedDate)
+	}
+}
+
+func TestSyncInvestmentTransactionsCountsOnlyChanges(t *testing.T) {
+	stubSyncNow(t)
+
+	const same = `{"investment_transaction_id": "same", "account_id": "invest-account-1", "date": "2024-05-01", "name": "Dividend", "amount": -5, "type": "cash", "subtype": "dividend"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"accounts": [{"account_id": "invest-account-1", "name": "Brokerage", "type": "investment", "balances": {}}],
+			"investment_transactions": [%s,
+				{"investment_transaction_id": "changed", "account_id": "invest-account-1", "date": "2024-05-02", "name": "Dividend", "amount": -7, "type": "cash", "subtype": "dividend"}],
+			"securities": [],
+			"total_investment_transactions": 2,
+			"request_id": "page"
+		}`, same)
+	}))
+	defer server.Close()
+
+	// The unchanged transaction is stored as a store loads it, without
+	// Plaid's AdditionalProperties.
+	var stored plaid.InvestmentTransaction
+	if err := json.Unmarshal([]byte(same), &stored); err != nil {
+		t.Fatalf("failed to unmarshal transaction: %v", err)
+	}
+	stored.AdditionalProperties = nil
+
+	inst := types.InvestmentInstitution{
+		InstitutionBase: types.InstitutionBase{Name: "mock-invest", AccessToken: "invest-token-456", LastSyncedDate: "2024-05-01"},
+		InvestmentAccounts: []types.InvestmentAccount{{
+			AccoutBase: plaid.AccountBase{AccountId: "invest-account-1"},
+			Transactions: map[string]plaid.InvestmentTransaction{
+				"same":    stored,
+				"changed": {InvestmentTransactionId: "changed", AccountId: "invest-account-1", Date: "2024-05-02", Name: "Dividend", Amount: -6},
+			},
+		}},
+	}
+
+	cli := plaidclient.New("client", "secret", server.URL)
+	inst, counts, err := syncInvestmentTransactions(context.Background(), cli, inst)
+	if err != nil {
+		t.Fatalf("syncInvestmentTransactions returned error: %v", err)
+	}
+	if counts.added != 0 || counts.modified != 1 {
+		t.Fatalf("expected 0 added and 1 modified, got %+v", counts)
+	}
+
+	if _, counts, err = syncInvestmentTransactions(context.Background(), cli, inst); err != nil {
+		t.Fatalf("syncInvestmentTransactions returned error: %v", err)
+	}
+	if counts != (syncCounts{}) {
+		t.Fatalf("expected a repeated sync to change nothing, got %+v", counts)
+	}
+}
+
+func TestSyncInvestmentTransactionsDropsRemovedInWindow(t *testing.T) {
+	stubSyncNow(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{
+			"accounts": [{"account_id": "invest-account-1", "name": "Brokerage", "type": "investment", "balances": {}}],
+			"investment_transactions": [{"investment_transaction_id": "kept", "account_id": "invest-account-1", "date": "2024-05-01", "type": "cash", "subtype": "dividend"}],
+			"securities": [],
+			"total_investment_transactions": 1,
+			"request_id": "page"
+		}`)
+	}))
+	defer server.Close()
+
+	txn := func(id, accountID, date string) plaid.InvestmentTransaction {
+		return plaid.InvestmentTransaction{InvestmentTransactionId: id, AccountId: accountID, Date: date}
+	}
+	inst := types.InvestmentInstitution{
+		InstitutionBase: types.InstitutionBase{Name: "mock-invest", AccessToken: "invest-token-456", LastSyncedDate: "2024-05-01"},
+		InvestmentAccounts: []types.InvestmentAccount{
+			{
+				AccoutBase: plaid.AccountBase{AccountId: "invest-account-1"},
+				Transactions: map[string]plaid.InvestmentTransaction{
+					"kept":      txn("kept", "invest-account-1", "2024-05-01"),
+					"cancelled": txn("cancelled", "invest-account-1", "2024-05-03"),
+					"history":   txn("history", "invest-account-1", "2023-01-01"),
+				},
+			},
+			{
+				// Not in the response, so its window is not known to be complete.
+				AccoutBase: plaid.AccountBase{AccountId: "invest-account-2"},
+				Transactions: map[string]plaid.InvestmentTransaction{
+					"other": txn("other", "invest-account-2", "2024-05-03"),
+				},
+			},
+		},
+	}
+
+	cli := plaidclient.New("client", "secret", server.URL)
+	inst, counts, err := syncInvestmentTransactions(context.Background(), cli, inst)
+	if err != nil {
+		t.Fatalf("syncInvestmentTransactions returned error: %v", err)
+	}
+	if counts.removed != 1 {
+		t.Fatalf("expected 1 removed, got %+v", counts)
+	}
+
+	account, _ := inst.InvestmentAccount("invest-account-1")
+	if _, ok := account.Transactions["cancelled"]; ok {
+		t.Errorf("expected cancelled to be removed, got %v", account.Transactions)
+	}
+	for _, id := range []string{"kept", "history"} {
+		if _, ok := account.Transactions[id]; !ok {
+			t.Errorf("expected %s to be kept, got %v", id, account.Transactions)
+		}
+	}
+	other, _ := inst.InvestmentAccount("invest-account-2")
+	if _, ok := other.Transactions["other"]; !ok {
+		t.Errorf("expected the uncovered account untouched, got %v", other.Transactions)
+	}
+}
+
+func TestSyncContinuesPastFailedInstitution(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accounts/get", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if req.AccessToken == "expired-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error_type": "ITEM_ERROR", "error_code": "ITEM_LOGIN_REQUIRED", "error_message": "the login details of this item have changed", "request_id": "failed"}`)
+			return
+		}
+		serveJSON(t, w, filepath.Join(testdataDir, "server_accounts_response.json"))
+	})
+	mux.HandleFunc("/transactions/sync", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		serveJSON(t, w, filepath.Join(testdataDir, "server_transactions_response.json"))
+	})
+	tempDir := setupSyncTest(t, mux)
+	writeSyncTestOwners(t, tempDir, `[{"name": "alice", "transactionInstitutions": [
+		{"institutionBase": {"name": "expired-bank", "accessToken": "expired-token", "cursor": ""}, "transactionAccounts": []},
+		{"institutionBase": {"name": "mock-bank", "accessToken": "token-123", "cursor": ""}, "transactionAccounts": []}
+	], "investmentInstitutions": []}]`)
+
+	if err := Sync(newSyncTestApp(t)); err == nil {
+		t.Fatalf("expected Sync to report the failed institution")
+	}
+
+	synced := loadSyncTestOwners(t, tempDir)
+	inst, ok := synced[0].TransactionInstitution("mock-bank")
+	if !ok || inst.InstitutionBase.Cursor != "cursor-1" {
+		t.Fatalf("expected mock-bank to be synced and persisted, got %+v", inst)
+	}
+	expired, ok := synced[0].TransactionInstitution("expired-bank")
+	if !ok || expired.InstitutionBase.Cursor != "" {
+		t.Fatalf("expected expired-bank to be left untouched, got %+v", expired)
+	}
+	if !expired.InstitutionBase.NeedsUpdate {
+		t.Fatalf("expected expired-bank to be flagged for update mode")
+	}
+	if inst.InstitutionBase.NeedsUpdate {
+		t.Fatalf("expected mock-bank not to be flagged for update mode")
+	}
+}
+
+// failingSaveStore fails to save the institution named failName.
+type failingSaveStore struct {
+	persistence.Store
+	failName string
+}
+
+func (s failingSaveStore) UpdateInstitutionBase(owner string, instType types.InstitutionType, inst types.InstitutionBase) error {
+	if inst.Name == s.failName {
+		return errors.New("disk full")
+	}
+	return s.Store.UpdateInstitutionBase(owner, instType, inst)
+}
+
+func TestSyncContinuesPastFailedSave(t *testing.T) {
+	tempDir := setupSyncTest(t, newPlaidTestMux(t))
+	origOpenStore := openStoreFn
+	openStoreFn = func(appCtx *app.Context) (persistence.Store, error) {
+		store, err := appCtx.OpenStore()
+		return failingSaveStore{Store: store, failName: "broken-bank"}, err
+	}
+	t.Cleanup(func() {
+		openStoreFn = origOpenStore
+	})
+	writeSyncTestOwners(t, tempDir, `[{"name": "alice", "transactionInstitutions": [
+		{"institutionBase": {"name": "broken-bank", "accessToken": "token-123", "cursor": ""}, "transactionAccounts": []}
+	], "investmentInstitutions": []},
+	{"name": "bob", "transactionInstitutions": [
+		{"institutionBase": {"name": "mock-bank", "accessToken": "token-123", "cursor": ""}, "transactionAccounts": []}
+	], "investmentInstitutions": []}]`)
+
+	err := Sync(newSyncTestApp(t))
+	if err == nil || !strings.Contains(err.Error(), "failed to sync 1 of 2 institutions") {
+		t.Fatalf("expected Sync to report one failed institution, got %v", err)
+	}
+
+	synced := loadSyncTestOwners(t, tempDir)
+	inst, ok := synced[1].TransactionInstitution("mock-bank")
+	if !ok || inst.InstitutionBase.Cursor != "cursor-1" {
+		t.Fatalf("expected bob's mock-bank to be synced after alice's save failed, got %+v", inst)
+	}
+}
+
+// testdataDir is absolute, as setupSyncTest moves each test to its own
+// working directory.
+var testdataDir, _ = filepath.Abs("testdata")
+
+// setupSyncTest serves mux as the Sandbox Plaid environment, fixes the sync
+// date to 2024-06-01 and runs the test in a temporary directory holding the
+// test config, which it returns.
+func setupSyncTest(t *testing.T, mux http.Handler) string {
+	t.Helper()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	origEnv, ok := plaidclient.Environment("Sandbox")
+	plaidclient.SetEnvironment("Sandbox", plaid.Environment(server.URL))
+	t.Cleanup(func() {
+		if ok {
+			plaidclient.SetEnvironment("Sandbox", origEnv)
+		}
+	})
+	stubSyncNow(t)
+
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get wd: %v", err)
+	}
+	tempDir := t.TempDir()
+	if err := os.Chdir(tempDir); err != nil {
+		t.Fatalf("failed to chdir: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(origDir)
+	})
+
+	copySyncTestFile(t, filepath.Join(testdataDir, "config.yaml"), filepath.Join(tempDir, "config.yaml"))
+	return tempDir
+}
+
+func stubSyncNow(t *testing.T) {
+	t.Helper()
+	origNow := nowFn
+	nowFn = func() time.Time { return time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() {
+		nowFn = origNow
+	})
+}
+
+// stubSyncSleep records the backoffs sync would sleep for instead of
+// sleeping.
+func stubSyncSleep(t *testing.T) *[]time.Duration {
+	t.Helper()
+	origSleep := sleepFn
+	var slept []time.Duration
+	sleepFn = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() {
+		sleepFn = origSleep
+	})
+	return &slept
+}
+
+func writeSyncTestOwners(t *testing.T, dir, owners string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "owners.yaml"), []byte(owners), 0644); err != nil {
+		t.Fatalf("failed to write owners: %v", err)
+	}
+}
+
+func loadSyncTestOwners(t *testing.T, dir string) []types.Owner {
+	t.Helper()
+	owners, err := persistence.LoadOwners(filepath.Join(dir, "owners.yaml"))
+	if err != nil {
+		t.Fatalf("failed to load owners: %v", err)
+	}
+	return owners
 }
 
 func copySyncTestFile(t *testing.T, src, dst string) {
@@ -147,39 +487,39 @@ func copySyncTestFile(t *testing.T, src, dst string) {
 	}
 }
 
-func newPlaidTestServer(t *testing.T, baseDir string) *httptest.Server {
+func newPlaidTestMux(t *testing.T) *http.ServeMux {
 	t.Helper()
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/accounts/get", func(w http.ResponseWriter, r *http.Request) {
 		ensureMethod(t, r, http.MethodPost)
-		ensureRequestBody(t, r.Body, filepath.Join(baseDir, "testdata", "server_accounts_request.json"))
+		ensureRequestBody(t, r.Body, filepath.Join(testdataDir, "server_accounts_request.json"))
 		w.Header().Set("Content-Type", "application/json")
-		serveJSON(t, w, filepath.Join(baseDir, "testdata", "server_accounts_response.json"))
+		serveJSON(t, w, filepath.Join(testdataDir, "server_accounts_response.json"))
 	})
 
 	mux.HandleFunc("/transactions/sync", func(w http.ResponseWriter, r *http.Request) {
 		ensureMethod(t, r, http.MethodPost)
-		ensureRequestBody(t, r.Body, filepath.Join(baseDir, "testdata", "server_transactions_request.json"))
+		ensureRequestBody(t, r.Body, filepath.Join(testdataDir, "server_transactions_request.json"))
 		w.Header().Set("Content-Type", "application/json")
-		serveJSON(t, w, filepath.Join(baseDir, "testdata", "server_transactions_response.json"))
+		serveJSON(t, w, filepath.Join(testdataDir, "server_transactions_response.json"))
 	})
 
 	mux.HandleFunc("/investments/holdings/get", func(w http.ResponseWriter, r *http.Request) {
 		ensureMethod(t, r, http.MethodPost)
-		ensureRequestBody(t, r.Body, filepath.Join(baseDir, "testdata", "server_investment_holdings_request.json"))
+		ensureRequestBody(t, r.Body, filepath.Join(testdataDir, "server_investment_holdings_request.json"))
 		w.Header().Set("Content-Type", "application/json")
-		serveJSON(t, w, filepath.Join(baseDir, "testdata", "server_investment_holdings_response.json"))
+		serveJSON(t, w, filepath.Join(testdataDir, "server_investment_holdings_response.json"))
 	})
 
 	mux.HandleFunc("/investments/transactions/get", func(w http.ResponseWriter, r *http.Request) {
 		ensureMethod(t, r, http.MethodPost)
-		ensureRequestBody(t, r.Body, filepath.Join(baseDir, "testdata", "server_investment_transactions_request.json"))
+		ensureRequestBody(t, r.Body, filepath.Join(testdataDir, "server_investment_transactions_request.json"))
 		w.Header().Set("Content-Type", "application/json")
-		serveJSON(t, w, filepath.Join(baseDir, "testdata", "server_investment_transactions_response.json"))
+		serveJSON(t, w, filepath.Join(testdataDir, "server_investment_transactions_response.json"))
 	})
 
-	return httptest.NewServer(mux)
+	return mux
 }
 
 func ensureMethod(t *testing.T, r *http.Request, method string) {
@@ -267,3 +607,317 @@ func jsonEqual(leftRaw, rightRaw []byte) bool {
 	}
 	return reflect.DeepEqual(left, right)
 }
+
+// pagedSyncMux serves a two page /transactions/sync from an empty cursor,
+// failing the first request for page two with status and body. It records
+// the cursor of every request.
+func pagedSyncMux(t *testing.T, status int, body string, cursors *[]string) *http.ServeMux {
+	t.Helper()
+	failSecondPage := true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accounts/get", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		serveJSON(t, w, filepath.Join(testdataDir, "server_accounts_response.json"))
+	})
+	mux.HandleFunc("/transactions/sync", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Cursor string `json:"cursor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		*cursors = append(*cursors, req.Cursor)
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Cursor {
+		case "":
+			fmt.Fprint(w, `{"added": [{"account_id": "account-1", "transaction_id": "txn-1", "name": "Page One", "amount": 1, "date": "2024-01-01"}],
+				"modified": [], "removed": [], "next_cursor": "cursor-1", "has_more": true, "request_id": "p1"}`)
+		case "cursor-1":
+			if failSecondPage {
+				failSecondPage = false
+				w.WriteHeader(status)
+				fmt.Fprint(w, body)
+				return
+			}
+			fmt.Fprint(w, `{"added": [{"account_id": "account-1", "transaction_id": "txn-2", "name": "Page Two", "amount": 2, "date": "2024-01-02"}],
+				"modified": [], "removed": [], "next_cursor": "cursor-2", "has_more": false, "request_id": "p2"}`)
+		default:
+			t.Errorf("unexpected cursor %q", req.Cursor)
+		}
+	})
+	return mux
+}
+
+func TestSyncRestartsFailedLoopFromItsCursor(t *testing.T) {
+	stubSyncSleep(t)
+	var cursors []string
+	tempDir := setupSyncTest(t, pagedSyncMux(t, http.StatusBadRequest,
+		`{"error_type": "TRANSACTIONS_ERROR", "error_code": "TRANSACTIONS_SYNC_MUTATION_DURING_PAGINATION", "error_message": "restart", "request_id": "p2"}`, &cursors))
+	writeSyncTestOwners(t, tempDir, `[{"name": "alice", "transactionInstitutions": [
+		{"institutionBase": {"name": "mock-bank", "accessToken": "token-123", "cursor": ""}, "transactionAccounts": []}
+	], "investmentInstitutions": []}]`)
+
+	if err := Sync(newSyncTestApp(t)); err != nil {
+		t.Fatalf("expected Sync to succeed after restarting: %v", err)
+	}
+	if want := []string{"", "cursor-1", "", "cursor-1"}; !reflect.DeepEqual(cursors, want) {
+		t.Fatalf("expected the loop to restart from the empty cursor, requested %q", cursors)
+	}
+	inst, _ := loadSyncTestOwners(t, tempDir)[0].TransactionInstitution("mock-bank")
+	account, _ := inst.TransactionAccount("account-1")
+	if inst.InstitutionBase.Cursor != "cursor-2" || len(account.Transactions) != 2 {
+		t.Fatalf("expected both pages to be stored, got cursor %q and %d txns", inst.InstitutionBase.Cursor, len(account.Transactions))
+	}
+}
+
+func TestSyncResumesFromLastCommittedPage(t *testing.T) {
+	var cursors []string
+	tempDir := setupSyncTest(t, pagedSyncMux(t, http.StatusInternalServerError,
+		`{"error_type": "API_ERROR", "error_code": "INTERNAL_SERVER_ERROR", "error_message": "boom", "request_id": "p2"}`, &cursors))
+	writeSyncTestOwners(t, tempDir, `[{"name": "alice", "transactionInstitutions": [
+		{"institutionBase": {"name": "mock-bank", "accessToken": "token-123", "cursor": ""}, "transactionAccounts": []}
+	], "investmentInstitutions": []}]`)
+
+	loadInst := func() types.TransactionInstitution {
+		t.Helper()
+		inst, _ := loadSyncTestOwners(t, tempDir)[0].TransactionInstitution("mock-bank")
+		return inst
+	}
+
+	if err := Sync(newSyncTestApp(t)); err == nil {
+		t.Fatalf("expected the first Sync to fail on page two")
+	}
+	inst := loadInst()
+	account, _ := inst.TransactionAccount("account-1")
+	if inst.InstitutionBase.Cursor != "cursor-1" || len(account.Transactions) != 1 {
+		t.Fatalf("expected page one to be kept, got cursor %q and %d txns", inst.InstitutionBase.Cursor, len(account.Transactions))
+	}
+
+	cursors = nil
+	if err := Sync(newSyncTestApp(t)); err != nil {
+		t.Fatalf("expected the second Sync to succeed: %v", err)
+	}
+	if want := []string{"cursor-1"}; !reflect.DeepEqual(cursors, want) {
+		t.Fatalf("expected sync to resume from cursor-1, requested %q", cursors)
+	}
+	inst = loadInst()
+	account, _ = inst.TransactionAccount("account-1")
+	if inst.InstitutionBase.Cursor != "cursor-2" || len(account.Transactions) != 2 {
+		t.Fatalf("expected both pages to be stored, got cursor %q and %d txns", inst.InstitutionBase.Cursor, len(account.Transactions))
+	}
+}
+
+func TestSyncRestartsPaginationAfterMutation(t *testing.T) {
+	slept := stubSyncSleep(t)
+
+	mutated := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Cursor string `json:"cursor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Cursor == "start" && !mutated:
+			// Seen only before the mutation; must not survive the restart.
+			fmt.Fprint(w, `{"added": [{"account_id": "account-1", "transaction_id": "txn-stale", "name": "Stale", "amount": 1, "date": "2024-01-01"}],
+				"modified": [{"account_id": "account-1", "transaction_id": "txn-old", "name": "Changed Too Early", "amount": 9, "date": "2023-12-01"}],
+				"removed": [], "next_cursor": "page-1", "has_more": true, "request_id": "p1"}`)
+		case req.Cursor == "page-1" && !mutated:
+			mutated = true
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error_type": "TRANSACTIONS_ERROR", "error_code": "TRANSACTIONS_SYNC_MUTATION_DURING_PAGINATION", "error_message": "restart", "request_id": "p2"}`)
+		case req.Cursor == "start":
+			fmt.Fprint(w, `{"added": [{"account_id": "account-1", "transaction_id": "txn-1", "name": "Fresh", "amount": 1, "date": "2024-01-01"}],
+				"modified": [], "removed": [], "next_cursor": "page-1b", "has_more": true, "request_id": "p1b"}`)
+		case req.Cursor == "page-1b":
+			fmt.Fprint(w, `{"added": [{"account_id": "account-1", "transaction_id": "txn-2", "name": "Fresh Two", "amount": 2, "date": "2024-01-02"}],
+				"modified": [], "removed": [], "next_cursor": "page-2b", "has_more": false, "request_id": "p2b"}`)
+		default:
+			t.Errorf("unexpected cursor %q", req.Cursor)
+		}
+	}))
+	defer server.Close()
+
+	store := persistence.NewJSONStore(filepath.Join(t.TempDir(), "owners.yaml"))
+	oldTxn := plaid.Transaction{TransactionId: "txn-old", AccountId: "account-1", Name: "Original", Amount: 5, Date: "2023-12-01"}
+	inst := types.TransactionInstitution{
+		InstitutionBase: types.InstitutionBase{Name: "mock-bank", AccessToken: "token-123", Cursor: "start"},
+		TransactionAccounts: []types.TransactionAccount{
+			{
+				AccoutBase:   plaid.AccountBase{AccountId: "account-1", Name: "Checking", Type: plaid.ACCOUNTTYPE_DEPOSITORY},
+				Transactions: map[string]plaid.Transaction{"txn-old": oldTxn},
+			},
+		},
+	}
+	if err := store.DumpOwners([]types.Owner{{Name: "alice", TransactionInstitutions: []types.TransactionInstitution{inst}}}); err != nil {
+		t.Fatalf("failed to seed store: %v", err)
+	}
+
+	cli := plaidclient.New("client", "secret", server.URL)
+	inst, counts, err := syncTransactions(context.Background(), cli, store, "alice", inst, nil)
+	if err != nil {
+		t.Fatalf("syncTransactions returned error: %v", err)
+	}
+
+	if len(*slept) != 1 {
+		t.Fatalf("expected one backoff, got %v", *slept)
+	}
+	if counts.added != 2 || counts.modified != 0 {
+		t.Fatalf("expected counts of the successful attempt only, got %+v", counts)
+	}
+
+	owners, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("failed to load store: %v", err)
+	}
+	for _, got := range []types.TransactionInstitution{inst, owners[0].TransactionInstitutions[0]} {
+		account, _ := got.TransactionAccount("account-1")
+		if got.InstitutionBase.Cursor != "page-2b" {
+			t.Fatalf("expected cursor page-2b, got %q", got.InstitutionBase.Cursor)
+		}
+		if _, ok := account.Transactions["txn-stale"]; ok {
+			t.Fatalf("expected txn-stale from the discarded attempt to be rolled back")
+		}
+		if account.Transactions["txn-old"].Name != "Original" {
+			t.Fatalf("expected txn-old to be restored, got %+v", account.Transactions["txn-old"])
+		}
+		if len(account.Transactions) != 3 {
+			t.Fatalf("expected txn-old, txn-1 and txn-2, got %v", account.Transactions)
+		}
+	}
+}
+
+func TestSyncGivesUpAfterRepeatedMutations(t *testing.T) {
+	stubSyncSleep(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error_type": "TRANSACTIONS_ERROR", "error_code": "TRANSACTIONS_SYNC_MUTATION_DURING_PAGINATION", "error_message": "restart", "request_id": "r"}`)
+	}))
+	defer server.Close()
+
+	store := persistence.NewJSONStore(filepath.Join(t.TempDir(), "owners.yaml"))
+	inst := types.TransactionInstitution{
+		InstitutionBase: types.InstitutionBase{Name: "mock-bank", AccessToken: "token-123"},
+	}
+	if err := store.DumpOwners([]types.Owner{{Name: "alice", TransactionInstitutions: []types.TransactionInstitution{inst}}}); err != nil {
+		t.Fatalf("failed to seed store: %v", err)
+	}
+
+	cli := plaidclient.New("client", "secret", server.URL)
+	if _, _, err := syncTransactions(context.Background(), cli, store, "alice", inst, nil); !isMutationDuringPagination(err) {
+		t.Fatalf("expected mutation error after retries, got %v", err)
+	}
+	if requests != maxPaginationAttempts {
+		t.Fatalf("expected %d attempts, got %d", maxPaginationAttempts, requests)
+	}
+}
+
+func TestSyncRollsBackFinalAttemptFailingOnPageTwo(t *testing.T) {
+	stubSyncSleep(t)
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Cursor string `json:"cursor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch req.Cursor {
+		case "start":
+			attempts++
+			fmt.Fprint(w, `{"added": [{"account_id": "account-1", "transaction_id": "txn-stale", "name": "Stale", "amount": 1, "date": "2024-01-01"}],
+				"modified": [{"account_id": "account-1", "transaction_id": "txn-old", "name": "Changed", "amount": 9, "date": "2023-12-01"}],
+				"removed": [], "next_cursor": "page-1", "has_more": true, "request_id": "p1"}`)
+		case "page-1":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error_type": "TRANSACTIONS_ERROR", "error_code": "TRANSACTIONS_SYNC_MUTATION_DURING_PAGINATION", "error_message": "restart", "request_id": "p2"}`)
+		default:
+			t.Errorf("unexpected cursor %q", req.Cursor)
+		}
+	}))
+	defer server.Close()
+
+	store := persistence.NewJSONStore(filepath.Join(t.TempDir(), "owners.yaml"))
+	oldTxn := plaid.Transaction{TransactionId: "txn-old", AccountId: "account-1", Name: "Original", Amount: 5, Date: "2023-12-01"}
+	inst := types.TransactionInstitution{
+		InstitutionBase: types.InstitutionBase{Name: "mock-bank", AccessToken: "token-123", Cursor: "start"},
+		TransactionAccounts: []types.TransactionAccount{
+			{
+				AccoutBase:   plaid.AccountBase{AccountId: "account-1", Name: "Checking", Type: plaid.ACCOUNTTYPE_DEPOSITORY},
+				Transactions: map[string]plaid.Transaction{"txn-old": oldTxn},
+			},
+		},
+	}
+	if err := store.DumpOwners([]types.Owner{{Name: "alice", TransactionInstitutions: []types.TransactionInstitution{inst}}}); err != nil {
+		t.Fatalf("failed to seed store: %v", err)
+	}
+
+	cli := plaidclient.New("client", "secret", server.URL)
+	inst, _, err := syncTransactions(context.Background(), cli, store, "alice", inst, nil)
+	if !isMutationDuringPagination(err) {
+		t.Fatalf("expected mutation error after retries, got %v", err)
+	}
+	if attempts != maxPaginationAttempts {
+		t.Fatalf("expected %d attempts, got %d", maxPaginationAttempts, attempts)
+	}
+
+	owners, err := store.LoadOwners()
+	if err != nil {
+		t.Fatalf("failed to load store: %v", err)
+	}
+	for _, got := range []types.TransactionInstitution{inst, owners[0].TransactionInstitutions[0]} {
+		if got.InstitutionBase.Cursor != "start" {
+			t.Fatalf("expected cursor to be reset to start, got %q", got.InstitutionBase.Cursor)
+		}
+		account, _ := got.TransactionAccount("account-1")
+		if len(account.Transactions) != 1 || account.Transactions["txn-old"].Name != "Original" {
+			t.Fatalf("expected only the original txn-old, got %v", account.Transactions)
+		}
+	}
+}
+
+func TestDecodePlaidError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error_type": "ITEM_ERROR", "error_code": "ITEM_LOGIN_REQUIRED", "error_message": "login required", "request_id": "req-1"}`)
+	}))
+	defer server.Close()
+
+	cli := plaidclient.New("client", "secret", server.URL)
+	_, err := getTransactionAccounts(context.Background(), cli, types.InstitutionBase{AccessToken: "token"})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	var plaidErr *PlaidError
+	if !errors.As(err, &plaidErr) {
+		t.Fatalf("expected a *PlaidError in chain, got %v", err)
+	}
+	if plaidErr.Type != "ITEM_ERROR" || plaidErr.Code != "ITEM_LOGIN_REQUIRED" || plaidErr.RequestID != "req-1" {
+		t.Fatalf("unexpected decoded error: %+v", plaidErr)
+	}
+	if !needsUpdateMode(err) {
+		t.Fatalf("expected ITEM_LOGIN_REQUIRED to need update mode")
+	}
+}
+
+// newSyncTestApp loads the app context for the config.yaml in the working
+// directory, the way the root command does.
+func newSyncTestApp(t *testing.T) *app.Context {
+	t.Helper()
+	appCtx, err := app.Load(app.Options{ConfigPath: "config.yaml"})
+	if err != nil {
+		t.Fatalf("failed to load app context: %v", err)
+	}
+	return appCtx
+}
@@ -0,0 +1,106 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Compile validates the categorisation rules and compiles their regexes,
+// so that they are compiled once however many transactions are matched.
+// Errors name the offending rule, e.g. keyword_rules[2].match.payee.regex.
+func (c *PostprocessConfig) Compile() error {
+	if c.Categorise == nil {
+		return nil
+	}
+	for i := range c.Categorise.KeywordRules {
+		path := fmt.Sprintf("postprocess.categorise.keyword_rules[%d].match", i)
+		if err := c.Categorise.KeywordRules[i].Match.compile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MatchCriteria) compile(path string) error {
+	texts := []struct {
+		name string
+		crit *TextCriteria
+	}{
+		{"description", &m.Description},
+		{"payee", &m.Payee},
+		{"from_account", &m.FromAccount},
+		{"to_account", &m.ToAccount},
+	}
+	for _, t := range texts {
+		if err := t.crit.compile(path + "." + t.name); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(m.Metadata))
+	for key := range m.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		crit := m.Metadata[key]
+		if err := crit.compile(path + ".metadata." + key); err != nil {
+			return err
+		}
+		m.Metadata[key] = crit
+	}
+
+	if m.Amount.Min != nil && m.Amount.Max != nil && *m.Amount.Min > *m.Amount.Max {
+		return fmt.Errorf("invalid %s.amount: min %v is above max %v", path, *m.Amount.Min, *m.Amount.Max)
+	}
+	for _, d := range []struct{ name, value string }{{"from", m.Date.From}, {"to", m.Date.To}} {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d.value); err != nil {
+			return fmt.Errorf("invalid %s.date.%s %q: want YYYY-MM-DD", path, d.name, d.value)
+		}
+	}
+	if m.Date.From != "" && m.Date.To != "" && m.Date.From > m.Date.To {
+		return fmt.Errorf("invalid %s.date: from %s is after to %s", path, m.Date.From, m.Date.To)
+	}
+
+	for i := range m.Any {
+		if err := m.Any[i].compile(fmt.Sprintf("%s.any[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	for i := range m.All {
+		if err := m.All[i].compile(fmt.Sprintf("%s.all[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	if m.Not != nil {
+		return m.Not.compile(path + ".not")
+	}
+	return nil
+}
+
+func (t *TextCriteria) compile(path string) error {
+	if t.Regex == "" || t.regex != nil {
+		return nil
+	}
+
+	pattern := t.Regex
+	if t.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid %s.regex: %w", path, err)
+	}
+	t.regex = re
+	return nil
+}
+
+// Regexp returns the compiled Regex, or nil before Compile.
+func (t TextCriteria) Regexp() *regexp.Regexp {
+	return t.regex
+}
@@ -1,6 +1,10 @@
 package types
 
 import (
+	"regexp"
+	"sort"
+	"time"
+
 	"github.com/plaid/plaid-go/plaid"
 )
 
@@ -17,11 +21,83 @@ type Config struct {
 	Environment string            `yaml:"environment"`
 	Postprocess PostprocessConfig `yaml:"postprocess"`
 	Storage     StorageConfig     `yaml:"storage"`
+	Dump        DumpConfig        `yaml:"dump"`
+	// Accounts override how dump writes single Plaid accounts, keyed by
+	// Plaid account id or by "owner/institution/mask".
+	Accounts map[string]AccountConfig `yaml:"accounts"`
+}
+
+// AccountConfig fixes up an account Plaid names or classifies badly, e.g.
+// an HSA, a loan or a prepaid card.
+type AccountConfig struct {
+	// Name replaces the whole Beancount account name, e.g.
+	// "Assets:Alice:US:HSA".
+	Name string `yaml:"name"`
+	// Exclude leaves the account and its transactions out of the dump.
+	Exclude bool `yaml:"exclude"`
+	// Type forces the account to "Assets" or "Liabilities".
+	Type string `yaml:"type"`
+}
+
+type DumpConfig struct {
+	// Region replaces the currency code as the second segment of generated
+	// account names, e.g. "US" for Assets:Alice:US:... Mapped category
+	// accounts are used as written. Empty keeps the currency for
+	// compatibility with existing ledgers.
+	Region string `yaml:"region"`
+	// Balance picks the Plaid balance asserted for asset accounts:
+	// "available" (default) or "current". Credit and loan accounts always
+	// assert the current balance.
+	Balance string `yaml:"balance"`
+	// Layout, when set, splits the output into one file per owner and
+	// institution, named by it relative to the output file, e.g.
+	// "{owner}/{institution}.beancount". The output file then includes
+	// them and accounts.beancount, which holds the open directives.
+	Layout string `yaml:"layout"`
+	// Aliases name accounts by Plaid account id, replacing the Plaid
+	// account name in the Beancount account, e.g. to tell apart two cards
+	// both called "Credit Card".
+	Aliases map[string]string `yaml:"aliases"`
+	// Categories map Plaid personal finance categories to Expenses and
+	// Income accounts.
+	Categories CategoriesConfig `yaml:"categories"`
+	// Templates replace the built-in Beancount templates.
+	Templates TemplatesConfig `yaml:"templates"`
+}
+
+// CategoriesConfig maps Plaid personal finance categories, detailed (e.g.
+// FOOD_AND_DRINK_GROCERIES) or primary (e.g. FOOD_AND_DRINK), to accounts
+// such as Expenses:Food:Groceries.
+type CategoriesConfig struct {
+	// File replaces the built-in mapping file.
+	File string `yaml:"file"`
+	// Map adds to and overrides the mapping file.
+	Map map[string]string `yaml:"map"`
+}
+
+// TemplatesConfig names text/template files replacing the built-in
+// templates; an empty path keeps the built-in one.
+type TemplatesConfig struct {
+	Transaction string `yaml:"transaction"`
+	OpenAccount string `yaml:"openAccount"`
+	Commodity   string `yaml:"commodity"`
+	Holding     string `yaml:"holding"`
+	Price       string `yaml:"price"`
 }
 
 type StorageConfig struct {
 	Backend string `yaml:"backend"` // "json" or "sqlite", default "sqlite"
 	Path    string `yaml:"path"`    // file path; defaults to "./owners.yaml" for json, "./owners.db" for sqlite
+
+	Encryption EncryptionConfig `yaml:"encryption"`
+}
+
+// EncryptionConfig selects where the key sealing access tokens at rest comes
+// from. At most one source may be set; with none, tokens are stored as is.
+type EncryptionConfig struct {
+	KeyFile       string `yaml:"keyFile"`       // file holding a base64-encoded 32-byte key
+	KeyEnv        string `yaml:"keyEnv"`        // environment variable holding a base64-encoded 32-byte key
+	PassphraseEnv string `yaml:"passphraseEnv"` // environment variable holding a passphrase, stretched with PBKDF2
 }
 
 type PostprocessConfig struct {
@@ -46,15 +122,46 @@ type KeywordRule struct {
 	Set   SetMutations  `yaml:"set"`
 }
 
+// MatchCriteria matches a transaction when every criterion set matches.
 type MatchCriteria struct {
 	Description TextCriteria            `yaml:"description"`
 	Payee       TextCriteria            `yaml:"payee"`
 	Metadata    map[string]TextCriteria `yaml:"metadata"`
+	// FromAccount and ToAccount match the Beancount names of the two legs.
+	FromAccount TextCriteria `yaml:"from_account"`
+	ToAccount   TextCriteria `yaml:"to_account"`
+	// Owner is the owner of the account the transaction posted to.
+	Owner  string         `yaml:"owner"`
+	Amount AmountCriteria `yaml:"amount"`
+	Date   DateCriteria   `yaml:"date"`
+
+	// Any, All and Not compose criteria: at least one of Any, all of All
+	// and not Not must match.
+	Any []MatchCriteria `yaml:"any"`
+	All []MatchCriteria `yaml:"all"`
+	Not *MatchCriteria  `yaml:"not"`
 }
 
 type TextCriteria struct {
-	Contains []string `yaml:"contains"`
-	Equals   string   `yaml:"equals"`
+	Contains   []string `yaml:"contains"`
+	Equals     string   `yaml:"equals"`
+	Regex      string   `yaml:"regex"`
+	IgnoreCase bool     `yaml:"ignore_case"`
+
+	regex *regexp.Regexp
+}
+
+// AmountCriteria bounds the transaction amount, which is never negative,
+// inclusively.
+type AmountCriteria struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// DateCriteria bounds the transaction date inclusively, as YYYY-MM-DD.
+type DateCriteria struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
 }
 
 type SetMutations struct {
@@ -145,6 +252,12 @@ type InstitutionBase struct {
 	Name        string `json:"name"`
 	AccessToken string `json:"accessToken"`
 	Cursor      string `json:"cursor"`
+	// LastSyncedDate is the end date of the last successful investment
+	// transactions fetch, used as the watermark for incremental syncs.
+	LastSyncedDate string `json:"lastSyncedDate,omitempty"`
+	// NeedsUpdate is set when Plaid reports ITEM_LOGIN_REQUIRED and cleared
+	// by the next successful sync or relink.
+	NeedsUpdate bool `json:"needsUpdate,omitempty"`
 }
 
 type TransactionInstitution struct {
@@ -197,9 +310,111 @@ func (ti TransactionInstitution) CreateOrUpdateTransactionAccountBases(accountBa
 	return ti
 }
 
+// TransactionSyncPage is one page of a /transactions/sync response, limited
+// to the accounts known to the institution, together with the account bases
+// it refers to and the cursor that follows it.
+type TransactionSyncPage struct {
+	AccountBases []plaid.AccountBase `json:"accountBases"`
+	// BalanceSnapshots are the balances fetched with AccountBases; applying
+	// the same snapshot twice records it once.
+	BalanceSnapshots []BalanceSnapshot   `json:"balanceSnapshots,omitempty"`
+	Added            []plaid.Transaction `json:"added"`
+	Modified         []plaid.Transaction `json:"modified"`
+	Removed          []string            `json:"removed"`
+	NextCursor       string              `json:"nextCursor"`
+}
+
+func (ti TransactionInstitution) ApplyTransactionSyncPage(page TransactionSyncPage) TransactionInstitution {
+	ti = ti.CreateOrUpdateTransactionAccountBases(page.AccountBases)
+	ti = ti.AddBalanceSnapshots(page.BalanceSnapshots)
+
+	for _, txns := range [][]plaid.Transaction{page.Added, page.Modified} {
+		for _, txn := range txns {
+			account, ok := ti.TransactionAccount(txn.AccountId)
+			if !ok {
+				continue
+			}
+
+			if account.Transactions == nil {
+				account.Transactions = map[string]plaid.Transaction{}
+			}
+			account.Transactions[txn.TransactionId] = txn
+			ti = ti.CreateOrUpdateTransactionAccount(account)
+		}
+	}
+
+	for _, id := range page.Removed {
+		for _, account := range ti.TransactionAccounts {
+			if _, ok := account.Transactions[id]; ok {
+				delete(account.Transactions, id)
+				ti = ti.CreateOrUpdateTransactionAccount(account)
+				break
+			}
+		}
+	}
+
+	ti.InstitutionBase.Cursor = page.NextCursor
+	return ti
+}
+
+func (ti TransactionInstitution) AddBalanceSnapshots(snapshots []BalanceSnapshot) TransactionInstitution {
+	for _, snapshot := range snapshots {
+		account, ok := ti.TransactionAccount(snapshot.AccountID)
+		if !ok {
+			continue
+		}
+		account.BalanceHistory = addBalanceSnapshot(account.BalanceHistory, snapshot)
+		ti = ti.CreateOrUpdateTransactionAccount(account)
+	}
+	return ti
+}
+
 type TransactionAccount struct {
 	AccoutBase   plaid.AccountBase            `json:"accountBase"`
 	Transactions map[string]plaid.Transaction `json:"transactions"`
+	// BalanceHistory holds every balance fetched for the account, oldest
+	// first.
+	BalanceHistory []BalanceSnapshot `json:"balanceHistory,omitempty"`
+}
+
+// BalanceSnapshot is the balance Plaid reported for an account when it was
+// fetched at FetchedAt.
+type BalanceSnapshot struct {
+	AccountID string               `json:"accountId"`
+	FetchedAt time.Time            `json:"fetchedAt"`
+	Balances  plaid.AccountBalance `json:"balances"`
+}
+
+// NewBalanceSnapshots records the balances of accountBases as fetched at
+// fetchedAt, kept to the second in UTC so they compare equal once stored.
+func NewBalanceSnapshots(accountBases []plaid.AccountBase, fetchedAt time.Time) []BalanceSnapshot {
+	fetchedAt = fetchedAt.UTC().Truncate(time.Second)
+	snapshots := make([]BalanceSnapshot, 0, len(accountBases))
+	for _, acb := range accountBases {
+		snapshots = append(snapshots, BalanceSnapshot{
+			AccountID: acb.AccountId,
+			FetchedAt: fetchedAt,
+			Balances:  acb.Balances,
+		})
+	}
+	return snapshots
+}
+
+// addBalanceSnapshot inserts snapshot into history in FetchedAt order,
+// replacing a snapshot fetched at the same time.
+func addBalanceSnapshot(history []BalanceSnapshot, snapshot BalanceSnapshot) []BalanceSnapshot {
+	i := sort.Search(len(history), func(i int) bool {
+		return !history[i].FetchedAt.Before(snapshot.FetchedAt)
+	})
+	if i < len(history) && history[i].FetchedAt.Equal(snapshot.FetchedAt) {
+		history[i] = snapshot
+		return history
+	}
+
+	history = append(history, BalanceSnapshot{})
+	copy(history[i+1:], history[i:])
+	history[i] = snapshot
+	return history
 }
 
 type InvestmentInstitution struct {
@@ -212,6 +427,9 @@ type InvestmentAccount struct {
 	Holdings     []plaid.Holding                        `json:"holdings"`
 	Securities   map[string]plaid.Security              `json:"securities"`
 	Transactions map[string]plaid.InvestmentTransaction `json:"transactions"`
+	// BalanceHistory holds every balance fetched for the account, oldest
+	// first.
+	BalanceHistory []BalanceSnapshot `json:"balanceHistory,omitempty"`
 }
 
 func (ii InvestmentInstitution) InvestmentAccount(id string) (InvestmentAccount, bool) {
@@ -258,3 +476,15 @@ func (ii InvestmentInstitution) CreateOrUpdateInvestmentAccountBases(accountBase
 
 	return ii
 }
+
+func (ii InvestmentInstitution) AddBalanceSnapshots(snapshots []BalanceSnapshot) InvestmentInstitution {
+	for _, snapshot := range snapshots {
+		account, ok := ii.InvestmentAccount(snapshot.AccountID)
+		if !ok {
+			continue
+		}
+		account.BalanceHistory = addBalanceSnapshot(account.BalanceHistory, snapshot)
+		ii = ii.CreateOrUpdateInvestmentAccount(account)
+	}
+	return ii
+}